@@ -0,0 +1,320 @@
+package main
+
+import "fmt"
+
+// shadowWarnings returns a warning for each lambda parameter in the tree rooted
+// at n which has the same name as an enclosing lambda parameter or definition,
+// or as a symbol in env, in which case the symbol can't be referred to within
+// the lambda's body. The warnings are in the order that the lambdas appear in
+// the program.
+func shadowWarnings(n *node, env *environment) []string {
+	var warnings []string
+	walkScope(n, func(n *node, sc *scope) {
+		if n.typ != nodeLam {
+			return
+		}
+		param := n.val.(*lamNode).param
+		if w := shadowWarning(param, sc.bound(param), env); w != "" {
+			warnings = append(warnings, w)
+		}
+	})
+	return warnings
+}
+
+// shadowWarning returns a warning if the lambda parameter param shadows another
+// binding, or an empty string otherwise. bound tells whether param is already
+// bound within the program.
+func shadowWarning(param string, bound bool, env *environment) string {
+	if bound {
+		return fmt.Sprintf("lam parameter '%s' shadows an outer binding", param)
+	}
+	obj := env.lookup(param)
+	switch {
+	case obj.typ == objectError:
+		return ""
+	case defaultEnvironment.lookup(param) == obj:
+		return fmt.Sprintf("lam parameter '%s' shadows a built-in", param)
+	default:
+		return fmt.Sprintf("lam parameter '%s' shadows a definition", param)
+	}
+}
+
+// unusedParams returns a description of each lambda parameter in the tree
+// rooted at n which doesn't occur free in the lambda's body, such as x in
+// "lam x 5". A parameter named _ is meant to be unused, so it isn't reported.
+// Each description consists of the parameter name followed by the path of
+// enclosing definitions and lambdas leading to it, e.g.
+// "y (in def f > lam x > lam y)".
+func unusedParams(n *node) []string {
+	var unused []string
+	walkScope(n, func(n *node, sc *scope) {
+		if n.typ != nodeLam {
+			return
+		}
+		lam := n.val.(*lamNode)
+		if lam.param != "_" && !occursFree(lam.param, lam.body) {
+			path := joinPath(sc.describe(n), "lam "+lam.param)
+			unused = append(unused, fmt.Sprintf("%s (in %s)", lam.param, path))
+		}
+	})
+	return unused
+}
+
+func joinPath(path, elem string) string {
+	if path == "" {
+		return elem
+	}
+	return path + " > " + elem
+}
+
+// arityError returns an error object for the first application of a built-in
+// function in the tree rooted at n to a different number of arguments than it
+// takes, such as "app add 1" or "app app app add 1 2 3", or nil if there isn't
+// one. Extra arguments are allowed for built-in functions that can return a
+// function, such as "app app app if true add 0 1". Applications are checked in
+// the order that they appear in the program, outermost first. Identifiers which
+// aren't bound within the tree are looked up in env. Built-in functions which
+// are only referred to, rather than applied, aren't checked, so they can still
+// be passed to other functions.
+func arityError(n *node, env *environment) *object {
+	var err *object
+	walkScope(n, func(n *node, sc *scope) {
+		if err != nil || n.typ != nodeApp || sc.isFunction(n) {
+			return
+		}
+		var args []*node
+		head := n
+		for head.typ == nodeApp {
+			app := head.val.(*appNode)
+			args = append(args, app.arg)
+			head = app.fn
+		}
+		if head.typ != nodeIdentifier || sc.bound(head.val.(string)) {
+			return
+		}
+		name := head.val.(string)
+		fn := env.lookup(name)
+		if arity, ok := builtinArity[fn]; ok {
+			tooFew := len(args) < arity
+			tooMany := len(args) > arity && !returnsFunction(fn)
+			if tooFew || tooMany {
+				err = kindErrorf(ArityError, "%s: expected %d arguments, got %d in %s", name, arity, len(args), sexpr(n))
+			}
+		}
+	})
+	return err
+}
+
+// returnsFunction returns true if the built-in function fn can return another
+// function once it's been applied to all of its arguments, according to its
+// type. It returns false if fn's type isn't known.
+func returnsFunction(fn *object) bool {
+	typeOf, ok := builtinTypes[fn]
+	if !ok {
+		return false
+	}
+	t := typeOf(new(inferrer))
+	for i := 0; i < builtinArity[fn]; i++ {
+		t = t.to
+	}
+	kind := t.prune().kind
+	return kind == typeVariable || kind == typeFunc
+}
+
+// divergenceWarnings returns a warning for each application in the tree rooted
+// at n which is certain to never terminate because it applies a self-applying
+// lambda function to another one, as in the omega combinator
+// "app (lam x app x x) (lam x app x x)". A lambda is self-applying if its body
+// applies its parameter to itself before doing anything else, e.g.
+// "lam x app app x x y". Identifiers which refer to definitions of such lambdas
+// are recognized as well. Telling whether a program terminates isn't possible
+// in general, so other programs which never terminate aren't reported.
+func divergenceWarnings(n *node) []string {
+	var warnings []string
+	walkScope(n, func(n *node, sc *scope) {
+		if n.typ != nodeApp {
+			return
+		}
+		resolve := func(n *node) *node {
+			if n.typ == nodeIdentifier {
+				if b := sc.binding(n.val.(string)); b != nil && b.typ == nodeDef {
+					return b.val.(*defNode).val
+				}
+			}
+			return n
+		}
+		app := n.val.(*appNode)
+		if isSelfApplying(resolve(app.fn)) && isSelfApplying(resolve(app.arg)) {
+			warnings = append(warnings, fmt.Sprintf("application never terminates: %s", sexpr(n)))
+		}
+	})
+	return warnings
+}
+
+// isSelfApplying returns true if n is a lambda function whose body applies its
+// parameter to itself, possibly followed by other arguments, e.g.
+// "lam x app x x" or "lam x app app x x 1".
+func isSelfApplying(n *node) bool {
+	if n.typ != nodeLam {
+		return false
+	}
+	lam := n.val.(*lamNode)
+	isParam := func(n *node) bool {
+		return n.typ == nodeIdentifier && n.val.(string) == lam.param
+	}
+	for body := lam.body; body.typ == nodeApp; {
+		app := body.val.(*appNode)
+		if isParam(app.fn) && isParam(app.arg) {
+			return true
+		}
+		body = app.fn
+	}
+	return false
+}
+
+// A scope describes where a node is within a tree: the nodes enclosing it, and
+// the names bound by them.
+type scope struct {
+	path     []*node            // enclosing nodes, outermost first
+	bindings map[string][]*node // nodes binding each name, innermost last
+}
+
+// bound returns true if name is bound within the tree.
+func (sc *scope) bound(name string) bool {
+	return len(sc.bindings[name]) > 0
+}
+
+// binding returns the lam, letrec, or def node whose binding of name is in
+// effect, or nil if name isn't bound within the tree.
+func (sc *scope) binding(name string) *node {
+	if b := sc.bindings[name]; len(b) > 0 {
+		return b[len(b)-1]
+	}
+	return nil
+}
+
+// isFunction returns true if n is the function of an application, in which
+// case it's part of the application enclosing it.
+func (sc *scope) isFunction(n *node) bool {
+	if len(sc.path) == 0 {
+		return false
+	}
+	parent := sc.path[len(sc.path)-1]
+	return parent.typ == nodeApp && parent.val.(*appNode).fn == n
+}
+
+// describe returns the path of the lambdas enclosing n, and of the definitions
+// and letrec expressions whose values enclose it, e.g. "def f > lam x".
+func (sc *scope) describe(n *node) string {
+	var path string
+	for i, outer := range sc.path {
+		child := n
+		if i+1 < len(sc.path) {
+			child = sc.path[i+1]
+		}
+		switch outer.typ {
+		case nodeLam:
+			path = joinPath(path, "lam "+outer.val.(*lamNode).param)
+		case nodeLetrec:
+			if letrec := outer.val.(*letrecNode); child == letrec.val {
+				path = joinPath(path, "letrec "+letrec.name)
+			}
+		case nodeDef:
+			if def := outer.val.(*defNode); child == def.val {
+				path = joinPath(path, "def "+def.name)
+			}
+		}
+	}
+	return path
+}
+
+// walkScope traverses the tree rooted at n in the same order as walk, calling
+// fn for each node with its scope: the enclosing nodes, and the bindings in
+// effect, which come from the enclosing lambda parameters and letrec
+// expressions, and the earlier definitions. A node's own binding isn't in scope
+// when fn is called for it, and a definition's name isn't in scope in its own
+// value. The scope is only valid during the call.
+func walkScope(n *node, fn func(n *node, sc *scope)) {
+	sc := &scope{bindings: make(map[string][]*node)}
+	bind := func(name string, n *node) {
+		sc.bindings[name] = append(sc.bindings[name], n)
+	}
+	unbind := func(name string) {
+		sc.bindings[name] = sc.bindings[name][:len(sc.bindings[name])-1]
+	}
+	var visit func(n *node)
+	visit = func(n *node) {
+		fn(n, sc)
+		sc.path = append(sc.path, n)
+		switch n.typ {
+		case nodeApp:
+			app := n.val.(*appNode)
+			visit(app.fn)
+			visit(app.arg)
+		case nodeLam:
+			lam := n.val.(*lamNode)
+			bind(lam.param, n)
+			visit(lam.body)
+			unbind(lam.param)
+		case nodeWhen:
+			when := n.val.(*whenNode)
+			visit(when.test)
+			visit(when.body)
+		case nodeSeq:
+			seq := n.val.(*seqNode)
+			visit(seq.first)
+			visit(seq.second)
+		case nodeLetrec:
+			letrec := n.val.(*letrecNode)
+			bind(letrec.name, n)
+			visit(letrec.val)
+			visit(letrec.body)
+			unbind(letrec.name)
+		case nodeDef:
+			def := n.val.(*defNode)
+			visit(def.val)
+			if def.body != nil {
+				bind(def.name, n)
+				visit(def.body)
+				unbind(def.name)
+			}
+		}
+		sc.path = sc.path[:len(sc.path)-1]
+	}
+	visit(n)
+}
+
+// unboundIdentifiers returns the names of the identifiers in the tree rooted at
+// n which aren't bound within the tree and for which defined returns false, so
+// that evaluating them would fail. Each name is only returned once, in the
+// order of its first occurrence. A definition's name is bound in the rest of
+// the program, but not in its own value.
+func unboundIdentifiers(n *node, defined func(name string) bool) []string {
+	var unbound []string
+	seen := make(map[string]bool)
+	walkScope(n, func(n *node, sc *scope) {
+		if n.typ != nodeIdentifier {
+			return
+		}
+		name := n.val.(string)
+		if !sc.bound(name) && !seen[name] && !defined(name) {
+			seen[name] = true
+			unbound = append(unbound, name)
+		}
+	})
+	return unbound
+}
+
+// boundIdentifiers returns the set of identifier nodes in the tree rooted at n
+// which refer to a binding within the tree: an enclosing lambda parameter or
+// letrec expression, or an earlier definition. The other identifiers in the
+// tree are free, and refer to the environment that it's evaluated in.
+func boundIdentifiers(n *node) map[*node]bool {
+	refs := make(map[*node]bool)
+	walkScope(n, func(n *node, sc *scope) {
+		if n.typ == nodeIdentifier && sc.bound(n.val.(string)) {
+			refs[n] = true
+		}
+	})
+	return refs
+}
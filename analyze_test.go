@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+type analyzeTest struct {
+	name     string
+	input    string
+	warnings []string
+}
+
+var shadowTests = []analyzeTest{
+	{"no warnings", "lam x lam y app app add x y", nil},
+	{"shadowed builtin", "lam add app add 1", []string{"lam parameter 'add' shadows a built-in"}},
+	{"shadowed lam parameter", "lam x app (lam x x) x", []string{"lam parameter 'x' shadows an outer binding"}},
+	{"shadowed def", "def f 1 lam f f", []string{"lam parameter 'f' shadows an outer binding"}},
+	{"shadowed session definition", "lam double double", []string{"lam parameter 'double' shadows a definition"}},
+	{"siblings", "app (lam x x) (lam x x)", nil},
+	{"several", "lam gt lam y lam gt y", []string{
+		"lam parameter 'gt' shadows a built-in",
+		"lam parameter 'gt' shadows an outer binding"}},
+}
+
+func TestShadowWarnings(t *testing.T) {
+	env := defaultEnvironment.extend("double", evalString("lam x app app add x x"))
+	for _, at := range shadowTests {
+		got := shadowWarnings(parseString(at.input), env)
+		if fmt.Sprint(got) != fmt.Sprint(at.warnings) {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", at.name, at.input, at.warnings, got)
+		}
+	}
+}
+
+var unusedParamsTests = []analyzeTest{
+	{"used", "lam x app app add x 1", nil},
+	{"unused", "lam x 5", []string{"x (in lam x)"}},
+	{"used by inner lam", "lam x lam y x", []string{"y (in lam x > lam y)"}},
+	{"shadowed by inner lam", "lam x lam x x", []string{"x (in lam x)"}},
+	{"in def", "def f lam x lam y y app f 1", []string{"x (in def f > lam x)"}},
+	{"in argument", "app f (lam x 1)", []string{"x (in lam x)"}},
+	{"in when", "when b lam x 1", []string{"x (in lam x)"}},
+	{"in letrec", "letrec f lam x 1 app f 2", []string{"x (in letrec f > lam x)"}},
+	{"underscore", "lam _ lam y 1", []string{"y (in lam _ > lam y)"}},
+}
+
+func TestUnusedParams(t *testing.T) {
+	for _, at := range unusedParamsTests {
+		got := unusedParams(parseString(at.input))
+		if fmt.Sprint(got) != fmt.Sprint(at.warnings) {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", at.name, at.input, at.warnings, got)
+		}
+	}
+}
+
+var divergenceTests = []analyzeTest{
+	{"omega", "app (lam x app x x) (lam x app x x)", []string{
+		"application never terminates: (app (lam x (app x x)) (lam x (app x x)))"}},
+	{"different parameters", "app (lam x app x x) (lam y app y y)", []string{
+		"application never terminates: (app (lam x (app x x)) (lam y (app y y)))"}},
+	{"extra arguments", "app (lam x app app x x x) (lam x app app x x x)", []string{
+		"application never terminates: (app (lam x (app (app x x) x)) (lam x (app (app x x) x)))"}},
+	{"nested", "lam f app f (app (lam x app x x) (lam x app x x))", []string{
+		"application never terminates: (app (lam x (app x x)) (lam x (app x x)))"}},
+	{"definition", "def w lam x app x x app w w", []string{
+		"application never terminates: (app w w)"}},
+	{"shadowed definition", "def w lam x app x x lam w app w w", nil},
+	{"benign", "def double lam x app app add x x app double app (lam y y) 2", nil},
+	{"self-application of argument", "app (lam x app x x) (lam y y)", nil},
+	{"self-application inside body", "app (lam x lam y app x x) (lam x lam y app x x)", nil},
+	{"fixed-point combinator", "lam f app (lam x app f (app x x)) (lam x app f (app x x))", nil},
+}
+
+func TestDivergenceWarnings(t *testing.T) {
+	for _, at := range divergenceTests {
+		got := divergenceWarnings(parseString(at.input))
+		if fmt.Sprint(got) != fmt.Sprint(at.warnings) {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", at.name, at.input, at.warnings, got)
+		}
+	}
+}
+
+var unboundTests = []analyzeTest{
+	{"bound", "lam x app app add x 1", nil},
+	{"unbound", "lam x app app add x y", []string{"y"}},
+	{"repeated", "app app f y app f y", []string{"f", "y"}},
+	{"def", "def x 1 app double x", nil},
+	{"def in its own value", "def x x x", []string{"x"}},
+	{"letrec", "letrec f lam n app f n app f 1", nil},
+	{"when", "when b lam b b", []string{"b"}},
+}
+
+func TestUnboundIdentifiers(t *testing.T) {
+	defined := func(name string) bool {
+		return name == "double" || defaultEnvironment.lookup(name).typ != objectError
+	}
+	for _, at := range unboundTests {
+		got := unboundIdentifiers(parseString(at.input), defined)
+		if fmt.Sprint(got) != fmt.Sprint(at.warnings) {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", at.name, at.input, at.warnings, got)
+		}
+	}
+}
+
+var boundTests = []analyzeTest{
+	{"lam", "lam x app x y", []string{"x"}},
+	{"def", "def x 1 app f x", []string{"x"}},
+	{"def in its own value", "def x x x", []string{"x"}},
+	{"letrec", "letrec f lam n app f n app f 1", []string{"f", "n", "f"}},
+	{"seq", "lam x seq x y x", []string{"x", "x"}},
+}
+
+func TestBoundIdentifiers(t *testing.T) {
+	for _, at := range boundTests {
+		root := parseString(at.input)
+		bound := boundIdentifiers(root)
+		var got []string
+		walk(root, func(n *node) bool {
+			if bound[n] {
+				got = append(got, n.val.(string))
+			}
+			return true
+		})
+		if fmt.Sprint(got) != fmt.Sprint(at.warnings) {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", at.name, at.input, at.warnings, got)
+		}
+	}
+}
+
+var arityErrorTests = []struct {
+	name  string
+	input string
+	err   string
+}{
+	{"exact", "app app add 1 2", ""},
+	{"too few", "app add 1", "add: expected 2 arguments, got 1 in (app add 1)"},
+	{"too many", "app app app add 1 2 3", "add: expected 2 arguments, got 3 in (app (app (app add 1) 2) 3)"},
+	{"result may be a function", "app app app app if true add 0 1 2", ""},
+	{"not applied", "app app apply add 1", ""},
+	{"in argument", "app isnum app add 1", "add: expected 2 arguments, got 1 in (app add 1)"},
+	{"in when body", "when true app add 1", "add: expected 2 arguments, got 1 in (app add 1)"},
+	{"letrec shadows builtin", "letrec add lam x x app add 1", ""},
+	{"outermost first", "app app add app gt 1 2", "gt: expected 2 arguments, got 1 in (app gt 1)"},
+	{"in lam", "lam x app add x", "add: expected 2 arguments, got 1 in (app add x)"},
+	{"shadowed by lam", "lam add app add 1", ""},
+	{"shadowed by def", "def add lam x x app add 1", ""},
+	{"in def value", "def f app add 1 f", "add: expected 2 arguments, got 1 in (app add 1)"},
+	{"lam head", "app (lam f app f 1) add", ""},
+	{"unknown identifier", "app x 1", ""},
+	{"too many for min", "app app app min 1 2 3", "min: expected 2 arguments, got 3 in (app (app (app min 1) 2) 3)"},
+	{"too many for pow", "app app app pow 1 2 3", "pow: expected 2 arguments, got 3 in (app (app (app pow 1) 2) 3)"},
+}
+
+func TestArityError(t *testing.T) {
+	for _, tt := range arityErrorTests {
+		var got string
+		if err := arityError(parseString(tt.input), defaultEnvironment); err != nil {
+			got = err.String()
+		}
+		if got != tt.err {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", tt.name, tt.input, tt.err, got)
+		}
+	}
+}
+
+func TestArityErrorDefinition(t *testing.T) {
+	env := defaultEnvironment.extend("f", evalEnv(parseString("lam x x"), defaultEnvironment))
+	for _, input := range []string{"app f 1", "app app app f id id 1"} {
+		if err := arityError(parseString(input), env); err != nil {
+			t.Errorf("input: %q\nunexpected error: %s", input, err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import "math/big"
+
+// The functions in this file construct parse trees directly, which allows
+// programs to be built and evaluated without going through the parser. They
+// check their arguments and return an error node for invalid ones, such as an
+// empty identifier. If an argument is itself an error node, it's returned
+// instead, so an error anywhere in a tree ends up at its root.
+
+// Ident returns an identifier node for the given name, which must be a valid
+// identifier: a letter followed by letters and digits, other than a keyword, or
+// an underscore on its own.
+func Ident(name string) *node {
+	if err := checkIdent(name); err != nil {
+		return err
+	}
+	return &node{nodeIdentifier, name}
+}
+
+// Num returns a number node for n.
+func Num(n int64) *node {
+	return &node{nodeNumber, big.NewInt(n)}
+}
+
+// BigNum returns a number node for n, which may be arbitrarily large. The node
+// contains a copy of n, so n can be modified afterwards.
+func BigNum(n *big.Int) *node {
+	if n == nil {
+		return errorNodef("number is nil")
+	}
+	return &node{nodeNumber, new(big.Int).Set(n)}
+}
+
+// Bool returns a bool node for b.
+func Bool(b bool) *node {
+	return &node{nodeBool, b}
+}
+
+// Str returns a string node for s.
+func Str(s string) *node {
+	return &node{nodeString, s}
+}
+
+// App returns a node which applies the function fn to arg.
+func App(fn, arg *node) *node {
+	if err := checkNodes(fn, arg); err != nil {
+		return err
+	}
+	return &node{nodeApp, &appNode{fn, arg}}
+}
+
+// When returns a node whose value is body if test is true, or nil otherwise.
+func When(test, body *node) *node {
+	if err := checkNodes(test, body); err != nil {
+		return err
+	}
+	return &node{nodeWhen, &whenNode{test, body, false}}
+}
+
+// Unless returns a node whose value is body if test is false, or nil otherwise.
+func Unless(test, body *node) *node {
+	if err := checkNodes(test, body); err != nil {
+		return err
+	}
+	return &node{nodeWhen, &whenNode{test, body, true}}
+}
+
+// Lam returns a lambda function node with the given parameter and body.
+func Lam(param string, body *node) *node {
+	if err := checkIdent(param); err != nil {
+		return err
+	}
+	if err := checkNodes(body); err != nil {
+		return err
+	}
+	return &node{nodeLam, &lamNode{param, body}}
+}
+
+// Letrec returns a letrec node which binds name to val within both val and body,
+// so that val can refer to itself.
+func Letrec(name string, val, body *node) *node {
+	if err := checkIdent(name); err != nil {
+		return err
+	}
+	if err := checkNodes(val, body); err != nil {
+		return err
+	}
+	return &node{nodeLetrec, &letrecNode{name, val, body}}
+}
+
+// Seq returns a node which evaluates first and then second, and whose value is
+// that of second.
+func Seq(first, second *node) *node {
+	if err := checkNodes(first, second); err != nil {
+		return err
+	}
+	return &node{nodeSeq, &seqNode{first, second}}
+}
+
+// Def returns a definition node which binds name to val within body. If body is
+// nil, the definition ends the program.
+func Def(name string, val, body *node) *node {
+	if err := checkIdent(name); err != nil {
+		return err
+	}
+	if err := checkNodes(val); err != nil {
+		return err
+	}
+	if body != nil && body.typ == nodeError {
+		return body
+	}
+	return &node{nodeDef, &defNode{name, val, body}}
+}
+
+// checkIdent returns an error node if name isn't a valid identifier, or nil
+// otherwise.
+func checkIdent(name string) *node {
+	if name == "" {
+		return errorNodef("empty identifier")
+	}
+	if name == "_" {
+		return nil
+	}
+	for i, ch := range name {
+		if !isLetter(ch) && (i == 0 || !isDigit(ch)) {
+			return errorNodef("bad identifier syntax: '%s'", name)
+		}
+	}
+	if isKeyword(name) || name == "true" || name == "false" {
+		return errorNodef("keyword used as identifier: '%s'", name)
+	}
+	return nil
+}
+
+// checkNodes returns an error node if any of the given nodes is nil or an error
+// node, or nil otherwise.
+func checkNodes(nodes ...*node) *node {
+	for _, n := range nodes {
+		if n == nil {
+			return errorNodef("node is nil")
+		}
+		if n.typ == nodeError {
+			return n
+		}
+	}
+	return nil
+}
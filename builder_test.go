@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	tests := []struct {
+		name  string
+		built *node
+		input string // equivalent source code
+	}{
+		{"ident", Ident("x1"), "x1"},
+		{"underscore", Ident("_"), "_"},
+		{"num", Num(-5), "-5"},
+		{"big num", BigNum(new(big.Int).Lsh(big.NewInt(1), 100)), "1267650600228229401496703205376"},
+		{"bool", Bool(true), "true"},
+		{"string", Str("a\"b"), `"a\"b"`},
+		{"lam", Lam("x", Ident("x")), "lam x x"},
+		{"app", App(Lam("x", Ident("x")), Num(1)), "app lam x x 1"},
+		{"def", Def("x", Num(1), App(Ident("f"), Ident("x"))), "def x 1 app f x"},
+		{"def without body", Def("x", Num(1), nil), "def x 1"},
+		{"when", When(Bool(true), Ident("x")), "when true x"},
+		{"unless", Unless(Ident("b"), Num(1)), "unless b 1"},
+		{"letrec", Letrec("f", Lam("x", App(Ident("f"), Ident("x"))), Ident("f")), "letrec f lam x app f x f"},
+		{"example", App(App(App(Ident("if"), App(App(Ident("gt"), Num(3)), Num(1))), Num(10)), Num(5)),
+			"app app app if (app app gt 3 1) 10 5"},
+	}
+	for _, bt := range tests {
+		if want := parseString(bt.input); !nodesEqual(bt.built, want) {
+			t.Errorf("[%s]\nwant: %v\ngot: %v\n", bt.name, want, bt.built)
+		}
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		built *node
+		err   string
+	}{
+		{"empty identifier", Ident(""), "empty identifier"},
+		{"bad identifier", Ident("1x"), "bad identifier syntax: '1x'"},
+		{"identifier with symbol", Ident("a-b"), "bad identifier syntax: 'a-b'"},
+		{"underscore before letter", Ident("_a"), "bad identifier syntax: '_a'"},
+		{"keyword", Ident("lam"), "keyword used as identifier: 'lam'"},
+		{"bool keyword", Ident("true"), "keyword used as identifier: 'true'"},
+		{"nil number", BigNum(nil), "number is nil"},
+		{"empty parameter", Lam("", Ident("x")), "empty identifier"},
+		{"nil body", Lam("x", nil), "node is nil"},
+		{"nil function", App(nil, Num(1)), "node is nil"},
+		{"nested error", App(Ident("f"), Lam("x", App(Ident(""), Num(1)))), "empty identifier"},
+		{"bad definition name", Def("app", Num(1), nil), "keyword used as identifier: 'app'"},
+		{"error in definition body", Def("x", Num(1), Ident("")), "empty identifier"},
+		{"nil when body", When(Bool(true), nil), "node is nil"},
+		{"keyword when", Ident("when"), "keyword used as identifier: 'when'"},
+		{"bad letrec name", Letrec("def", Num(1), Num(1)), "keyword used as identifier: 'def'"},
+	}
+	for _, bt := range tests {
+		if bt.built.typ != nodeError || bt.built.val.(error).Error() != bt.err {
+			t.Errorf("[%s]\nwant: %q\ngot: %v\n", bt.name, bt.err, bt.built)
+		}
+	}
+}
+
+func TestBuilderEval(t *testing.T) {
+	example := App(App(App(Ident("if"), App(App(Ident("gt"), Num(3)), Num(1))), Num(10)), Num(5))
+	if val := eval(example); !val.Equal(mknumobj(10)) {
+		t.Errorf("want: 10\ngot: %v", val)
+	}
+	double := Def("double", Lam("x", App(App(Ident("add"), Ident("x")), Ident("x"))),
+		App(Ident("double"), Num(21)))
+	if val := eval(double); !val.Equal(mknumobj(42)) {
+		t.Errorf("want: 42\ngot: %v", val)
+	}
+}
+
+func TestBigNumCopy(t *testing.T) {
+	n := big.NewInt(7)
+	built := BigNum(n)
+	n.SetInt64(8)
+	if !nodesEqual(built, Num(7)) {
+		t.Errorf("want: 7\ngot: %v", built)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// maxDiffs is the most differences that diffNodes reports.
+const maxDiffs = 5
+
+// diffNodes returns descriptions of the first few places where the trees rooted
+// at a and b differ, or nil if they're equal. Each description starts with the
+// path to the differing nodes from the root, made of the type of each node on
+// the way and the field that leads to the next, e.g. "at app.arg: number 3 vs
+// number 4". The trees are walked in parallel, and nodes of different types
+// aren't compared any further, so at most one difference is reported for them.
+//
+// Like hashNode, diffNodes is structural rather than alpha-invariant, so "lam x
+// x" and "lam y y" differ in their parameter and body.
+func diffNodes(a, b *node) []string {
+	var diffs []string
+	var visit func(a, b *node, path string)
+	visit = func(a, b *node, path string) {
+		if len(diffs) >= maxDiffs {
+			return
+		}
+		report := func(format string, args ...interface{}) {
+			if len(diffs) < maxDiffs {
+				diffs = append(diffs, "at "+path+": "+fmt.Sprintf(format, args...))
+			}
+		}
+		child := func(field string) string {
+			if path == "root" {
+				return diffLabel(a, false) + "." + field
+			}
+			return path + "." + diffLabel(a, false) + "." + field
+		}
+		if a.typ != b.typ {
+			report("%s vs %s", diffLabel(a, true), diffLabel(b, true))
+			return
+		}
+		switch a.typ {
+		case nodeApp:
+			aApp, bApp := a.val.(*appNode), b.val.(*appNode)
+			visit(aApp.fn, bApp.fn, child("fn"))
+			visit(aApp.arg, bApp.arg, child("arg"))
+		case nodeLam:
+			aLam, bLam := a.val.(*lamNode), b.val.(*lamNode)
+			if aLam.param != bLam.param {
+				report("lam param %s vs %s", aLam.param, bLam.param)
+			}
+			visit(aLam.body, bLam.body, child("body"))
+		case nodeWhen:
+			aWhen, bWhen := a.val.(*whenNode), b.val.(*whenNode)
+			if aWhen.unless != bWhen.unless {
+				report("%s vs %s", aWhen.keyword(), bWhen.keyword())
+			}
+			visit(aWhen.test, bWhen.test, child("test"))
+			visit(aWhen.body, bWhen.body, child("body"))
+		case nodeSeq:
+			aSeq, bSeq := a.val.(*seqNode), b.val.(*seqNode)
+			visit(aSeq.first, bSeq.first, child("first"))
+			visit(aSeq.second, bSeq.second, child("second"))
+		case nodeLetrec:
+			aLetrec, bLetrec := a.val.(*letrecNode), b.val.(*letrecNode)
+			if aLetrec.name != bLetrec.name {
+				report("letrec name %s vs %s", aLetrec.name, bLetrec.name)
+			}
+			visit(aLetrec.val, bLetrec.val, child("val"))
+			visit(aLetrec.body, bLetrec.body, child("body"))
+		case nodeDef:
+			aDef, bDef := a.val.(*defNode), b.val.(*defNode)
+			if aDef.name != bDef.name {
+				report("def name %s vs %s", aDef.name, bDef.name)
+			}
+			visit(aDef.val, bDef.val, child("val"))
+			switch {
+			case aDef.body != nil && bDef.body != nil:
+				visit(aDef.body, bDef.body, child("body"))
+			case aDef.body != nil:
+				path = child("body")
+				report("%s vs no body", diffLabel(aDef.body, true))
+			case bDef.body != nil:
+				path = child("body")
+				report("no body vs %s", diffLabel(bDef.body, true))
+			}
+		case nodeNumber:
+			if a.val.(*big.Int).Cmp(b.val.(*big.Int)) != 0 {
+				report("%s vs %s", diffLabel(a, true), diffLabel(b, true))
+			}
+		default:
+			if aLabel, bLabel := diffLabel(a, true), diffLabel(b, true); aLabel != bLabel {
+				report("%s vs %s", aLabel, bLabel)
+			}
+		}
+	}
+	visit(a, b, "root")
+	return diffs
+}
+
+// diffLabel returns the name of n's type as used in diffNodes, followed by its
+// value, parameter, or name if full is true.
+func diffLabel(n *node, full bool) string {
+	var typ, val string
+	switch n.typ {
+	case nodeApp:
+		return "app"
+	case nodeWhen:
+		return n.val.(*whenNode).keyword()
+	case nodeSeq:
+		return "seq"
+	case nodeLam:
+		typ, val = "lam", n.val.(*lamNode).param
+	case nodeLetrec:
+		typ, val = "letrec", n.val.(*letrecNode).name
+	case nodeDef:
+		typ, val = "def", n.val.(*defNode).name
+	case nodeIdentifier:
+		typ, val = "identifier", n.val.(string)
+	case nodeNumber:
+		typ, val = "number", fmt.Sprint(n.val)
+	case nodeBool:
+		typ, val = "bool", fmt.Sprint(n.val)
+	case nodeString:
+		typ, val = "string", quote(n.val.(string))
+	default:
+		typ, val = "error", fmt.Sprint(n.val)
+	}
+	if !full {
+		return typ
+	}
+	return typ + " " + val
+}
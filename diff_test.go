@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var diffTests = []struct {
+	name string
+	a, b string
+	want []string
+}{
+	{"equal", "app lam x x 1", "app lam x x 1", nil},
+	{"literal", "app f 3", "app f 4", []string{"at app.arg: number 3 vs number 4"}},
+	{"string", `"a"`, `"b"`, []string{`at root: string "a" vs string "b"`}},
+	{"big number", "12345678901234567890", "12345678901234567890", nil},
+	{"param", "lam x 1", "lam y 1", []string{"at root: lam param x vs y"}},
+	{"param and body", "lam x x", "lam y y", []string{
+		"at root: lam param x vs y",
+		"at lam.body: identifier x vs identifier y",
+	}},
+	{"node type", "app f 1", "app f lam x x", []string{"at app.arg: number 1 vs lam x"}},
+	{"node type at root", "true", "app f x", []string{"at root: bool true vs app"}},
+	{"when", "when b app f 1", "unless b app f 2", []string{
+		"at root: when vs unless",
+		"at when.body.app.arg: number 1 vs number 2",
+	}},
+	{"letrec", "letrec f 1 f", "letrec g 1 app f 2", []string{
+		"at root: letrec name f vs g",
+		"at letrec.body: identifier f vs app",
+	}},
+	{"nested", "app app add 1 app neg 2", "app app add 1 app neg 3", []string{
+		"at app.arg.app.arg: number 2 vs number 3",
+	}},
+	{"def", "def f 1 f", "def g 2 g", []string{
+		"at root: def name f vs g",
+		"at def.val: number 1 vs number 2",
+		"at def.body: identifier f vs identifier g",
+	}},
+	{"def body", "def f 1 f", "def f 1", []string{"at def.body: identifier f vs no body"}},
+	{"def no body", "def f 1", "def f 1 f", []string{"at def.body: no body vs identifier f"}},
+	{"limit", "app app app app app a b c d e f", "app app app app app g h i j k l", []string{
+		"at app.fn.app.fn.app.fn.app.fn.app.fn: identifier a vs identifier g",
+		"at app.fn.app.fn.app.fn.app.fn.app.arg: identifier b vs identifier h",
+		"at app.fn.app.fn.app.fn.app.arg: identifier c vs identifier i",
+		"at app.fn.app.fn.app.arg: identifier d vs identifier j",
+		"at app.fn.app.arg: identifier e vs identifier k",
+	}},
+}
+
+func TestDiffNodes(t *testing.T) {
+	for _, dt := range diffTests {
+		got := diffNodes(parseString(dt.a), parseString(dt.b))
+		if !reflect.DeepEqual(got, dt.want) {
+			t.Errorf("[%s]\na: %q\nb: %q\nwant: %q\ngot: %q", dt.name, dt.a, dt.b, dt.want, got)
+		}
+	}
+}
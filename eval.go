@@ -1,23 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 type applyer interface {
-	apply(*object) *object
+	apply(*evaluator, *object) *object
 }
 
 type objectType int
 
 // Constants indicating the type of the value stored in an object struct.
 const (
-	objectError  objectType = iota // object.val is set to an error string
+	objectError  objectType = iota // object.val is set to an *errorValue
 	objectBool                     // object.val is set to a bool
-	objectNumber                   // object.val is set to a *big.Int
-	objectFunc                     // object.val is set to a funcObject
+	objectNumber                   // object.val is set to a *big.Int, which must not be modified
+	objectFunc                     // object.val is set to a *funcObject
 	objectLam                      // object.val is set to a *lamObject
+	objectString                   // object.val is set to a string
+	objectList                     // object.val is set to a *consCell, which is nil for the empty list
+	objectPair                     // object.val is set to a *pairValue
+	objectThunk                    // object.val is set to a *thunk
 )
 
 // An object represents a generic object within the interpreter context.
@@ -27,73 +40,270 @@ type object struct {
 }
 
 func (v *object) String() string {
+	return v.Text(10)
+}
+
+// Text returns a description of the object like String, except that numbers,
+// including the ones in lists, are written in the given base, which must be
+// between 2 and 62 (see big.Int.Text). Error messages are always the same,
+// whatever the base.
+func (v *object) Text(base int) string {
 	switch v.typ {
 	case objectError:
-		return v.val.(string)
+		return v.val.(*errorValue).msg
 	case objectBool:
 		if v.val.(bool) {
 			return "true"
 		}
 		return "false"
 	case objectNumber:
-		return v.val.(*big.Int).String()
+		return v.val.(*big.Int).Text(base)
 	case objectFunc:
-		return fmt.Sprintf("<function %p>", v.val)
+		return fmt.Sprintf("<builtin %s>", v.val.(*funcObject).name)
 	case objectLam:
-		lam := v.val.(*lamObject)
-		return fmt.Sprintf("<lam %s %p>", lam.node.param, lam)
+		return fmt.Sprintf("<lam %s>", v.val.(*lamObject).node.param)
+	case objectString:
+		return v.val.(string)
+	case objectList:
+		// Lists can be long, so build the string iteratively rather
+		// than by recursion.
+		var b bytes.Buffer
+		n := 0
+		for cell := v.val.(*consCell); cell != nil; cell = cell.tail.val.(*consCell) {
+			fmt.Fprintf(&b, "(cons %s ", cell.head.Text(base))
+			n++
+		}
+		b.WriteString("nil")
+		b.WriteString(strings.Repeat(")", n))
+		return b.String()
+	case objectPair:
+		p := v.val.(*pairValue)
+		return fmt.Sprintf("(pair %s %s)", p.fst.Text(base), p.snd.Text(base))
+	case objectThunk:
+		return "<thunk>"
 	default:
 		// Shouldn't be possible
 		panic(fmt.Errorf("invalid object type: %d", v.typ))
 	}
 }
 
+// Equal reports whether the object is equal to other. Numbers, bools, and
+// strings are equal if their values are, errors if their messages are, and
+// lists and pairs if their elements are. Built-in functions, lambdas, and
+// thunks are only equal to themselves, since telling whether two functions
+// behave the same way isn't possible in general.
+func (v *object) Equal(other *object) bool {
+	for {
+		if v.typ != other.typ {
+			return false
+		}
+		switch v.typ {
+		case objectError:
+			return v.val.(*errorValue).msg == other.val.(*errorValue).msg
+		case objectNumber:
+			return v.val.(*big.Int).Cmp(other.val.(*big.Int)) == 0
+		case objectList:
+			// Compare the tails iteratively so that long lists don't
+			// use up the stack.
+			a, b := v.val.(*consCell), other.val.(*consCell)
+			if a == nil || b == nil {
+				return a == b
+			}
+			if !a.head.Equal(b.head) {
+				return false
+			}
+			v, other = a.tail, b.tail
+		case objectPair:
+			a, b := v.val.(*pairValue), other.val.(*pairValue)
+			if !a.fst.Equal(b.fst) {
+				return false
+			}
+			v, other = a.snd, b.snd
+		default:
+			// Bools and strings are compared by value, and the
+			// other types by pointer.
+			return v.val == other.val
+		}
+	}
+}
+
+// The bool objects. Objects are never modified once created, so all bool values
+// share these instead of allocating new objects.
+var (
+	trueObject  = &object{objectBool, true}
+	falseObject = &object{objectBool, false}
+)
+
+// boolObject returns the object representing the given bool.
+func boolObject(b bool) *object {
+	if b {
+		return trueObject
+	}
+	return falseObject
+}
+
+// The range of numbers for which numberObject returns shared objects.
+const (
+	minSmallNumber = -128
+	maxSmallNumber = 256
+)
+
+// smallNumbers contains the shared objects for small numbers, indexed by the
+// number minus minSmallNumber.
+var smallNumbers [maxSmallNumber - minSmallNumber + 1]*object
+
+func init() {
+	for i := range smallNumbers {
+		smallNumbers[i] = &object{objectNumber, big.NewInt(int64(i + minSmallNumber))}
+	}
+}
+
+// numberObject returns an object representing the given number. Small numbers
+// share preallocated objects, which saves allocations in loops that count up or
+// down. Since the objects are shared, n must not be modified after calling
+// numberObject, and neither may the *big.Int stored in any number object.
+func numberObject(n *big.Int) *object {
+	// Checking the bit length first avoids calling Int64 on numbers that
+	// don't fit into an int64.
+	if n.BitLen() <= 9 {
+		if v := n.Int64(); v >= minSmallNumber && v <= maxSmallNumber {
+			return smallNumbers[v-minSmallNumber]
+		}
+	}
+	return &object{objectNumber, n}
+}
+
+// ErrorKind identifies the cause of an error object, so that errors can be told
+// apart without parsing their messages.
+type ErrorKind int
+
+// Constants indicating the kind of an error object.
+const (
+	NotAnError             ErrorKind = iota // the object isn't an error
+	OtherError                              // the error isn't one of the kinds below
+	TypeError                               // a value has the wrong type, e.g. a bool passed to add
+	UnboundIdentifierError                  // an identifier isn't defined
+	ArityError                              // a function has the wrong number of arguments
+	DomainError                             // a value has the right type but isn't allowed, e.g. isqrt of -1
+	ParseError                              // the program couldn't be parsed
+	StoppedError                            // evaluation was stopped before it finished
+)
+
+var errorKindNames = [...]string{
+	NotAnError:             "not an error",
+	OtherError:             "other error",
+	TypeError:              "type error",
+	UnboundIdentifierError: "unbound identifier",
+	ArityError:             "arity error",
+	DomainError:            "domain error",
+	ParseError:             "parse error",
+	StoppedError:           "stopped",
+}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(errorKindNames) {
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+	return errorKindNames[k]
+}
+
+// errorValue is the value of an error object.
+type errorValue struct {
+	kind  ErrorKind
+	msg   string
+	trace []*node // applications that were being evaluated, innermost first
+}
+
 // errorObjectf formats according to a format specifier (see fmt) and returns
-// the resulting string as an error object.
+// the resulting string as an error object of kind OtherError.
 func errorObjectf(format string, args ...interface{}) *object {
-	return &object{objectError, fmt.Sprintf(format, args...)}
+	return kindErrorf(OtherError, format, args...)
+}
+
+// kindErrorf is like errorObjectf, but it returns an error object of the given
+// kind.
+func kindErrorf(kind ErrorKind, format string, args ...interface{}) *object {
+	return &object{objectError, &errorValue{kind: kind, msg: fmt.Sprintf(format, args...)}}
+}
+
+// ErrorKindOf returns the kind of the given error object, or NotAnError if the
+// object isn't an error.
+func ErrorKindOf(o *object) ErrorKind {
+	if o.typ != objectError {
+		return NotAnError
+	}
+	return o.val.(*errorValue).kind
+}
+
+// errorTrace returns the applications that were being evaluated when the given
+// error object was created, innermost first, or nil if the error doesn't have a
+// stack trace. Errors only have stack traces if they come from an evaluator
+// with tracing enabled.
+func errorTrace(o *object) []*node {
+	return o.val.(*errorValue).trace
 }
 
 // A funcObject represents a built-in function within the interpreter context.
-type funcObject func(*object) *object
+// Builtins that take multiple arguments are curried, and the functions they
+// return for the remaining arguments share the builtin's name.
+type funcObject struct {
+	name   string // name of the builtin, used when printing the function
+	fn     func(*object) *object
+	evalFn func(*evaluator, *object) *object // used instead of fn if set
+
+	// If the function comes from partly applying a builtin, the function
+	// that was applied and its argument, which is how its type is inferred
+	appliedTo *object
+	arg       *object
+}
 
-var _ applyer = funcObject(nil)
+var _ applyer = &funcObject{}
 
-// newFuncObject returns the given function wrapped into a function object.
-func newFuncObject(fn func(*object) *object) *object {
-	return &object{objectFunc, funcObject(fn)}
+// newFuncObject returns the given function wrapped into a function object
+// with the given name.
+func newFuncObject(name string, fn func(*object) *object) *object {
+	return &object{objectFunc, &funcObject{name: name, fn: fn}}
+}
+
+// newEvalFuncObject is like newFuncObject, but the function is also given the
+// evaluator that applied it, which it needs in order to apply other functions.
+func newEvalFuncObject(name string, fn func(*evaluator, *object) *object) *object {
+	return &object{objectFunc, &funcObject{name: name, evalFn: fn}}
 }
 
 // apply calls f with v as an argument and returns the result.
-func (f funcObject) apply(v *object) *object {
-	return f(v)
+func (f *funcObject) apply(ev *evaluator, v *object) *object {
+	if f.evalFn != nil {
+		return f.evalFn(ev, v)
+	}
+	return f.fn(v)
 }
 
 // The builtin function add returns the sum of two numbers.
 // Signature: number -> number -> number
-var builtinAdd = newFuncObject(func(a *object) *object {
+var builtinAdd = newFuncObject("add", func(a *object) *object {
 	if a.typ != objectNumber {
-		return errorObjectf("add: not a number: '%s'", a)
+		return kindErrorf(TypeError, "add: not a number: '%s'", a)
 	}
-	return newFuncObject(func(b *object) *object {
+	return newFuncObject("add", func(b *object) *object {
 		if b.typ != objectNumber {
-			return errorObjectf("add: not a number: '%s'", b)
+			return kindErrorf(TypeError, "add: not a number: '%s'", b)
 		}
 		an := a.val.(*big.Int)
 		bn := b.val.(*big.Int)
-		return &object{objectNumber, new(big.Int).Add(an, bn)}
+		return numberObject(new(big.Int).Add(an, bn))
 	})
 })
 
 // The builtin function if branches on a bool (the first argument).
 // If the bool is true, the second argument is returned, otherwise the third.
 // Signature: bool -> object -> object -> object
-var builtinIf = newFuncObject(func(a *object) *object {
+var builtinIf = newFuncObject("if", func(a *object) *object {
 	if a.typ != objectBool {
-		return errorObjectf("if: not a bool: '%s'", a)
+		return kindErrorf(TypeError, "if: not a bool: '%s'", a)
 	}
-	return newFuncObject(func(b *object) *object {
-		return newFuncObject(func(c *object) *object {
+	return newFuncObject("if", func(b *object) *object {
+		return newFuncObject("if", func(c *object) *object {
 			if a.val.(bool) {
 				return b
 			}
@@ -105,20 +315,596 @@ var builtinIf = newFuncObject(func(a *object) *object {
 // The builtin function gt compares two numbers and returns the result as a
 // boolean which is true only if the first argument is greater than the second.
 // Signature: number -> number -> bool
-var builtinGt = newFuncObject(func(a *object) *object {
+var builtinGt = newFuncObject("gt", func(a *object) *object {
 	if a.typ != objectNumber {
-		return errorObjectf("gt: not a number: '%s'", a)
+		return kindErrorf(TypeError, "gt: not a number: '%s'", a)
 	}
-	return newFuncObject(func(b *object) *object {
+	return newFuncObject("gt", func(b *object) *object {
 		if b.typ != objectNumber {
-			return errorObjectf("gt: not a number: '%s'", b)
+			return kindErrorf(TypeError, "gt: not a number: '%s'", b)
 		}
 		an := a.val.(*big.Int)
 		bn := b.val.(*big.Int)
-		return &object{objectBool, an.Cmp(bn) == 1}
+		return boolObject(an.Cmp(bn) == 1)
+	})
+})
+
+// newNumberComparison returns a builtin function with the given name which
+// takes two numbers and returns the result of calling test with the result of
+// comparing them (see big.Int.Cmp).
+// Signature: number -> number -> bool
+func newNumberComparison(name string, test func(cmp int) bool) *object {
+	return newFuncObject(name, func(a *object) *object {
+		if a.typ != objectNumber {
+			return kindErrorf(TypeError, "%s: not a number: '%s'", name, a)
+		}
+		return newFuncObject(name, func(b *object) *object {
+			if b.typ != objectNumber {
+				return kindErrorf(TypeError, "%s: not a number: '%s'", name, b)
+			}
+			return boolObject(test(a.val.(*big.Int).Cmp(b.val.(*big.Int))))
+		})
+	})
+}
+
+// The builtin functions gte and lte return true if the first argument is
+// greater than or equal to the second, or less than or equal to it,
+// respectively.
+// Signature: number -> number -> bool
+var (
+	builtinGte = newNumberComparison("gte", func(cmp int) bool { return cmp >= 0 })
+	builtinLte = newNumberComparison("lte", func(cmp int) bool { return cmp <= 0 })
+)
+
+// newNumberOperator returns a builtin function with the given name which takes
+// two numbers and returns the result of calling op on them.
+// Signature: number -> number -> object
+func newNumberOperator(name string, op func(a, b *big.Int) *object) *object {
+	return newFuncObject(name, func(a *object) *object {
+		if a.typ != objectNumber {
+			return kindErrorf(TypeError, "%s: not a number: '%s'", name, a)
+		}
+		return newFuncObject(name, func(b *object) *object {
+			if b.typ != objectNumber {
+				return kindErrorf(TypeError, "%s: not a number: '%s'", name, b)
+			}
+			return op(a.val.(*big.Int), b.val.(*big.Int))
+		})
+	})
+}
+
+// The builtin functions band, bor, and bxor return the bitwise and, or, and
+// exclusive or of two numbers. Negative numbers behave as if they were
+// represented in two's complement with an infinite number of leading ones, so
+// for example, app app band -1 x is x for any x.
+// Signature: number -> number -> number
+var (
+	builtinBand = newNumberOperator("band", func(a, b *big.Int) *object {
+		return numberObject(new(big.Int).And(a, b))
+	})
+	builtinBor = newNumberOperator("bor", func(a, b *big.Int) *object {
+		return numberObject(new(big.Int).Or(a, b))
+	})
+	builtinBxor = newNumberOperator("bxor", func(a, b *big.Int) *object {
+		return numberObject(new(big.Int).Xor(a, b))
+	})
+)
+
+// maxResultBits limits the size of the numbers created by builtins like shl and
+// pow, which would otherwise be able to create numbers that take up an
+// unreasonable amount of memory.
+const maxResultBits = 1 << 24
+
+// The builtin functions shl and shr shift the first argument to the left or
+// right by the number of bits given by the second argument, which must not be
+// negative. Shifting right rounds towards negative infinity.
+// Signature: number -> number -> number
+var (
+	builtinShl = newNumberOperator("shl", func(a, b *big.Int) *object {
+		if b.Sign() < 0 {
+			return kindErrorf(DomainError, "shl: negative shift count: '%s'", b)
+		}
+		if a.Sign() == 0 {
+			return numberObject(new(big.Int))
+		}
+		// The result has len(a)+b bits, where len(a) is the bit length of
+		// a.
+		if b.Cmp(big.NewInt(int64(maxResultBits-a.BitLen()))) > 0 {
+			return kindErrorf(DomainError, "shl: result too large: %d-bit number shifted left by '%s'", a.BitLen(), b)
+		}
+		return numberObject(new(big.Int).Lsh(a, uint(b.Int64())))
+	})
+	builtinShr = newNumberOperator("shr", func(a, b *big.Int) *object {
+		if b.Sign() < 0 {
+			return kindErrorf(DomainError, "shr: negative shift count: '%s'", b)
+		}
+		// Shifting by more than the length of a gives the same result
+		// as shifting by exactly its length, which is either 0 or -1.
+		n := uint(a.BitLen())
+		if b.Cmp(big.NewInt(int64(n))) < 0 {
+			n = uint(b.Int64())
+		}
+		return numberObject(new(big.Int).Rsh(a, n))
+	})
+)
+
+// The builtin function cmp compares two numbers and returns -1 if the first
+// argument is less than the second, 0 if they're equal, and 1 otherwise.
+// Signature: number -> number -> number
+var builtinCmp = newNumberOperator("cmp", func(a, b *big.Int) *object {
+	return numberObject(big.NewInt(int64(a.Cmp(b))))
+})
+
+// The builtin functions isnum and isbool return whether their argument is a
+// number or a bool, respectively. They accept arguments of any type.
+// Signature: object -> bool
+var (
+	builtinIsnum = newFuncObject("isnum", func(a *object) *object {
+		return boolObject(a.typ == objectNumber)
+	})
+	builtinIsbool = newFuncObject("isbool", func(a *object) *object {
+		return boolObject(a.typ == objectBool)
+	})
+)
+
+// The builtin function typeof returns a number identifying the type of its
+// argument: 0 for numbers, 1 for bools, 2 for functions (both built-in and
+// lambda functions), 3 for strings, 4 for lists, and 5 for pairs.
+// Signature: object -> number
+var builtinTypeof = newFuncObject("typeof", func(a *object) *object {
+	switch a.typ {
+	case objectNumber:
+		return numberObject(big.NewInt(0))
+	case objectBool:
+		return numberObject(big.NewInt(1))
+	case objectFunc, objectLam:
+		return numberObject(big.NewInt(2))
+	case objectString:
+		return numberObject(big.NewInt(3))
+	case objectList:
+		return numberObject(big.NewInt(4))
+	case objectPair:
+		return numberObject(big.NewInt(5))
+	default:
+		return errorObjectf("typeof: invalid object: '%s'", a)
+	}
+})
+
+// The builtin function isqrt returns the integer square root of a number, which
+// is the square root rounded down. The number must not be negative.
+// Signature: number -> number
+var builtinIsqrt = newFuncObject("isqrt", func(a *object) *object {
+	if a.typ != objectNumber {
+		return kindErrorf(TypeError, "isqrt: not a number: '%s'", a)
+	}
+	an := a.val.(*big.Int)
+	if an.Sign() < 0 {
+		return kindErrorf(DomainError, "isqrt: negative argument")
+	}
+	return numberObject(new(big.Int).Sqrt(an))
+})
+
+// The builtin function neg returns the negation of a number.
+// Signature: number -> number
+var builtinNeg = newFuncObject("neg", func(a *object) *object {
+	if a.typ != objectNumber {
+		return kindErrorf(TypeError, "neg: not a number: '%s'", a)
+	}
+	return numberObject(new(big.Int).Neg(a.val.(*big.Int)))
+})
+
+// newNumberChooser returns a builtin function with the given name which takes
+// two numbers and returns the first one if first returns true when given the
+// result of comparing them (see big.Int.Cmp), or the second one otherwise.
+// The chosen argument is returned as is rather than copied.
+// Signature: number -> number -> number
+func newNumberChooser(name string, first func(cmp int) bool) *object {
+	return newFuncObject(name, func(a *object) *object {
+		if a.typ != objectNumber {
+			return kindErrorf(TypeError, "%s: not a number: '%s'", name, a)
+		}
+		return newFuncObject(name, func(b *object) *object {
+			if b.typ != objectNumber {
+				return kindErrorf(TypeError, "%s: not a number: '%s'", name, b)
+			}
+			if first(a.val.(*big.Int).Cmp(b.val.(*big.Int))) {
+				return a
+			}
+			return b
+		})
+	})
+}
+
+// The builtin functions min and max return the lesser and greater of two
+// numbers, respectively.
+// Signature: number -> number -> number
+var (
+	builtinMin = newNumberChooser("min", func(cmp int) bool { return cmp <= 0 })
+	builtinMax = newNumberChooser("max", func(cmp int) bool { return cmp >= 0 })
+)
+
+// The builtin function pow raises the first argument to the power of the
+// second argument, which must not be negative.
+// Signature: number -> number -> number
+var builtinPow = newNumberOperator("pow", func(a, b *big.Int) *object {
+	if b.Sign() < 0 {
+		return kindErrorf(DomainError, "pow: negative exponent")
+	}
+	// The result has at least (len(a)-1)*b bits, where len(a) is the bit
+	// length of a, except for 0, 1, and -1 which can be raised to any
+	// power.
+	if bits := int64(a.BitLen() - 1); bits > 0 {
+		if b.Cmp(big.NewInt(maxResultBits/bits)) > 0 {
+			return kindErrorf(DomainError, "pow: result too large: '%s' to the power of '%s'", a, b)
+		}
+	} else if a.Sign() < 0 && b.Bit(0) == 1 {
+		return numberObject(big.NewInt(-1))
+	} else if a.Sign() != 0 || b.Sign() == 0 {
+		return numberObject(big.NewInt(1))
+	} else {
+		return numberObject(big.NewInt(0))
+	}
+	return numberObject(new(big.Int).Exp(a, b, nil))
+})
+
+// The builtin function fact returns the factorial of a number, which must not
+// be negative.
+// Signature: number -> number
+var builtinFact = newFuncObject("fact", func(a *object) *object {
+	if a.typ != objectNumber {
+		return kindErrorf(TypeError, "fact: not a number: '%s'", a)
+	}
+	n := a.val.(*big.Int)
+	if n.Sign() < 0 {
+		return kindErrorf(DomainError, "fact: negative argument")
+	}
+	// The result has fewer than n*len(n) bits, where len(n) is the bit
+	// length of n.
+	if n.BitLen() >= 64 || n.BitLen() > 0 && n.Int64() > maxResultBits/int64(n.BitLen()) {
+		return kindErrorf(DomainError, "fact: result too large: '%s'", a)
+	}
+	return numberObject(new(big.Int).MulRange(1, n.Int64()))
+})
+
+// The builtin function concat returns the concatenation of two strings.
+// Signature: string -> string -> string
+var builtinConcat = newFuncObject("concat", func(a *object) *object {
+	if a.typ != objectString {
+		return kindErrorf(TypeError, "concat: not a string: '%s'", a)
+	}
+	return newFuncObject("concat", func(b *object) *object {
+		if b.typ != objectString {
+			return kindErrorf(TypeError, "concat: not a string: '%s'", b)
+		}
+		return &object{objectString, a.val.(string) + b.val.(string)}
+	})
+})
+
+// The builtin function strlen returns the number of characters (Unicode code
+// points) in a string.
+// Signature: string -> number
+var builtinStrlen = newFuncObject("strlen", func(a *object) *object {
+	if a.typ != objectString {
+		return kindErrorf(TypeError, "strlen: not a string: '%s'", a)
+	}
+	return numberObject(big.NewInt(int64(utf8.RuneCountInString(a.val.(string)))))
+})
+
+// A consCell is a non-empty list: an element followed by the rest of the list.
+type consCell struct {
+	head *object
+	tail *object // always a list object
+}
+
+// nilObject is the empty list.
+var nilObject = &object{objectList, (*consCell)(nil)}
+
+// The builtin function cons returns a list with the first argument prepended to
+// the second argument, which must be a list.
+// Signature: object -> list -> list
+var builtinCons = newFuncObject("cons", func(a *object) *object {
+	return newFuncObject("cons", func(b *object) *object {
+		if b.typ != objectList {
+			return kindErrorf(TypeError, "cons: not a list: '%s'", b)
+		}
+		return &object{objectList, &consCell{a, b}}
+	})
+})
+
+// The builtin functions head and tail return the first element of a non-empty
+// list and the list of the remaining elements, respectively.
+// Signature: list -> object, list -> list
+var (
+	builtinHead = newFuncObject("head", func(a *object) *object {
+		if a.typ != objectList {
+			return kindErrorf(TypeError, "head: not a list: '%s'", a)
+		}
+		cell := a.val.(*consCell)
+		if cell == nil {
+			return kindErrorf(DomainError, "head: empty list")
+		}
+		return cell.head
+	})
+	builtinTail = newFuncObject("tail", func(a *object) *object {
+		if a.typ != objectList {
+			return kindErrorf(TypeError, "tail: not a list: '%s'", a)
+		}
+		cell := a.val.(*consCell)
+		if cell == nil {
+			return kindErrorf(DomainError, "tail: empty list")
+		}
+		return cell.tail
+	})
+)
+
+// The builtin function isnil returns whether a list is empty.
+// Signature: list -> bool
+var builtinIsnil = newFuncObject("isnil", func(a *object) *object {
+	if a.typ != objectList {
+		return kindErrorf(TypeError, "isnil: not a list: '%s'", a)
+	}
+	return boolObject(a.val.(*consCell) == nil)
+})
+
+// pairValue is the value of a pair object.
+type pairValue struct {
+	fst, snd *object
+}
+
+// The builtin function pair returns a pair of its two arguments, which can be
+// any objects.
+// Signature: a -> b -> pair a b
+var builtinPair = newFuncObject("pair", func(a *object) *object {
+	return newFuncObject("pair", func(b *object) *object {
+		return &object{objectPair, &pairValue{a, b}}
+	})
+})
+
+// The builtin functions fst and snd return the first and second element of a
+// pair, respectively.
+// Signature: pair a b -> a, pair a b -> b
+var (
+	builtinFst = newFuncObject("fst", func(a *object) *object {
+		if a.typ != objectPair {
+			return kindErrorf(TypeError, "fst: not a pair: '%s'", a)
+		}
+		return a.val.(*pairValue).fst
+	})
+	builtinSnd = newFuncObject("snd", func(a *object) *object {
+		if a.typ != objectPair {
+			return kindErrorf(TypeError, "snd: not a pair: '%s'", a)
+		}
+		return a.val.(*pairValue).snd
+	})
+)
+
+// printOutput is where the builtin function print writes to. It can be replaced
+// to capture the output, e.g. when embedding the interpreter or in tests. Since
+// programs may be evaluated concurrently, it should be safe for concurrent use,
+// and it shouldn't be replaced while a program is being evaluated.
+var printOutput io.Writer = os.Stderr
+
+// The builtin function print writes its argument to printOutput, followed by a
+// newline, and returns it unchanged so that it can be used in the middle of an
+// expression. It's the only builtin with a side effect; all of the others only
+// compute their results from their arguments.
+// Signature: object -> object
+var builtinPrint = newFuncObject("print", func(a *object) *object {
+	fmt.Fprintln(printOutput, a)
+	return a
+})
+
+// The builtin function id returns its argument.
+// Signature: a -> a
+var builtinID = newFuncObject("id", func(a *object) *object {
+	return a
+})
+
+// The builtin function const returns its first argument, ignoring the second.
+// Signature: a -> b -> a
+var builtinConst = newFuncObject("const", func(a *object) *object {
+	return newFuncObject("const", func(b *object) *object {
+		return a
+	})
+})
+
+// The builtin function compose returns the composition of two functions: a
+// function which applies the second function to its argument and then the first
+// function to the result.
+// Signature: (b -> c) -> (a -> b) -> a -> c
+var builtinCompose = newFuncObject("compose", func(f *object) *object {
+	if _, ok := f.val.(applyer); !ok {
+		return kindErrorf(TypeError, "compose: not a function: '%s'", f)
+	}
+	return newFuncObject("compose", func(g *object) *object {
+		if _, ok := g.val.(applyer); !ok {
+			return kindErrorf(TypeError, "compose: not a function: '%s'", g)
+		}
+		return newEvalFuncObject("compose", func(ev *evaluator, x *object) *object {
+			y := ev.apply(g, x)
+			if y.typ == objectError {
+				return y
+			}
+			return ev.apply(f, y)
+		})
+	})
+})
+
+// The builtin function apply applies its first argument, which must be a
+// function, to its second argument.
+// Signature: (a -> b) -> a -> b
+var builtinApply = newFuncObject("apply", func(f *object) *object {
+	if _, ok := f.val.(applyer); !ok {
+		return kindErrorf(TypeError, "apply: not a function: '%s'", f)
+	}
+	return newEvalFuncObject("apply", func(ev *evaluator, x *object) *object {
+		return ev.apply(f, x)
+	})
+})
+
+// The builtin function fold reduces a list to a single value by applying a
+// function to each element and an accumulator, starting from the last element
+// and the given initial value, so "app app app fold f z l" is
+// "app app f x1 app app f x2 ... z" for the elements x1, x2, ... of l. The
+// initial value is returned for the empty list. The list is traversed
+// iteratively, so long lists don't use up the stack.
+// Signature: (a -> b -> b) -> b -> list a -> b
+var builtinFold = newFuncObject("fold", func(f *object) *object {
+	if _, ok := f.val.(applyer); !ok {
+		return kindErrorf(TypeError, "fold: not a function: '%s'", f)
+	}
+	return newFuncObject("fold", func(acc *object) *object {
+		return newEvalFuncObject("fold", func(ev *evaluator, list *object) *object {
+			if list.typ != objectList {
+				return kindErrorf(TypeError, "fold: not a list: '%s'", list)
+			}
+			var elems []*object
+			for cell := list.val.(*consCell); cell != nil; cell = cell.tail.val.(*consCell) {
+				elems = append(elems, cell.head)
+			}
+			acc := acc
+			for i := len(elems) - 1; i >= 0; i-- {
+				g := ev.apply(f, elems[i])
+				if g.typ == objectError {
+					return g
+				}
+				if acc = ev.apply(g, acc); acc.typ == objectError {
+					return acc
+				}
+			}
+			return acc
+		})
 	})
 })
 
+// The builtin function map returns the list of the results of applying a
+// function to each element of a list, in order. Like fold, it traverses the
+// list iteratively.
+// Signature: (a -> b) -> list a -> list b
+var builtinMap = newFuncObject("map", func(f *object) *object {
+	if _, ok := f.val.(applyer); !ok {
+		return kindErrorf(TypeError, "map: not a function: '%s'", f)
+	}
+	return newEvalFuncObject("map", func(ev *evaluator, list *object) *object {
+		if list.typ != objectList {
+			return kindErrorf(TypeError, "map: not a list: '%s'", list)
+		}
+		var results []*object
+		for cell := list.val.(*consCell); cell != nil; cell = cell.tail.val.(*consCell) {
+			result := ev.apply(f, cell.head)
+			if result.typ == objectError {
+				return result
+			}
+			results = append(results, result)
+		}
+		mapped := nilObject
+		for i := len(results) - 1; i >= 0; i-- {
+			mapped = &object{objectList, &consCell{results[i], mapped}}
+		}
+		return mapped
+	})
+})
+
+// The builtin functions curry and uncurry convert between functions which take
+// a pair and curried functions which take the pair's elements as two separate
+// arguments: "app app app curry f a b" is the same as "app f app app pair a b",
+// and "app app uncurry g p" is the same as "app app g app fst p app snd p".
+// Signature: (pair a b -> c) -> a -> b -> c, (a -> b -> c) -> pair a b -> c
+var (
+	builtinCurry = newFuncObject("curry", func(f *object) *object {
+		if _, ok := f.val.(applyer); !ok {
+			return kindErrorf(TypeError, "curry: not a function: '%s'", f)
+		}
+		return newFuncObject("curry", func(a *object) *object {
+			return newEvalFuncObject("curry", func(ev *evaluator, b *object) *object {
+				return ev.apply(f, &object{objectPair, &pairValue{a, b}})
+			})
+		})
+	})
+	builtinUncurry = newFuncObject("uncurry", func(f *object) *object {
+		if _, ok := f.val.(applyer); !ok {
+			return kindErrorf(TypeError, "uncurry: not a function: '%s'", f)
+		}
+		return newEvalFuncObject("uncurry", func(ev *evaluator, p *object) *object {
+			if p.typ != objectPair {
+				return kindErrorf(TypeError, "uncurry: not a pair: '%s'", p)
+			}
+			pv := p.val.(*pairValue)
+			g := ev.apply(f, pv.fst)
+			if g.typ == objectError {
+				return g
+			}
+			return ev.apply(g, pv.snd)
+		})
+	})
+)
+
+// builtinArity contains the number of arguments that each built-in function
+// takes before it returns a value other than a function.
+var builtinArity = map[*object]int{
+	builtinAdd:     2,
+	builtinIf:      3,
+	builtinGt:      2,
+	builtinGte:     2,
+	builtinLte:     2,
+	builtinBand:    2,
+	builtinBor:     2,
+	builtinBxor:    2,
+	builtinShl:     2,
+	builtinShr:     2,
+	builtinCmp:     2,
+	builtinIsnum:   1,
+	builtinIsbool:  1,
+	builtinTypeof:  1,
+	builtinIsqrt:   1,
+	builtinNeg:     1,
+	builtinMin:     2,
+	builtinMax:     2,
+	builtinPow:     2,
+	builtinFact:    1,
+	builtinConcat:  2,
+	builtinStrlen:  1,
+	builtinCons:    2,
+	builtinHead:    1,
+	builtinTail:    1,
+	builtinIsnil:   1,
+	builtinPrint:   1,
+	builtinID:      1,
+	builtinConst:   2,
+	builtinCompose: 3,
+	builtinApply:   2,
+	builtinCurry:   3,
+	builtinUncurry: 2,
+	builtinFold:    3,
+	builtinMap:     2,
+	builtinPair:    2,
+	builtinFst:     1,
+	builtinSnd:     1,
+}
+
+// overApplication returns an error object describing the problem if app
+// applies a built-in function to more arguments than it takes, e.g.
+// "app app app add 1 2 3", or nil otherwise. Since the extra argument is
+// applied to the builtin's result, this is only worth checking once that
+// result turns out not to be a function.
+func overApplication(app *appNode, env *environment) *object {
+	args := 1
+	head := app.fn
+	for head.typ == nodeApp {
+		head = head.val.(*appNode).fn
+		args++
+	}
+	if head.typ != nodeIdentifier {
+		return nil
+	}
+	name := head.val.(string)
+	arity, ok := builtinArity[env.lookup(name)]
+	if !ok || args <= arity {
+		return nil
+	}
+	return kindErrorf(ArityError, "apply: too many arguments: '%s' takes %d, got %d", name, arity, args)
+}
+
 // An environment contains a list of symbols. It is used to resolve identifiers
 // when evaluating a parse tree.
 //
@@ -126,7 +912,9 @@ var builtinGt = newFuncObject(func(a *object) *object {
 // earlier ones.
 //
 // This is an immutable data structure, so all operations return a new
-// environment instead of mutating the current one.
+// environment instead of mutating the current one. The one exception is the
+// environment that a letrec expression evaluates its value in, which has to
+// exist before the value does (see evalEnv).
 type environment struct {
 	parent *environment
 	symbol string
@@ -153,6 +941,23 @@ func (e *environment) extend(symbol string, val *object) *environment {
 	return newEnvironment(e, symbol, val)
 }
 
+// filter returns an environment which contains the symbols in e for which keep
+// returns true, in the same order, so that duplicates still take precedence in
+// the same way.
+func (e *environment) filter(keep func(symbol string) bool) *environment {
+	var kept []*environment
+	for cur := e; cur != nil; cur = cur.parent {
+		if keep(cur.symbol) {
+			kept = append(kept, cur)
+		}
+	}
+	var filtered *environment
+	for i := len(kept) - 1; i >= 0; i-- {
+		filtered = newEnvironment(filtered, kept[i].symbol, kept[i].val)
+	}
+	return filtered
+}
+
 // lookup returns the value associated with a symbol. See the environment type
 // definition for details on how duplicates are handled.
 func (e *environment) lookup(symbol string) *object {
@@ -161,7 +966,37 @@ func (e *environment) lookup(symbol string) *object {
 			return cur.val
 		}
 	}
-	return errorObjectf("unknown identifier: '%s'", symbol)
+	return kindErrorf(UnboundIdentifierError, "unknown identifier: '%s'", symbol)
+}
+
+// Symbols returns the symbols in the environment, each only once even if it was
+// added more than once, in the order that the bindings which take precedence
+// were added. For example, if "x", "y", and then "x" again were added, the
+// symbols are "y" and "x".
+func (e *environment) Symbols() []string {
+	bindings := e.bindings()
+	symbols := make([]string, len(bindings))
+	for i, b := range bindings {
+		symbols[i] = b.symbol
+	}
+	return symbols
+}
+
+// bindings returns the bindings in the environment which take precedence, in
+// the order that they were added, like Symbols.
+func (e *environment) bindings() []*environment {
+	var bindings []*environment
+	seen := make(map[string]bool)
+	for cur := e; cur != nil; cur = cur.parent {
+		if !seen[cur.symbol] {
+			seen[cur.symbol] = true
+			bindings = append(bindings, cur)
+		}
+	}
+	for i, j := 0, len(bindings)-1; i < j; i, j = i+1, j-1 {
+		bindings[i], bindings[j] = bindings[j], bindings[i]
+	}
+	return bindings
 }
 
 // A lamObject represents a lambda function within the interpreter context.
@@ -172,55 +1007,543 @@ type lamObject struct {
 
 var _ applyer = &lamObject{}
 
-func (v *lamObject) apply(arg *object) *object {
-	return evalEnv(v.node.body, v.env.extend(v.node.param, arg))
+func (v *lamObject) apply(ev *evaluator, arg *object) *object {
+	return ev.evalEnv(v.node.body, ev.extend(v.env, v.node.param, arg))
+}
+
+// contextCheckInterval is the number of function applications between checks
+// of whether the evaluator's context is done.
+const contextCheckInterval = 1024
+
+// A thunk is an argument whose evaluation has been delayed by the lazy
+// evaluator until its value is needed. Thunks are only ever stored in
+// environments; looking one up evaluates it, so they never appear in the values
+// of expressions. A thunk is evaluated at most once, the first time it's looked
+// up, and its value is saved for the following lookups.
+type thunk struct {
+	node *node
+	env  *environment
+	once sync.Once // guards val, since a thunk may be shared between goroutines
+	val  *object   // value of the thunk once it's been evaluated
+}
+
+// force returns the value of the thunk stored in obj, evaluating it if it hasn't
+// been evaluated yet.
+func (ev *evaluator) force(obj *object) *object {
+	t := obj.val.(*thunk)
+	t.once.Do(func() {
+		t.val = ev.evalEnv(t.node, t.env)
+		t.node, t.env = nil, nil // no longer needed
+	})
+	return t.val
+}
+
+// slabSize is the number of values of each type that an arena allocates at
+// once.
+const slabSize = 64
+
+// An arena allocates the objects and environments created during evaluation in
+// slabs rather than one at a time, which greatly reduces the number of
+// allocations made by programs that apply many lambdas.
+//
+// Values are never reused, so unlike with a free list or sync.Pool, there's no
+// need to tell which values are temporary and which end up in the result or in
+// an environment that outlives the evaluation. The garbage collector frees a
+// slab once none of its values are reachable. The cost is that a single value
+// which is kept, e.g. as part of a definition in the interactive shell, keeps
+// the rest of its slab alive as well.
+type arena struct {
+	objects []object
+	lams    []lamObject
+	envs    []environment
+}
+
+// newObject returns a new object with the given type and value.
+func (a *arena) newObject(typ objectType, val interface{}) *object {
+	if len(a.objects) == 0 {
+		a.objects = make([]object, slabSize)
+	}
+	o := &a.objects[0]
+	a.objects = a.objects[1:]
+	o.typ, o.val = typ, val
+	return o
+}
+
+// newLam returns a new lambda function object.
+func (a *arena) newLam(n *lamNode, env *environment) *object {
+	if len(a.lams) == 0 {
+		a.lams = make([]lamObject, slabSize)
+	}
+	lam := &a.lams[0]
+	a.lams = a.lams[1:]
+	lam.node, lam.env = n, env
+	return a.newObject(objectLam, lam)
+}
+
+// extend is like environment.extend, but the new environment is allocated from
+// the arena.
+func (a *arena) extend(e *environment, symbol string, val *object) *environment {
+	if len(a.envs) == 0 {
+		a.envs = make([]environment, slabSize)
+	}
+	env := &a.envs[0]
+	a.envs = a.envs[1:]
+	env.parent, env.symbol, env.val = e, symbol, val
+	return env
+}
+
+// evaluator contains the evaluator's execution state. An evaluator must only be
+// used by one goroutine at a time, but any number of evaluators can run
+// concurrently, even on the same parse tree and environment. That's safe because
+// nodes, objects, and environments are never modified once they're created,
+// including the shared ones like defaultEnvironment and smallNumbers. The only
+// exceptions are thunks, which synchronize their own updates, and the
+// environment created by a letrec expression, which is updated once before
+// anything outside of the evaluator can refer to it.
+type evaluator struct {
+	arena                    // allocates the objects created during evaluation
+	steps    int             // number of function applications performed so far
+	maxSteps int             // if positive, evaluation stops after this many applications
+	ctx      context.Context // if set, evaluation stops once ctx is done
+	lazy     bool            // whether to delay evaluating the arguments of lambdas
+	err      error           // reason that evaluation was stopped, if it was
+	trace    bool            // whether to record stack traces for errors
+	stack    []*node         // applications being evaluated, if trace is set
+}
+
+// maxTailFrames is the maximum number of frames kept in the stack for the tail
+// calls made by one call to evalEnv. Only the most recent ones are kept, since
+// a program that loops through tail calls would otherwise make the stack grow
+// without bound.
+const maxTailFrames = 16
+
+// popFrames removes the frames which were pushed onto the stack since it had
+// the given length. If obj is an error which doesn't have a stack trace yet,
+// it's replaced by a copy whose trace is the stack before the frames are
+// removed, since that's where the error occurred.
+func (ev *evaluator) popFrames(base int, obj **object) {
+	if o := *obj; o.typ == objectError && errorTrace(o) == nil && len(ev.stack) > 0 {
+		e := o.val.(*errorValue)
+		trace := make([]*node, len(ev.stack))
+		for i, n := range ev.stack {
+			trace[len(trace)-1-i] = n
+		}
+		*obj = &object{objectError, &errorValue{kind: e.kind, msg: e.msg, trace: trace}}
+	}
+	ev.stack = ev.stack[:base]
+}
+
+// pushFrame pushes the application n onto the stack. The frames above base
+// belong to the current call to evalEnv; see maxTailFrames.
+func (ev *evaluator) pushFrame(base int, n *node) {
+	if len(ev.stack)-base >= maxTailFrames {
+		copy(ev.stack[base:], ev.stack[base+1:])
+		ev.stack = ev.stack[:len(ev.stack)-1]
+	}
+	ev.stack = append(ev.stack, n)
+}
+
+// step records a function application. It returns an error object if
+// evaluation should stop instead.
+func (ev *evaluator) step() *object {
+	ev.steps++
+	if ev.maxSteps > 0 && ev.steps > ev.maxSteps {
+		return kindErrorf(StoppedError, "evaluation exceeded step budget")
+	}
+	if ev.ctx != nil && ev.steps%contextCheckInterval == 0 {
+		if err := ev.ctx.Err(); err != nil {
+			ev.err = err
+			return kindErrorf(StoppedError, "evaluation stopped: %s", err)
+		}
+	}
+	return nil
+}
+
+// apply applies the function fn to arg and returns the result, or an error if
+// fn isn't a function.
+func (ev *evaluator) apply(fn, arg *object) *object {
+	fnApplyer, ok := fn.val.(applyer)
+	if !ok {
+		return kindErrorf(TypeError, "apply: invalid function: '%s'", fn)
+	}
+	if stop := ev.step(); stop != nil {
+		return stop
+	}
+	result := fnApplyer.apply(ev, arg)
+	if fn.typ == objectFunc {
+		return partlyApplied(fn, arg, result)
+	}
+	return result
+}
+
+// partlyApplied returns result, which comes from applying the built-in function
+// fn to arg, after recording fn and arg in it if it's the function that takes
+// the builtin's remaining arguments.
+func partlyApplied(fn, arg, result *object) *object {
+	if result.typ != objectFunc || result == fn {
+		return result
+	}
+	// Until a builtin has all of its arguments, it returns a new function
+	// with the same name. Once it does, it can only return a function with
+	// the same name by returning one of them, which was already applied.
+	f, r := fn.val.(*funcObject), result.val.(*funcObject)
+	if r.name != f.name || r.appliedTo != nil || builtinRoot(fn) == result {
+		return result
+	}
+	r.appliedTo, r.arg = fn, arg
+	return result
+}
+
+// builtinRoot returns the built-in function that fn is part of, if it's been
+// partly applied, or fn itself otherwise.
+func builtinRoot(fn *object) *object {
+	for fn.val.(*funcObject).appliedTo != nil {
+		fn = fn.val.(*funcObject).appliedTo
+	}
+	return fn
 }
 
 // evalEnv evaluates a node within the context of a particular environment.
+//
+// Applications of lambda functions are evaluated in a loop rather than by
+// recursion, so that programs which recurse through tail calls (including ones
+// that never terminate) run in constant stack space.
+//
+// If tracing is enabled, each application is pushed onto the evaluator's stack
+// while it's being evaluated, and errors get a copy of the stack where they
+// occurred as their trace.
+func (ev *evaluator) evalEnv(n *node, env *environment) (obj *object) {
+	base := len(ev.stack)
+	if ev.trace {
+		defer ev.popFrames(base, &obj)
+	}
+	for {
+		switch n.typ {
+		case nodeApp:
+			if ev.trace {
+				ev.pushFrame(base, n)
+			}
+			app := n.val.(*appNode)
+			fn := ev.evalEnv(app.fn, env)
+			if fn.typ == objectError {
+				return fn
+			}
+			lam, isLam := fn.val.(*lamObject)
+			var arg *object
+			if ev.lazy && isLam {
+				arg = ev.newObject(objectThunk, &thunk{node: app.arg, env: env})
+			} else if arg = ev.evalEnv(app.arg, env); arg.typ == objectError {
+				return arg
+			}
+			if isLam {
+				if stop := ev.step(); stop != nil {
+					return stop
+				}
+				n, env = lam.node.body, ev.extend(lam.env, lam.node.param, arg)
+				continue
+			}
+			if _, ok := fn.val.(applyer); !ok {
+				if err := overApplication(app, env); err != nil {
+					return err
+				}
+			}
+			return ev.apply(fn, arg)
+		case nodeLam:
+			return ev.newLam(n.val.(*lamNode), env)
+		case nodeWhen:
+			when := n.val.(*whenNode)
+			test := ev.evalEnv(when.test, env)
+			if test.typ == objectError {
+				return test
+			}
+			if test.typ != objectBool {
+				return kindErrorf(TypeError, "%s: not a bool: '%s'", when.keyword(), test)
+			}
+			// Only the branch that's taken is evaluated, unlike with if.
+			if test.val.(bool) == when.unless {
+				return nilObject
+			}
+			n = when.body
+			continue
+		case nodeSeq:
+			seq := n.val.(*seqNode)
+			if first := ev.evalEnv(seq.first, env); first.typ == objectError {
+				return first
+			}
+			n = seq.second
+			continue
+		case nodeLetrec:
+			// The value is evaluated in an environment where the name
+			// is already bound, so that a function can refer to itself.
+			// Until the value is known, the name is bound to an error,
+			// so a value which needs itself right away fails instead.
+			letrec := n.val.(*letrecNode)
+			recEnv := ev.extend(env, letrec.name, kindErrorf(UnboundIdentifierError,
+				"letrec: '%s' used before it's defined", letrec.name))
+			val := ev.evalEnv(letrec.val, recEnv)
+			if val.typ == objectError {
+				return val
+			}
+			recEnv.val = val
+			n, env = letrec.body, recEnv
+			continue
+		case nodeNumber:
+			return numberObject(n.val.(*big.Int))
+		case nodeBool:
+			return boolObject(n.val.(bool))
+		case nodeString:
+			return ev.newObject(objectString, n.val)
+		case nodeIdentifier:
+			obj := env.lookup(n.val.(string))
+			if obj.typ == objectThunk {
+				return ev.force(obj)
+			}
+			return obj
+		case nodeDef:
+			obj, _ := ev.evalDefs(n, env)
+			return obj
+		case nodeError:
+			// Callers are expected to check for parse errors before
+			// evaluating, but don't crash if they didn't.
+			return kindErrorf(ParseError, "parse error: %s", n.val)
+		default:
+			// Shouldn't be possible
+			panic(fmt.Errorf("invalid node: %s", n.typ))
+		}
+	}
+}
+
+// evalDefs evaluates a program within the context of a particular environment.
+// Along with the result, it returns the environment extended with the
+// program's top-level definitions, with later definitions shadowing earlier
+// ones. If evaluation fails, the given environment is returned unchanged.
+//
+// Definitions are evaluated in order, and each one can refer only to the ones
+// before it. In particular, a function can't refer to itself by name.
+func (ev *evaluator) evalDefs(n *node, env *environment) (*object, *environment) {
+	cur := env
+	for n.typ == nodeDef {
+		def := n.val.(*defNode)
+		val := ev.evalEnv(def.val, cur)
+		if val.typ == objectError {
+			return val, env
+		}
+		cur = cur.extend(def.name, val)
+		if def.body == nil {
+			return val, cur
+		}
+		n = def.body
+	}
+	obj := ev.evalEnv(n, cur)
+	if obj.typ == objectError {
+		return obj, env
+	}
+	return obj, cur
+}
+
+// evalEnv evaluates a node within the context of a particular environment
+// using a new evaluator.
 func evalEnv(n *node, env *environment) *object {
-	switch n.typ {
-	case nodeApp:
-		app := n.val.(*appNode)
-		fn := evalEnv(app.fn, env)
-		if fn.typ == objectError {
-			return fn
-		}
-		arg := evalEnv(app.arg, env)
-		if arg.typ == objectError {
-			return arg
-		}
-		if fnApplyer, ok := fn.val.(applyer); ok {
-			return fnApplyer.apply(arg)
-		}
-		return errorObjectf("apply: invalid function: '%s'", fn)
-	case nodeLam:
-		return &object{objectLam, &lamObject{n.val.(*lamNode), env}}
-	case nodeNumber:
-		return &object{objectNumber, n.val}
-	case nodeBool:
-		return &object{objectBool, n.val}
-	case nodeIdentifier:
-		return env.lookup(n.val.(string))
-	case nodeError:
-		return errorObjectf("parse error: %s", n.val.(string))
-	default:
-		// Shouldn't be possible
-		panic(fmt.Errorf("invalid node: %s", n.typ))
+	return new(evaluator).evalEnv(n, env)
+}
+
+// evalStrict is like evalEnv, but it first checks that each built-in function in
+// n is applied to exactly as many arguments as it takes. If one isn't, an error
+// describing the application is returned and n isn't evaluated. See arityError.
+func evalStrict(n *node, env *environment) *object {
+	if err := arityError(n, env); err != nil {
+		return err
 	}
+	return evalEnv(n, env)
+}
+
+// evalDefs is like evaluator.evalDefs, but it uses a new evaluator.
+func evalDefs(n *node, env *environment) (*object, *environment) {
+	return new(evaluator).evalDefs(n, env)
 }
 
 // defaultEnvironment is an environment that contains the built-in functions.
-// It's used as the default environment in some places, as noted.
+// It's used as the default environment in some places, as noted. Like any
+// environment, it's never modified, so it can be shared between goroutines.
 var defaultEnvironment = newEnvironment(nil, "add", builtinAdd).
 	extend("if", builtinIf).
-	extend("gt", builtinGt)
+	extend("gt", builtinGt).
+	extend("gte", builtinGte).
+	extend("lte", builtinLte).
+	extend("band", builtinBand).
+	extend("bor", builtinBor).
+	extend("bxor", builtinBxor).
+	extend("shl", builtinShl).
+	extend("shr", builtinShr).
+	extend("cmp", builtinCmp).
+	extend("isnum", builtinIsnum).
+	extend("isbool", builtinIsbool).
+	extend("typeof", builtinTypeof).
+	extend("isqrt", builtinIsqrt).
+	extend("neg", builtinNeg).
+	extend("min", builtinMin).
+	extend("max", builtinMax).
+	extend("pow", builtinPow).
+	extend("fact", builtinFact).
+	extend("concat", builtinConcat).
+	extend("strlen", builtinStrlen).
+	extend("nil", nilObject).
+	extend("cons", builtinCons).
+	extend("head", builtinHead).
+	extend("tail", builtinTail).
+	extend("isnil", builtinIsnil).
+	extend("print", builtinPrint).
+	extend("id", builtinID).
+	extend("const", builtinConst).
+	extend("compose", builtinCompose).
+	extend("apply", builtinApply).
+	extend("curry", builtinCurry).
+	extend("uncurry", builtinUncurry).
+	extend("fold", builtinFold).
+	extend("map", builtinMap).
+	extend("pair", builtinPair).
+	extend("fst", builtinFst).
+	extend("snd", builtinSnd)
 
 // eval evaluates a node with the default environment.
 func eval(n *node) *object {
 	return evalEnv(n, defaultEnvironment)
 }
 
-// evalString parses and evaluates a string with the default environment.
+// evalLazy evaluates a node with the default environment in normal order: the
+// arguments of lambdas aren't evaluated until they're used, so an argument that
+// isn't used can't cause an error or keep the program from terminating. An
+// argument is evaluated at most once no matter how many times it's used, i.e.
+// arguments are passed by need. Built-in functions still evaluate their
+// arguments before they're applied.
+func evalLazy(n *node) *object {
+	ev := &evaluator{lazy: true}
+	return ev.evalEnv(n, defaultEnvironment)
+}
+
+// evalCount evaluates a node with the default environment and also returns
+// the number of function applications that were performed, including
+// applications of built-in functions.
+func evalCount(n *node) (*object, int) {
+	ev := new(evaluator)
+	obj := ev.evalEnv(n, defaultEnvironment)
+	return obj, ev.steps
+}
+
+// EvalContext evaluates a node with the default environment, stopping early if
+// ctx is done before evaluation finishes, in which case ctx.Err() is returned.
+// The context is checked periodically, so evaluation may continue for a short
+// time after it's done. If n is an error node, its parse error is returned
+// without evaluating anything.
+func EvalContext(ctx context.Context, n *node) (*object, error) {
+	if n.typ == nodeError {
+		return nil, n.val.(error)
+	}
+	ev := &evaluator{ctx: ctx}
+	obj := ev.evalEnv(n, defaultEnvironment)
+	if ev.err != nil {
+		return nil, ev.err
+	}
+	return obj, nil
+}
+
+// ToGo converts an object into the corresponding Go value: a *big.Int for a
+// number, a bool, a string, or a []interface{} containing the converted
+// elements of a list or a pair. An error object is converted into an error
+// instead, as is a function, which can't be represented as a Go value.
+func ToGo(o *object) (interface{}, error) {
+	switch o.typ {
+	case objectNumber:
+		return new(big.Int).Set(o.val.(*big.Int)), nil
+	case objectBool:
+		return o.val.(bool), nil
+	case objectString:
+		return o.val.(string), nil
+	case objectList:
+		elems := []interface{}{}
+		for cell := o.val.(*consCell); cell != nil; cell = cell.tail.val.(*consCell) {
+			elem, err := ToGo(cell.head)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	case objectPair:
+		p := o.val.(*pairValue)
+		fst, err := ToGo(p.fst)
+		if err != nil {
+			return nil, err
+		}
+		snd, err := ToGo(p.snd)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{fst, snd}, nil
+	case objectError:
+		return nil, errors.New(o.val.(*errorValue).msg)
+	default:
+		return nil, fmt.Errorf("can't convert function to a Go value: '%s'", o)
+	}
+}
+
+// jsonObject is the JSON representation of an object. See object.MarshalJSON.
+type jsonObject struct {
+	Type        string      `json:"type"`
+	Value       interface{} `json:"value,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. An object is represented
+// as a JSON object containing its type, i.e. "number", "bool", "string",
+// "list", "pair", "error", or "function", along with its value. Numbers are
+// written as strings, since they can be too large to be represented exactly by
+// JSON numbers, and lists and pairs as arrays of their elements. Errors have a
+// message instead of a value, and functions have a description like the one
+// that String returns, e.g. "<lam x>".
+func (v *object) MarshalJSON() ([]byte, error) {
+	var j jsonObject
+	switch v.typ {
+	case objectError:
+		j = jsonObject{Type: "error", Message: v.val.(*errorValue).msg}
+	case objectBool:
+		j = jsonObject{Type: "bool", Value: v.val.(bool)}
+	case objectNumber:
+		j = jsonObject{Type: "number", Value: v.val.(*big.Int).String()}
+	case objectString:
+		j = jsonObject{Type: "string", Value: v.val.(string)}
+	case objectList:
+		elems := []*object{}
+		for cell := v.val.(*consCell); cell != nil; cell = cell.tail.val.(*consCell) {
+			elems = append(elems, cell.head)
+		}
+		j = jsonObject{Type: "list", Value: elems}
+	case objectPair:
+		p := v.val.(*pairValue)
+		j = jsonObject{Type: "pair", Value: []*object{p.fst, p.snd}}
+	case objectFunc, objectLam:
+		j = jsonObject{Type: "function", Description: v.String()}
+	default:
+		j = jsonObject{Type: "thunk", Description: v.String()}
+	}
+	// Descriptions like "<lam x>" are easier to read without escaping.
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(j); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// evalString parses and evaluates a string with the default environment. If the
+// string can't be parsed, it returns an error object containing the parse
+// error.
 func evalString(s string) *object {
-	return eval(parseString(s))
+	n := parseString(s)
+	if n.typ == nodeError {
+		return kindErrorf(ParseError, "parse error: %s", n.val)
+	}
+	return eval(n)
 }
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"math/big"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func mknumobj(n int64) *object {
@@ -27,6 +33,10 @@ var (
 var evalTests = []evalTest{
 	{"number", "3", mknumobj(3)},
 	{"negative number", "-9", mknumobj(-9)},
+	{"zero", "0", mknumobj(0)},
+	{"negative zero", "-0", mknumobj(0)},
+	{"leading zeros", "007", mknumobj(7)},
+	{"negative zero compared to zero", "app app cmp -0 0", mknumobj(0)},
 	{"bool true", "true", trueObj},
 	{"bool false", "false", falseObj},
 	{"add", "app app add 1 3", mknumobj(4)},
@@ -39,6 +49,44 @@ var evalTests = []evalTest{
 	{"if false", "app app app if false 1 2", mknumobj(2)},
 	{"if with non-bool", "app app app if 1 2 3",
 		errorObjectf("if: not a bool: '1'")},
+	{"when true", "when true app app cons 1 nil", mklistobj(mknumobj(1))},
+	{"when false", "when false 1", nilObject},
+	{"unless false", "unless app app gt 1 2 \"yes\"", &object{objectString, "yes"}},
+	{"unless true", "unless true 1", nilObject},
+	// The body would fail if it were evaluated.
+	{"when false skips body", "when false app app add true 1", nilObject},
+	{"unless true skips body", "unless true undefined", nilObject},
+	{"when with non-bool", "when 1 2", errorObjectf("when: not a bool: '1'")},
+	{"unless with non-bool", "unless nil 2", errorObjectf("unless: not a bool: 'nil'")},
+	{"when with error in test", "when undefined 2", errorObjectf("unknown identifier: 'undefined'")},
+	{"when in function", "app lam x when app app gt x 0 app app cons x nil 5", mklistobj(mknumobj(5))},
+	{"seq", "seq 1 2 3", mknumobj(3)},
+	{"semicolons", `"a"; true`, trueObj},
+	{"seq with error", "seq undefined 2", errorObjectf("unknown identifier: 'undefined'")},
+	{"seq in function", "app lam x (x; app app add x 1) 5", mknumobj(6)},
+	// Since if evaluates both branches, recursive functions choose between
+	// two lambdas and apply the chosen one.
+	{"letrec factorial", `
+		letrec mul lam a lam b
+			app app app app if app app gt b 0
+				(lam _ app app add a app app mul a app app add b -1)
+				(lam _ 0)
+				nil
+		letrec fact lam n
+			app app app app if app app gt n 0
+				(lam _ app app mul app fact app app add n -1 n)
+				(lam _ 1)
+				nil
+		app fact 10`, mknumobj(3628800)},
+	{"letrec deep recursion", `
+		letrec loop lam n
+			app app app app if app app gt n 0 (lam _ app loop app app add n -1) (lam _ "done") nil
+		app loop 1000`, &object{objectString, "done"}},
+	{"letrec without recursion", "letrec x 1 app app add x x", mknumobj(2)},
+	{"letrec used before it's defined", "letrec x app app add x 1 x",
+		errorObjectf("letrec: 'x' used before it's defined")},
+	{"letrec with error in value", "letrec f app add true f", errorObjectf("add: not a number: 'true'")},
+	{"letrec shadows definition", "def f 1 letrec f lam x app f x app typeof f", mknumobj(2)},
 	{"gt greater", "app app gt 2 1", trueObj},
 	{"gt less", "app app gt 1 2", falseObj},
 	{"gt equal", "app app gt 1 1", falseObj},
@@ -47,10 +95,197 @@ var evalTests = []evalTest{
 		errorObjectf("gt: not a number: 'false'")},
 	{"gt with non-number second argument", "app app gt 1 true",
 		errorObjectf("gt: not a number: 'true'")},
+	{"gte greater", "app app gte 2 1", trueObj},
+	{"gte less", "app app gte 1 2", falseObj},
+	{"gte equal", "app app gte 1 1", trueObj},
+	{"gte big equal", "app app gte 123456789012345678901234567890 123456789012345678901234567890", trueObj},
+	{"gte negative", "app app gte -1 1", falseObj},
+	{"gte with non-number first argument", "app app gte false 1",
+		errorObjectf("gte: not a number: 'false'")},
+	{"lte greater", "app app lte 2 1", falseObj},
+	{"lte less", "app app lte 1 2", trueObj},
+	{"lte equal", "app app lte 1 1", trueObj},
+	{"lte negative", "app app lte -1 1", trueObj},
+	{"lte with non-number second argument", "app app lte 1 true",
+		errorObjectf("lte: not a number: 'true'")},
+	{"band", "app app band 12 10", mknumobj(8)},
+	{"bor", "app app bor 12 10", mknumobj(14)},
+	{"bxor", "app app bxor 12 10", mknumobj(6)},
+	{"band negative", "app app band -1 10", mknumobj(10)},
+	{"band two negatives", "app app band -12 -10", mknumobj(-12)},
+	{"bor negative", "app app bor -8 3", mknumobj(-5)},
+	{"bxor negative", "app app bxor -1 5", mknumobj(-6)},
+	{"band non-number first argument", "app app band true 1",
+		errorObjectf("band: not a number: 'true'")},
+	{"bxor non-number second argument", "app app bxor 1 false",
+		errorObjectf("bxor: not a number: 'false'")},
+	{"shl", "app app shl 1 4", mknumobj(16)},
+	{"shr", "app app shr 16 2", mknumobj(4)},
+	{"shl by zero", "app app shl 5 0", mknumobj(5)},
+	{"shl negative number", "app app shl -3 2", mknumobj(-12)},
+	{"shr negative number", "app app shr -5 1", mknumobj(-3)},
+	{"shr past the end", "app app shr 16 100000000000000000000", mknumobj(0)},
+	{"shr negative number past the end", "app app shr -16 100", mknumobj(-1)},
+	{"shl negative count", "app app shl 1 -1",
+		errorObjectf("shl: negative shift count: '-1'")},
+	{"shr negative count", "app app shr 1 -1",
+		errorObjectf("shr: negative shift count: '-1'")},
+	{"shl huge count", "app app shl 1 100000000000000000000",
+		errorObjectf("shl: result too large: 1-bit number shifted left by '100000000000000000000'")},
+	{"shl result too large", "app app shl (app app shl 1 16777000) 1000",
+		errorObjectf("shl: result too large: 16777001-bit number shifted left by '1000'")},
+	{"shl largest result", "app app shl 1 16777215", &object{objectNumber, new(big.Int).Lsh(big.NewInt(1), 16777215)}},
+	{"shl zero by huge count", "app app shl 0 100000000000000000000", mknumobj(0)},
+	{"shl non-number count", "app app shl 1 true",
+		errorObjectf("shl: not a number: 'true'")},
+	{"cmp less", "app app cmp 1 2", mknumobj(-1)},
+	{"cmp equal", "app app cmp 2 2", mknumobj(0)},
+	{"cmp greater", "app app cmp 3 2", mknumobj(1)},
+	{"cmp negative", "app app cmp -3 -2", mknumobj(-1)},
+	{"cmp negative and positive", "app app cmp 1 -2", mknumobj(1)},
+	{"cmp non-number", "app app cmp 1 true",
+		errorObjectf("cmp: not a number: 'true'")},
+	{"isnum number", "app isnum 5", trueObj},
+	{"isnum bool", "app isnum true", falseObj},
+	{"isnum lam", "app isnum lam x x", falseObj},
+	{"isnum builtin", "app isnum add", falseObj},
+	{"isbool bool", "app isbool false", trueObj},
+	{"isbool number", "app isbool 0", falseObj},
+	{"isbool lam", "app isbool lam x true", falseObj},
+	{"isbool error", "app isbool x", errorObjectf("unknown identifier: 'x'")},
+	{"typeof number", "app typeof -5", mknumobj(0)},
+	{"typeof bool", "app typeof true", mknumobj(1)},
+	{"typeof lam", "app typeof lam x x", mknumobj(2)},
+	{"typeof builtin", "app typeof add", mknumobj(2)},
+	{"typeof partially applied builtin", "app typeof app add 1", mknumobj(2)},
+	{"isqrt perfect square", "app isqrt 144", mknumobj(12)},
+	{"isqrt non-square", "app isqrt 150", mknumobj(12)},
+	{"isqrt one below square", "app isqrt 143", mknumobj(11)},
+	{"isqrt zero", "app isqrt 0", mknumobj(0)},
+	{"isqrt negative", "app isqrt -4", errorObjectf("isqrt: negative argument")},
+	{"isqrt non-number", "app isqrt true", errorObjectf("isqrt: not a number: 'true'")},
+	{"neg positive", "app neg 5", mknumobj(-5)},
+	{"neg negative", "app neg -3", mknumobj(3)},
+	{"neg zero", "app neg 0", mknumobj(0)},
+	{"neg computed value", "app neg app app add 2 3", mknumobj(-5)},
+	{"neg non-number", "app neg true", errorObjectf("neg: not a number: 'true'")},
+	{"min ordered", "app app min 1 2", mknumobj(1)},
+	{"min reversed", "app app min 2 1", mknumobj(1)},
+	{"min equal", "app app min 2 2", mknumobj(2)},
+	{"min negative", "app app min -5 3", mknumobj(-5)},
+	{"max ordered", "app app max 1 2", mknumobj(2)},
+	{"max reversed", "app app max 2 1", mknumobj(2)},
+	{"max equal", "app app max 2 2", mknumobj(2)},
+	{"max negative", "app app max -5 -3", mknumobj(-3)},
+	{"min non-number", "app app min false 1", errorObjectf("min: not a number: 'false'")},
+	{"max non-number", "app app max 1 true", errorObjectf("max: not a number: 'true'")},
+	{"pow", "app app pow 2 10", mknumobj(1024)},
+	{"pow zero exponent", "app app pow 7 0", mknumobj(1)},
+	{"pow negative base", "app app pow -3 3", mknumobj(-27)},
+	{"pow zero to zero", "app app pow 0 0", mknumobj(1)},
+	{"pow zero", "app app pow 0 100000000000000000000", mknumobj(0)},
+	{"pow one", "app app pow 1 100000000000000000000", mknumobj(1)},
+	{"pow minus one even", "app app pow -1 100000000000000000000", mknumobj(1)},
+	{"pow minus one odd", "app app pow -1 100000000000000000001", mknumobj(-1)},
+	{"pow negative exponent", "app app pow 2 -1", errorObjectf("pow: negative exponent")},
+	{"fact zero", "app fact 0", mknumobj(1)},
+	{"fact one", "app fact 1", mknumobj(1)},
+	{"fact", "app fact 5", mknumobj(120)},
+	{"fact large", "app app cmp app fact 30 265252859812191058636308480000000", mknumobj(0)},
+	{"fact negative", "app fact -1", errorObjectf("fact: negative argument")},
+	{"fact too large", "app fact 100000000", errorObjectf("fact: result too large: '100000000'")},
+	{"fact non-number", "app fact true", errorObjectf("fact: not a number: 'true'")},
+	{"pow huge exponent", "app app pow 2 100000000000000000000",
+		errorObjectf("pow: result too large: '2' to the power of '100000000000000000000'")},
+	{"pow non-number", "app app pow 2 true", errorObjectf("pow: not a number: 'true'")},
+	{"string", `"hi"`, &object{objectString, "hi"}},
+	{"string with escapes", `"a\"b\nc"`, &object{objectString, "a\"b\nc"}},
+	{"string through lam", `app lam x x "hi"`, &object{objectString, "hi"}},
+	{"string in error message", `app app add "hi" 1`, errorObjectf("add: not a number: 'hi'")},
+	{"typeof string", `app typeof "hi"`, mknumobj(3)},
+	{"concat", `app app concat "foo" "bar"`, &object{objectString, "foobar"}},
+	{"concat empty", `app app concat "" "bar"`, &object{objectString, "bar"}},
+	{"concat non-string first argument", `app app concat 1 "bar"`,
+		errorObjectf("concat: not a string: '1'")},
+	{"concat non-string second argument", `app app concat "foo" true`,
+		errorObjectf("concat: not a string: 'true'")},
+	{"strlen", `app strlen "hello"`, mknumobj(5)},
+	{"strlen empty", `app strlen ""`, mknumobj(0)},
+	{"strlen multibyte", `app strlen "héllo, 世界"`, mknumobj(9)},
+	{"strlen concat", `app strlen app app concat "ab" "ç"`, mknumobj(3)},
+	{"strlen non-string", "app strlen 5", errorObjectf("strlen: not a string: '5'")},
+	{"nil", "nil", nilObject},
+	{"cons", "app app cons 1 nil", mklistobj(mknumobj(1))},
+	{"cons nested", "app app cons 1 app app cons true nil", mklistobj(mknumobj(1), trueObject)},
+	{"cons non-list", "app app cons 1 2", errorObjectf("cons: not a list: '2'")},
+	{"head", "app head app app cons 1 app app cons 2 nil", mknumobj(1)},
+	{"head empty", "app head nil", errorObjectf("head: empty list")},
+	{"head non-list", "app head 1", errorObjectf("head: not a list: '1'")},
+	{"tail", "app tail app app cons 1 app app cons 2 nil", mklistobj(mknumobj(2))},
+	{"tail single", "app tail app app cons 1 nil", nilObject},
+	{"tail empty", "app tail nil", errorObjectf("tail: empty list")},
+	{"tail non-list", "app tail true", errorObjectf("tail: not a list: 'true'")},
+	{"isnil nil", "app isnil nil", trueObject},
+	{"isnil cons", "app isnil app app cons 1 nil", falseObject},
+	{"isnil non-list", "app isnil 0", errorObjectf("isnil: not a list: '0'")},
+	{"typeof list", "app typeof nil", mknumobj(4)},
+	{"pair", "app app pair 1 true", &object{objectPair, &pairValue{mknumobj(1), trueObj}}},
+	{"fst", "app fst app app pair 1 true", mknumobj(1)},
+	{"snd", "app snd app app pair 1 true", trueObj},
+	{"nested pair", "app snd app fst app app pair (app app pair 1 2) 3", mknumobj(2)},
+	{"fst non-pair", "app fst 1", errorObjectf("fst: not a pair: '1'")},
+	{"snd non-pair", "app snd app app cons 1 nil", errorObjectf("snd: not a pair: '(cons 1 nil)'")},
+	{"typeof pair", "app typeof app app pair 1 2", mknumobj(5)},
+	{"fold sum", "app app app fold add 0 app app cons 1 app app cons 2 app app cons 3 nil", mknumobj(6)},
+	{"fold nil", "app app app fold add 5 nil", mknumobj(5)},
+	{"fold order", "app app app fold cons nil app app cons 1 app app cons 2 nil", mklistobj(mknumobj(1), mknumobj(2))},
+	{"fold lam", "app app app fold (lam x lam acc app app cons app app add x x acc) nil app app cons 1 app app cons 2 nil",
+		mklistobj(mknumobj(2), mknumobj(4))},
+	{"fold error", "app app app fold add 0 app app cons 1 app app cons true nil", errorObjectf("add: not a number: 'true'")},
+	{"fold non-list", "app app app fold add 0 1", errorObjectf("fold: not a list: '1'")},
+	{"fold non-function", "app fold 1", errorObjectf("fold: not a function: '1'")},
+	{"map builtin", "app app map neg app app cons 1 app app cons -2 app app cons 3 nil",
+		mklistobj(mknumobj(-1), mknumobj(2), mknumobj(-3))},
+	{"map lam", "app app map (lam x app app gt x 1) app app cons 1 app app cons 2 nil", mklistobj(falseObj, trueObj)},
+	{"map nil", "app app map neg nil", nilObject},
+	{"map error", "app app map neg app app cons 1 app app cons true nil", errorObjectf("neg: not a number: 'true'")},
+	{"map non-list", "app app map neg 1", errorObjectf("map: not a list: '1'")},
+	{"map non-function", "app map 1", errorObjectf("map: not a function: '1'")},
+	{"id", "app id 5", mknumobj(5)},
+	{"id function", "app app app id add 1 2", mknumobj(3)},
+	{"const", "app app const 1 2", mknumobj(1)},
+	{"const error", "app app const 1 x", errorObjectf("unknown identifier: 'x'")},
+	{"compose", "app app app compose (lam x app app add x 1) (lam x app app add x x) 5", mknumobj(11)},
+	{"compose builtins", "app app app compose isqrt (app add 3) 13", mknumobj(4)},
+	{"compose error", "app app app compose isqrt (app add 3) -5", errorObjectf("isqrt: negative argument")},
+	{"apply builtin", "app app app apply add 1 2", mknumobj(3)},
+	{"apply lam", "app app apply (lam x app app add x x) 4", mknumobj(8)},
+	{"apply with compose", "app app apply (app app compose isqrt isqrt) 16", mknumobj(2)},
+	{"apply error", "app app apply isqrt -1", errorObjectf("isqrt: negative argument")},
+	{"apply non-function", "app app apply 1 2", errorObjectf("apply: not a function: '1'")},
+	{"curry", "app app app curry (lam p app app add app fst p app snd p) 1 2", mknumobj(3)},
+	{"curry partial", "app app (app curry id) 1 true", &object{objectPair, &pairValue{mknumobj(1), trueObj}}},
+	{"uncurry", "app app uncurry add app app pair 1 2", mknumobj(3)},
+	{"uncurry curry", "app app uncurry (app curry fst) app app pair 1 2", mknumobj(1)},
+	{"curry uncurry", "app app app curry (app uncurry (lam x lam y y)) 1 2", mknumobj(2)},
+	{"uncurry non-pair", "app app uncurry add app app cons 1 app app cons 2 nil",
+		errorObjectf("uncurry: not a pair: '(cons 1 (cons 2 nil))'")},
+	{"uncurry error", "app app uncurry add app app pair 1 true", errorObjectf("add: not a number: 'true'")},
+	{"curry non-function", "app curry 1", errorObjectf("curry: not a function: '1'")},
+	{"compose non-function first argument", "app compose 1", errorObjectf("compose: not a function: '1'")},
+	{"compose non-function second argument", "app app compose id true", errorObjectf("compose: not a function: 'true'")},
 	{"unknown identifier", "x", errorObjectf("unknown identifier: 'x'")},
 	{"lam", "app lam x x 1", mknumobj(1)},
 	{"app invalid function", "app true 1",
 		errorObjectf("apply: invalid function: 'true'")},
+	{"builtin full application", "app app add 1 2", mknumobj(3)},
+	{"builtin partial application", "app typeof app app if true 1", mknumobj(2)},
+	{"builtin over-application", "app app app add 1 2 3",
+		errorObjectf("apply: too many arguments: 'add' takes 2, got 3")},
+	{"builtin over-application by one", "app app app app if true 1 2 3",
+		errorObjectf("apply: too many arguments: 'if' takes 3, got 4")},
+	{"over-application of lam result", "app app lam x x 1 2",
+		errorObjectf("apply: invalid function: '1'")},
 	{"parent env reference",
 		"app app lam x lam y x 1 2", mknumobj(1)},
 	{"passing lam as argument",
@@ -60,29 +295,600 @@ var evalTests = []evalTest{
 	{"example",
 		"app app (app (lam f lam y lam x (app (app f y) x)) (lam x lam y x)) 3 4",
 		mknumobj(3)},
+	{"def", "def x 2 x", mknumobj(2)},
+	{"def without body", "def x 2", mknumobj(2)},
+	{"def referring to earlier def", "def x 2 def y app app add x x y", mknumobj(4)},
+	{"def shadowing", "def x 2 def x true x", trueObj},
+	{"def error", "def x app add true x", errorObjectf("add: not a number: 'true'")},
+	{"builtin in error message", "app app add 1 gt",
+		errorObjectf("add: not a number: '<builtin gt>'")},
+	{"lam as if condition", "app app app if lam x x 1 2",
+		errorObjectf("if: not a bool: '<lam x>'")},
 }
 
-func equalObject(a, b *object) bool {
-	if a.typ != b.typ {
-		return false
+// objectStringTests contains programs whose values aren't comparable with
+// object.Equal, along with the expected string representation of each value.
+var objectStringTests = []struct {
+	input  string
+	output string
+}{
+	{"add", "<builtin add>"},
+	{"app add 1", "<builtin add>"},
+	{"-0", "0"},
+	{"-000", "0"},
+	{"007", "7"},
+	{"app if true", "<builtin if>"},
+	{"lam x x", "<lam x>"},
+	{"app lam x lam y x 1", "<lam y>"},
+	{"app lam f f gt", "<builtin gt>"},
+	{`"hi"`, "hi"},
+	{`"a\\b"`, `a\b`},
+	{"nil", "nil"},
+	{"app app cons 1 app app cons 2 nil", "(cons 1 (cons 2 nil))"},
+	{"app app cons app app cons 1 nil nil", "(cons (cons 1 nil) nil)"},
+	{"app app pair 1 2", "(pair 1 2)"},
+	{"app app pair app app pair 1 nil add", "(pair (pair 1 nil) <builtin add>)"},
+	{"app app apply add 1", "<builtin add>"},
+}
+
+func TestBuiltinArity(t *testing.T) {
+	for e := defaultEnvironment; e != nil; e = e.parent {
+		if e.val.typ != objectFunc {
+			continue
+		}
+		if _, ok := builtinArity[e.val]; !ok {
+			t.Errorf("builtin '%s' has no arity", e.symbol)
+		}
+	}
+}
+
+func TestEnvironmentSymbols(t *testing.T) {
+	tests := []struct {
+		name string
+		env  *environment
+		want []string
+	}{
+		{"empty", nil, nil},
+		{"one", newEnvironment(nil, "x", mknumobj(1)), []string{"x"}},
+		{"distinct", newEnvironment(nil, "x", mknumobj(1)).extend("y", mknumobj(2)), []string{"x", "y"}},
+		{"duplicates", newEnvironment(nil, "x", mknumobj(1)).extend("y", mknumobj(2)).
+			extend("x", mknumobj(3)).extend("z", mknumobj(4)).extend("x", mknumobj(5)), []string{"y", "z", "x"}},
+		{"duplicate at the end", newEnvironment(nil, "x", mknumobj(1)).extend("x", mknumobj(2)), []string{"x"}},
+	}
+	for _, tt := range tests {
+		if got := tt.env.Symbols(); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("[%s]\nwant: %q\ngot: %q", tt.name, tt.want, got)
+		}
 	}
-	if a.typ == objectNumber {
-		an := a.val.(*big.Int)
-		bn := b.val.(*big.Int)
-		return an.Cmp(bn) == 0
+
+	env := newEnvironment(nil, "x", mknumobj(1)).extend("x", mknumobj(2))
+	if symbols := env.Symbols(); len(symbols) != 1 || !env.lookup(symbols[0]).Equal(mknumobj(2)) {
+		t.Errorf("want: x = 2\ngot: %q = %v", symbols, env.lookup("x"))
+	}
+	symbols := defaultEnvironment.Symbols()
+	if len(symbols) == 0 || symbols[0] != "add" {
+		t.Errorf("default environment symbols: %q", symbols)
 	}
-	return a.val == b.val
+}
+
+func TestObjectEqual(t *testing.T) {
+	big1 := new(big.Int).Lsh(big.NewInt(1), 100)
+	big2 := new(big.Int).Lsh(big.NewInt(1), 100)
+	lam := evalString("lam x x")
+	str := &object{objectString, "a"}
+	tests := []struct {
+		name string
+		a, b *object
+		want bool
+	}{
+		{"equal numbers", mknumobj(3), mknumobj(3), true},
+		{"unequal numbers", mknumobj(3), mknumobj(-3), false},
+		{"unshared equal numbers", &object{objectNumber, big1}, &object{objectNumber, big2}, true},
+		{"negative zero", &object{objectNumber, big.NewInt(0)}, &object{objectNumber, new(big.Int).Neg(big.NewInt(0))}, true},
+		{"equal bools", trueObject, &object{objectBool, true}, true},
+		{"unequal bools", trueObject, falseObject, false},
+		{"equal strings", str, &object{objectString, "a"}, true},
+		{"unequal strings", str, &object{objectString, "b"}, false},
+		{"errors with equal messages", errorObjectf("x"), kindErrorf(TypeError, "x"), true},
+		{"errors with unequal messages", errorObjectf("x"), errorObjectf("y"), false},
+		{"equal lists", mklistobj(mknumobj(1), str), mklistobj(mknumobj(1), &object{objectString, "a"}), true},
+		{"lists with unequal elements", mklistobj(mknumobj(1), mknumobj(2)), mklistobj(mknumobj(1), mknumobj(3)), false},
+		{"equal pairs", evalString("app app pair 1 nil"), evalString("app app pair 1 nil"), true},
+		{"pairs with unequal elements", evalString("app app pair 1 2"), evalString("app app pair 1 3"), false},
+		{"pair and list", evalString("app app pair 1 nil"), mklistobj(mknumobj(1)), false},
+		{"lists of unequal lengths", mklistobj(mknumobj(1)), mklistobj(mknumobj(1), mknumobj(2)), false},
+		{"empty lists", nilObject, mklistobj(), true},
+		{"same builtin", defaultEnvironment.lookup("add"), defaultEnvironment.lookup("add"), true},
+		{"different builtins", defaultEnvironment.lookup("add"), defaultEnvironment.lookup("neg"), false},
+		{"same lambda", lam, lam, true},
+		{"identical lambdas", lam, evalString("lam x x"), false},
+		{"different types", mknumobj(1), trueObject, false},
+		{"number and its string", mknumobj(1), &object{objectString, "1"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Equal(tt.b); got != tt.want {
+			t.Errorf("[%s]\n%v == %v\nwant: %v\ngot: %v", tt.name, tt.a, tt.b, tt.want, got)
+		}
+		if got := tt.b.Equal(tt.a); got != tt.want {
+			t.Errorf("[%s]\n%v == %v\nwant: %v\ngot: %v", tt.name, tt.b, tt.a, tt.want, got)
+		}
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		input string
+		kind  ErrorKind
+	}{
+		{"1", NotAnError},
+		{"app app add 1 true", TypeError},
+		{"app app app if 1 2 3", TypeError},
+		{"app app cons 1 2", TypeError},
+		{"app 1 2", TypeError},
+		{"x", UnboundIdentifierError},
+		{"app app app add 1 2 3", ArityError},
+		{"app isqrt -1", DomainError},
+		{"app head nil", DomainError},
+		{"app app pow 2 -1", DomainError},
+		{"app add", ParseError},
+		{"app typeof x", UnboundIdentifierError},
+	}
+	for _, tt := range tests {
+		if got := ErrorKindOf(evalString(tt.input)); got != tt.kind {
+			t.Errorf("%s\nwant: %v\ngot: %v", tt.input, tt.kind, got)
+		}
+	}
+	if got := ErrorKindOf(evalStrict(parseString("app add 1"), defaultEnvironment)); got != ArityError {
+		t.Errorf("strict arity: want: %v\ngot: %v", ArityError, got)
+	}
+	if got := ErrorKindOf(errorObjectf("error")); got != OtherError {
+		t.Errorf("errorObjectf: want: %v\ngot: %v", OtherError, got)
+	}
+}
+
+func TestErrorTrace(t *testing.T) {
+	tests := []struct {
+		input string
+		trace []string
+	}{
+		{"app app add 1 2", nil},
+		{"x", nil},
+		{"app app add 1 true", []string{"(app (app add 1) true)"}},
+		{"app (lam x app app add x true) 1", []string{
+			"(app (app add x) true)",
+			"(app (lam x (app (app add x) true)) 1)"}},
+		{"def f lam x app app add x true app app add 1 app f 2", []string{
+			"(app (app add x) true)",
+			"(app f 2)",
+			"(app (app add 1) (app f 2))"}},
+		{"app (lam x x) app isqrt -1", []string{
+			"(app isqrt -1)",
+			"(app (lam x x) (app isqrt -1))"}},
+		{"app app app compose isqrt neg 4", []string{"(app (app (app compose isqrt) neg) 4)"}},
+	}
+	for _, tt := range tests {
+		ev := &evaluator{trace: true}
+		obj := ev.evalEnv(parseString(tt.input), defaultEnvironment)
+		var trace []string
+		if obj.typ == objectError {
+			for _, n := range errorTrace(obj) {
+				trace = append(trace, sexpr(n))
+			}
+		}
+		if fmt.Sprint(trace) != fmt.Sprint(tt.trace) {
+			t.Errorf("%s\nwant: %q\ngot: %q", tt.input, tt.trace, trace)
+		}
+		if len(ev.stack) != 0 {
+			t.Errorf("%s\nframes left on the stack: %d", tt.input, len(ev.stack))
+		}
+		if obj := evalString(tt.input); obj.typ == objectError && errorTrace(obj) != nil {
+			t.Errorf("%s\ntrace without tracing enabled", tt.input)
+		}
+	}
+}
+
+func TestErrorTraceTailCalls(t *testing.T) {
+	// Each iteration of the loop is a tail call, so only the most recent
+	// ones are kept.
+	ev := &evaluator{trace: true}
+	obj := ev.evalEnv(parseString(strings.Replace(countdown, "lam x n", "lam x app app add n true", 1)), defaultEnvironment)
+	if obj.typ != objectError {
+		t.Fatalf("want an error, got: %v", obj)
+	}
+	if n := len(errorTrace(obj)); n > maxTailFrames {
+		t.Errorf("want at most %d frames, got %d", maxTailFrames, n)
+	}
+}
+
+func TestObjectString(t *testing.T) {
+	for _, ot := range objectStringTests {
+		for i := 0; i < 2; i++ {
+			if got := evalString(ot.input).String(); got != ot.output {
+				t.Errorf("%s\nwant: %q\ngot: %q", ot.input, ot.output, got)
+			}
+		}
+	}
+}
+
+func TestBoolObjectIdentity(t *testing.T) {
+	for _, input := range []string{"true", "app app gt 2 1", "app lam x x true", "app app app if false 1 true"} {
+		if a, b := evalString(input), evalString(input); a != trueObject || b != trueObject {
+			t.Errorf("%s\nwant: %p\ngot: %p, %p", input, trueObject, a, b)
+		}
+	}
+	for _, input := range []string{"false", "app app gt 1 2", "app app gt 1 1"} {
+		if a, b := evalString(input), evalString(input); a != falseObject || b != falseObject {
+			t.Errorf("%s\nwant: %p\ngot: %p, %p", input, falseObject, a, b)
+		}
+	}
+}
+
+func TestNumberObjectIdentity(t *testing.T) {
+	for _, input := range []string{"-128", "0", "1", "256", "app app add 100 156", "app app add 1 -129"} {
+		a, b := evalString(input), evalString(input)
+		if a != b {
+			t.Errorf("%s\nwant: shared object\ngot: %p, %p", input, a, b)
+		}
+	}
+	for _, input := range []string{"-129", "257", "100000000000000000000", "app app add 200 57"} {
+		a, b := evalString(input), evalString(input)
+		if a == b {
+			t.Errorf("%s\nwant: separate objects\ngot: %p, %p", input, a, b)
+		}
+	}
+}
+
+func TestMinMaxIdentity(t *testing.T) {
+	a := &object{objectNumber, big.NewInt(1000)}
+	b := &object{objectNumber, big.NewInt(2000)}
+	tests := []struct {
+		fn   *object
+		a, b *object
+		want *object
+	}{
+		{builtinMin, a, b, a},
+		{builtinMin, b, a, a},
+		{builtinMax, a, b, b},
+		{builtinMax, b, a, b},
+	}
+	ev := new(evaluator)
+	for _, tt := range tests {
+		fn := tt.fn.val.(applyer).apply(ev, tt.a)
+		if got := fn.val.(applyer).apply(ev, tt.b); got != tt.want {
+			t.Errorf("%s %s %s\nwant: %p\ngot: %p", tt.fn, tt.a, tt.b, tt.want, got)
+		}
+	}
+}
+
+// mklistobj returns a list object containing the given elements.
+func mklistobj(elems ...*object) *object {
+	list := nilObject
+	for i := len(elems) - 1; i >= 0; i-- {
+		list = &object{objectList, &consCell{elems[i], list}}
+	}
+	return list
 }
 
 func TestEval(t *testing.T) {
 	for _, et := range evalTests {
 		val := evalString(et.input)
-		if !equalObject(val, et.val) {
+		if !val.Equal(et.val) {
 			t.Errorf("[%s]: %s\nwant: %q\ngot: %q", et.name, et.input, et.val, val)
 		}
 	}
 }
 
+var evalCountTests = []struct {
+	input string
+	val   *object
+	steps int
+}{
+	{"1", mknumobj(1), 0},
+	{"lam x x", nil, 0},
+	{"app app add 1 2", mknumobj(3), 2},
+	{"app lam x x 1", mknumobj(1), 1},
+	{"app (lam f app f 1) (lam x x)", mknumobj(1), 2},
+	{"app lam x app app add x x 2", mknumobj(4), 3},
+	{"app app app if true 1 2", mknumobj(1), 3},
+	{"def double lam x app app add x x app double app double 1", mknumobj(4), 6},
+	{"app app add true 1", errorObjectf("add: not a number: 'true'"), 1},
+}
+
+func TestEvalCount(t *testing.T) {
+	for _, ct := range evalCountTests {
+		val, steps := evalCount(parseString(ct.input))
+		if (ct.val != nil && !val.Equal(ct.val)) || steps != ct.steps {
+			t.Errorf("%s\nwant: %q, %d\ngot: %q, %d", ct.input, ct.val, ct.steps, val, steps)
+		}
+	}
+}
+
+// omega is a program whose evaluation never terminates.
+const omega = "app (lam x app x x) (lam x app x x)"
+
+// TestConcurrentEval evaluates the same programs from several goroutines at
+// once. It's mainly useful with the race detector (go test -race), which
+// reports any shared state that evaluation modifies.
+func TestConcurrentEval(t *testing.T) {
+	roots := make([]*node, len(evalTests))
+	for i, et := range evalTests {
+		roots[i] = parseString(et.input)
+	}
+	countdownRoot := parseString(countdown)
+	const goroutines = 8
+	errs := make(chan string, goroutines*(len(evalTests)+1))
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := range evalTests {
+				// Start each goroutine at a different test so
+				// that they evaluate different programs at the
+				// same time.
+				i = (i + g*len(evalTests)/goroutines) % len(evalTests)
+				if roots[i].typ == nodeError {
+					continue
+				}
+				if val := eval(roots[i]); !val.Equal(evalTests[i].val) {
+					errs <- fmt.Sprintf("%s\nwant: %v\ngot: %v", evalTests[i].input, evalTests[i].val, val)
+				}
+			}
+			if val := eval(countdownRoot); !val.Equal(mknumobj(0)) {
+				errs <- fmt.Sprintf("countdown\nwant: 0\ngot: %v", val)
+			}
+			if typ, err := inferType(roots[0], defaultEnvironment); err != nil {
+				errs <- fmt.Sprintf("%s\ntype error: %v (%v)", evalTests[0].input, err, typ)
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestEvalLazy(t *testing.T) {
+	// Every program in evalTests that doesn't involve errors should have the
+	// same value in either order.
+	for _, et := range evalTests {
+		if et.val.typ == objectError {
+			continue
+		}
+		if val := evalLazy(parseString(et.input)); !val.Equal(et.val) {
+			t.Errorf("%s\nwant: %v\ngot: %v", et.input, et.val, val)
+		}
+	}
+
+	tests := []struct {
+		input  string
+		strict *object // nil if the evaluation doesn't terminate
+		normal *object
+	}{
+		{"app (lam x 1) " + omega, nil, mknumobj(1)},
+		{"app (lam x 1) app isqrt -1", errorObjectf("isqrt: negative argument"), mknumobj(1)},
+		{"app app (lam x lam y y) x 2", errorObjectf("unknown identifier: 'x'"), mknumobj(2)},
+		{"app (lam x app app add x x) app isqrt 16", mknumobj(8), mknumobj(8)},
+		{"app (lam x app app add x 1) app isqrt -1", errorObjectf("isqrt: negative argument"),
+			errorObjectf("isqrt: negative argument")},
+		{strings.Replace(countdown, "1000", "3", 1), mknumobj(0), mknumobj(0)},
+	}
+	for _, tt := range tests {
+		n := parseString(tt.input)
+		if tt.strict != nil {
+			if val := evalEnv(n, defaultEnvironment); !val.Equal(tt.strict) {
+				t.Errorf("%s\nstrict: want: %v\ngot: %v", tt.input, tt.strict, val)
+			}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			ev := &evaluator{ctx: ctx}
+			ev.evalEnv(n, defaultEnvironment)
+			cancel()
+			if ev.err != context.DeadlineExceeded {
+				t.Errorf("%s\nstrict: evaluation terminated: %v", tt.input, ev.err)
+			}
+		}
+		ev := &evaluator{lazy: true}
+		if val := ev.evalEnv(n, defaultEnvironment); !val.Equal(tt.normal) {
+			t.Errorf("%s\nnormal: want: %v\ngot: %v", tt.input, tt.normal, val)
+		}
+	}
+}
+
+func TestEvalStrict(t *testing.T) {
+	tests := []struct {
+		input  string
+		strict *object
+		normal *object
+	}{
+		{"app app add 1 2", mknumobj(3), mknumobj(3)},
+		{"app typeof app add 1", errorObjectf("add: expected 2 arguments, got 1 in (app add 1)"), mknumobj(2)},
+		{"app app add true 1", errorObjectf("add: not a number: 'true'"), errorObjectf("add: not a number: 'true'")},
+		{"app app app add 1 2 3", errorObjectf("add: expected 2 arguments, got 3 in (app (app (app add 1) 2) 3)"),
+			errorObjectf("apply: too many arguments: 'add' takes 2, got 3")},
+		{"app app app apply add 1 2", mknumobj(3), mknumobj(3)},
+	}
+	for _, tt := range tests {
+		n := parseString(tt.input)
+		if val := evalStrict(n, defaultEnvironment); !val.Equal(tt.strict) {
+			t.Errorf("%s\nstrict: want: %v\ngot: %v", tt.input, tt.strict, val)
+		}
+		if val := evalEnv(n, defaultEnvironment); !val.Equal(tt.normal) {
+			t.Errorf("%s\nnormal: want: %v\ngot: %v", tt.input, tt.normal, val)
+		}
+	}
+}
+
+func TestEvalLazyByNeed(t *testing.T) {
+	defer func(w io.Writer) { printOutput = w }(printOutput)
+	var buf bytes.Buffer
+	printOutput = &buf
+	tests := []struct {
+		input  string
+		val    *object
+		output string
+	}{
+		{"app (lam x app app add x x) (app print 5)", mknumobj(10), "5\n"},
+		{"app (lam x app (lam y app app add x y) x) (app print 5)", mknumobj(10), "5\n"},
+		{"app (lam x 1) (app print 5)", mknumobj(1), ""},
+		{"app app (lam x lam y app app add x x) (app print 1) (app print 2)", mknumobj(2), "1\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		if val := evalLazy(parseString(tt.input)); !val.Equal(tt.val) || buf.String() != tt.output {
+			t.Errorf("%s\nwant: %v, %q\ngot: %v, %q", tt.input, tt.val, tt.output, val, buf.String())
+		}
+	}
+}
+
+func TestEvalErrorNode(t *testing.T) {
+	tests := []struct {
+		n   *node
+		val *object
+	}{
+		{errorNodef("bad number: '1x'"), errorObjectf("parse error: bad number: '1x'")},
+		{newExpectError(syntaxExpression, token{typ: tokenEOF}), errorObjectf("parse error: expecting expression; got EOF")},
+		{mkapp(mkident("add"), errorNodef("oops")), errorObjectf("parse error: oops")},
+	}
+	for _, tt := range tests {
+		if val := eval(tt.n); !val.Equal(tt.val) {
+			t.Errorf("%v\nwant: %v\ngot: %v", tt.n, tt.val, val)
+		}
+	}
+	if val := evalString("app add"); !val.Equal(errorObjectf("parse error: expecting expression; got EOF")) {
+		t.Errorf("want: parse error\ngot: %v", val)
+	}
+	if val, err := EvalContext(context.Background(), errorNodef("oops")); val != nil || err == nil || err.Error() != "oops" {
+		t.Errorf("want: <nil>, oops\ngot: %v, %v", val, err)
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	val, err := EvalContext(context.Background(), parseString("app app add 1 2"))
+	if err != nil || !val.Equal(mknumobj(3)) {
+		t.Errorf("want: 3, <nil>\ngot: %v, %v", val, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	val, err = EvalContext(ctx, parseString(omega))
+	if val != nil || err != context.Canceled {
+		t.Errorf("want: <nil>, %v\ngot: %v, %v", context.Canceled, val, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := EvalContext(ctx, parseString(omega))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("want: %v\ngot: %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("evaluation wasn't stopped after the deadline")
+	}
+}
+
+func TestLongList(t *testing.T) {
+	const n = 1000000
+	elems := make([]*object, n)
+	for i := range elems {
+		elems[i] = mknumobj(1)
+	}
+	env := defaultEnvironment.extend("l", mklistobj(elems...))
+	if val := evalEnv(parseString("app app app fold add 0 l"), env); !val.Equal(mknumobj(n)) {
+		t.Errorf("want: %d\ngot: %v", n, val)
+	}
+	if val := evalEnv(parseString("app app app fold add 0 app app map neg l"), env); !val.Equal(mknumobj(-n)) {
+		t.Errorf("want: %d\ngot: %v", -n, val)
+	}
+}
+
+func TestMaxSteps(t *testing.T) {
+	tests := []struct {
+		input    string
+		maxSteps int
+		val      *object
+	}{
+		{omega, 100, kindErrorf(StoppedError, "evaluation exceeded step budget")},
+		{"app app add 1 2", 2, mknumobj(3)},
+		{"app app add 1 2", 1, kindErrorf(StoppedError, "evaluation exceeded step budget")},
+		{countdown, 100, kindErrorf(StoppedError, "evaluation exceeded step budget")},
+		{countdown, 0, mknumobj(0)},
+	}
+	for _, tt := range tests {
+		ev := &evaluator{maxSteps: tt.maxSteps}
+		val := ev.evalEnv(parseString(tt.input), defaultEnvironment)
+		if !val.Equal(tt.val) || ErrorKindOf(val) != ErrorKindOf(tt.val) {
+			t.Errorf("%s with %d steps\nwant: %v\ngot: %v", tt.input, tt.maxSteps, tt.val, val)
+		}
+	}
+}
+
+// countdown is a program that loops 1000 times using the fixed-point
+// combinator and returns 0.
+const countdown = `
+app
+    app lam fix app
+        fix
+        lam f lam n app
+            app app app
+                if
+                app app gt n 0
+                lam x app f app app add n -1
+                lam x n
+            false
+    lam f app
+        lam x app f lam y app app x x y
+        lam x app f lam y app app x x y
+    1000
+`
+
+func TestCountdown(t *testing.T) {
+	if val := evalString(countdown); !val.Equal(mknumobj(0)) {
+		t.Errorf("want: 0\ngot: %v", val)
+	}
+}
+
+// TestCountdownAllocs checks that the evaluator's arena is being used, since
+// without it, countdown makes more than 30000 allocations.
+func TestCountdownAllocs(t *testing.T) {
+	n := parseString(countdown)
+	if allocs := testing.AllocsPerRun(5, func() { eval(n) }); allocs > 20000 {
+		t.Errorf("want: at most 20000 allocations\ngot: %v", allocs)
+	}
+}
+
+// TestArenaRetainedObjects checks that objects allocated by one evaluation are
+// still intact after they've been kept in an environment which is used by
+// later evaluations.
+func TestArenaRetainedObjects(t *testing.T) {
+	s := newSession(defaultEnvironment)
+	s.eval(parseString(`def k lam x lam y x def s "kept" def f app k s f`))
+	for i := 0; i < 3*slabSize; i++ {
+		s.eval(parseString("app app lam a lam b app app add a b 1 2"))
+	}
+	if val := s.eval(parseString("app f 1")); !val.Equal(&object{objectString, "kept"}) {
+		t.Errorf("want: kept\ngot: %v", val)
+	}
+	if val := s.eval(parseString("app app k 5 6")); !val.Equal(mknumobj(5)) {
+		t.Errorf("want: 5\ngot: %v", val)
+	}
+}
+
+func BenchmarkCountdown(b *testing.B) {
+	n := parseString(countdown)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		eval(n)
+	}
+}
+
 func readLines(filename string) ([]string, error) {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -159,3 +965,160 @@ func TestEvalFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestToGo(t *testing.T) {
+	tests := []struct {
+		input string
+		val   interface{}
+		err   string
+	}{
+		{"12345678901234567890", "12345678901234567890", ""},
+		{"-3", "-3", ""},
+		{"true", true, ""},
+		{"false", false, ""},
+		{`"hi"`, "hi", ""},
+		{"nil", []interface{}{}, ""},
+		{`app app cons 1 app app cons "a" nil`, []interface{}{big.NewInt(1), "a"}, ""},
+		{"app app cons add nil", nil, "can't convert function to a Go value: '<builtin add>'"},
+		{`app app pair 1 "a"`, []interface{}{big.NewInt(1), "a"}, ""},
+		{"app app pair 1 add", nil, "can't convert function to a Go value: '<builtin add>'"},
+		{"x", nil, "unknown identifier: 'x'"},
+		{"add", nil, "can't convert function to a Go value: '<builtin add>'"},
+		{"lam x x", nil, "can't convert function to a Go value: '<lam x>'"},
+	}
+	for _, tt := range tests {
+		val, err := ToGo(evalString(tt.input))
+		var errStr string
+		if err != nil {
+			errStr = err.Error()
+		}
+		want := tt.val
+		if s, ok := want.(string); ok && tt.input[0] != '"' {
+			// Numbers are given as strings to allow ones that
+			// don't fit into an int64.
+			want, _ = new(big.Int).SetString(s, 10)
+		}
+		if fmt.Sprintf("%T %v", val, val) != fmt.Sprintf("%T %v", want, want) || errStr != tt.err {
+			t.Errorf("%s\nwant: %T %v, %q\ngot: %T %v, %q", tt.input, want, want, tt.err, val, val, errStr)
+		}
+	}
+}
+
+func TestObjectText(t *testing.T) {
+	tests := []struct {
+		input string
+		base  int
+		want  string
+	}{
+		{"255", 2, "11111111"},
+		{"255", 8, "377"},
+		{"255", 10, "255"},
+		{"255", 16, "ff"},
+		{"-10", 2, "-1010"},
+		{"-10", 8, "-12"},
+		{"-10", 16, "-a"},
+		{"0", 16, "0"},
+		{"app app cons 10 app app cons 16 nil", 16, "(cons a (cons 10 nil))"},
+		{"app app cons true nil", 2, "(cons true nil)"},
+		{"app app pair 10 app app cons 16 nil", 16, "(pair a (cons 10 nil))"},
+		{`"10"`, 2, "10"},
+		{"app app shl 1 -9", 16, "shl: negative shift count: '-9'"},
+	}
+	for _, tt := range tests {
+		if got := evalString(tt.input).Text(tt.base); got != tt.want {
+			t.Errorf("input: %q, base %d\nwant: %q\ngot: %q", tt.input, tt.base, tt.want, got)
+		}
+	}
+	if got := evalString("255").String(); got != "255" {
+		t.Errorf("String() is %q, want base 10", got)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		json  string
+	}{
+		{"123456789012345678901234567890", `{"type":"number","value":"123456789012345678901234567890"}`},
+		{"-5", `{"type":"number","value":"-5"}`},
+		{"true", `{"type":"bool","value":true}`},
+		{"false", `{"type":"bool","value":false}`},
+		{`"a\"<b>"`, `{"type":"string","value":"a\"<b>"}`},
+		{`""`, `{"type":"string","value":""}`},
+		{"nil", `{"type":"list","value":[]}`},
+		{`app app cons 1 app app cons "x" nil`, `{"type":"list","value":[{"type":"number","value":"1"},{"type":"string","value":"x"}]}`},
+		{"app app pair 1 true", `{"type":"pair","value":[{"type":"number","value":"1"},{"type":"bool","value":true}]}`},
+		{"add", `{"type":"function","description":"<builtin add>"}`},
+		{"lam x x", `{"type":"function","description":"<lam x>"}`},
+		{"app add true", `{"type":"error","message":"add: not a number: 'true'"}`},
+	}
+	for _, tt := range tests {
+		b, err := evalString(tt.input).MarshalJSON()
+		if err != nil || string(b) != tt.json {
+			t.Errorf("%s\nwant: %s\ngot: %s (%v)", tt.input, tt.json, b, err)
+		}
+	}
+}
+
+func TestToGoNumberCopy(t *testing.T) {
+	obj := evalString("5")
+	val, _ := ToGo(obj)
+	val.(*big.Int).SetInt64(6)
+	if !obj.Equal(mknumobj(5)) || !evalString("5").Equal(mknumobj(5)) {
+		t.Errorf("modifying the result of ToGo changed the object: %v", obj)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	defer func(w io.Writer) { printOutput = w }(printOutput)
+	var buf bytes.Buffer
+	printOutput = &buf
+	tests := []struct {
+		input  string
+		val    *object
+		output string
+	}{
+		{"app print 5", mknumobj(5), "5\n"},
+		{`app print "a b"`, &object{objectString, "a b"}, "a b\n"},
+		{"app app add (app print 1) (app print 2)", mknumobj(3), "1\n2\n"},
+		{"app print app app cons true nil", mklistobj(trueObject), "(cons true nil)\n"},
+		{"app lam x 0 app print 7", mknumobj(0), "7\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		if val := evalString(tt.input); !val.Equal(tt.val) || buf.String() != tt.output {
+			t.Errorf("%s\nwant: %v, %q\ngot: %v, %q", tt.input, tt.val, tt.output, val, buf.String())
+		}
+	}
+
+	buf.Reset()
+	obj := evalString("lam x x")
+	if val := builtinPrint.val.(*funcObject).fn(obj); val != obj || buf.String() != "<lam x>\n" {
+		t.Errorf("want: %p, %q\ngot: %p, %q", obj, "<lam x>\n", val, buf.String())
+	}
+}
+
+func TestSeq(t *testing.T) {
+	defer func(w io.Writer) { printOutput = w }(printOutput)
+	var buf bytes.Buffer
+	printOutput = &buf
+	tests := []struct {
+		input  string
+		val    *object
+		output string
+	}{
+		{"seq app print 1 app print 2 app print 3", mknumobj(3), "1\n2\n3\n"},
+		{"app print 1; app print 2; 3", mknumobj(3), "1\n2\n"},
+		{"app (lam x seq app print x x) 4", mknumobj(4), "4\n"},
+		{"def f lam x (app print x; app app add x 1) seq app f 1 app f 2", mknumobj(3), "1\n2\n"},
+		// Evaluation stops at the first error.
+		{"seq app print 1 app app add true 1 app print 2",
+			errorObjectf("add: not a number: 'true'"), "1\n"},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		if val := evalString(tt.input); !val.Equal(tt.val) || buf.String() != tt.output {
+			t.Errorf("%s\nwant: %v, %q\ngot: %v, %q", tt.input, tt.val, tt.output, val, buf.String())
+		}
+	}
+}
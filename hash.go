@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+)
+
+// hashNode returns a hash of the tree rooted at n, which can be used to look up
+// subtrees in caches. Trees which are equal, i.e. which have the same structure
+// and the same literals and names, have the same hash, and different trees
+// usually have different hashes. The hash doesn't depend on where the nodes are
+// stored in memory, so it's the same from one run of the program to the next.
+//
+// The hash is structural rather than alpha-invariant: "lam x x" and "lam y y"
+// usually have different hashes even though they're the same function, since
+// parameter names are hashed like any other name. Hashing their de Bruijn forms
+// instead would make alpha-equivalent lambdas hash equally.
+func hashNode(n *node) uint64 {
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		return hashParts(n, hashNode(app.fn), hashNode(app.arg))
+	case nodeLam:
+		return hashParts(n, hashNode(n.val.(*lamNode).body))
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return hashParts(n, hashNode(when.test), hashNode(when.body))
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return hashParts(n, hashNode(seq.first), hashNode(seq.second))
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		return hashParts(n, hashNode(letrec.val), hashNode(letrec.body))
+	case nodeDef:
+		def := n.val.(*defNode)
+		if def.body == nil {
+			return hashParts(n, hashNode(def.val))
+		}
+		return hashParts(n, hashNode(def.val), hashNode(def.body))
+	default:
+		return hashParts(n)
+	}
+}
+
+// hashParts returns the hash of the node n given the hashes of its children,
+// so that hashes can be computed from the bottom of a tree up without hashing
+// any subtree twice. Only n's own type, literal value, and names are hashed;
+// its children are represented by the given hashes.
+func hashParts(n *node, children ...uint64) uint64 {
+	h := fnv.New64a()
+	var buf [binary.MaxVarintLen64]byte
+	// Variable-length parts are preceded by their length, so that e.g. a
+	// definition of "ab" with one child doesn't hash like a definition of
+	// "a" with two.
+	writeBytes := func(b []byte) {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+		h.Write(b)
+	}
+	h.Write([]byte{byte(n.typ)})
+	switch n.typ {
+	case nodeIdentifier, nodeString:
+		writeBytes([]byte(n.val.(string)))
+	case nodeNumber:
+		x := n.val.(*big.Int)
+		h.Write([]byte{byte(x.Sign() + 1)})
+		writeBytes(x.Bytes())
+	case nodeBool:
+		if n.val.(bool) {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	case nodeLam:
+		writeBytes([]byte(n.val.(*lamNode).param))
+	case nodeWhen:
+		if n.val.(*whenNode).unless {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+	case nodeLetrec:
+		writeBytes([]byte(n.val.(*letrecNode).name))
+	case nodeDef:
+		writeBytes([]byte(n.val.(*defNode).name))
+	case nodeError:
+		writeBytes([]byte(fmt.Sprint(n.val)))
+	}
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(children)))])
+	for _, c := range children {
+		binary.BigEndian.PutUint64(buf[:8], c)
+		h.Write(buf[:8])
+	}
+	return h.Sum64()
+}
+
+// An interner replaces structurally identical subtrees with shared nodes, which
+// is also known as hash consing. It keeps track of the nodes it has returned,
+// so equal subtrees of every tree passed to it end up shared, not just ones
+// within the same tree.
+type interner struct {
+	nodes map[uint64][]*node // nodes returned so far, by hash
+}
+
+// newInterner returns a new interner which hasn't shared any nodes yet.
+func newInterner() *interner {
+	return &interner{nodes: make(map[uint64][]*node)}
+}
+
+// intern returns a tree equal to the one rooted at n in which each subtree is
+// replaced by a node returned earlier for an equal subtree, if there is one,
+// along with the tree's hash (see hashNode). The given tree isn't modified.
+func (in *interner) intern(n *node) (*node, uint64) {
+	var h uint64
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		fn, fnHash := in.intern(app.fn)
+		arg, argHash := in.intern(app.arg)
+		n = &node{nodeApp, &appNode{fn, arg}}
+		h = hashParts(n, fnHash, argHash)
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		body, bodyHash := in.intern(lam.body)
+		n = &node{nodeLam, &lamNode{lam.param, body}}
+		h = hashParts(n, bodyHash)
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		test, testHash := in.intern(when.test)
+		body, bodyHash := in.intern(when.body)
+		n = &node{nodeWhen, &whenNode{test, body, when.unless}}
+		h = hashParts(n, testHash, bodyHash)
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		first, firstHash := in.intern(seq.first)
+		second, secondHash := in.intern(seq.second)
+		n = &node{nodeSeq, &seqNode{first, second}}
+		h = hashParts(n, firstHash, secondHash)
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		val, valHash := in.intern(letrec.val)
+		body, bodyHash := in.intern(letrec.body)
+		n = &node{nodeLetrec, &letrecNode{letrec.name, val, body}}
+		h = hashParts(n, valHash, bodyHash)
+	case nodeDef:
+		def := n.val.(*defNode)
+		val, valHash := in.intern(def.val)
+		if def.body == nil {
+			n = &node{nodeDef, &defNode{def.name, val, nil}}
+			h = hashParts(n, valHash)
+		} else {
+			body, bodyHash := in.intern(def.body)
+			n = &node{nodeDef, &defNode{def.name, val, body}}
+			h = hashParts(n, valHash, bodyHash)
+		}
+	default:
+		h = hashParts(n)
+	}
+	for _, m := range in.nodes[h] {
+		if sameNode(m, n) {
+			return m, h
+		}
+	}
+	in.nodes[h] = append(in.nodes[h], n)
+	return n, h
+}
+
+// sameNode returns true if a and b have the same type, literal value, and
+// names, and their children are the same nodes. It's used to compare nodes
+// whose children have already been interned.
+func sameNode(a, b *node) bool {
+	if a.typ != b.typ {
+		return false
+	}
+	switch a.typ {
+	case nodeNumber:
+		return a.val.(*big.Int).Cmp(b.val.(*big.Int)) == 0
+	case nodeApp:
+		aApp, bApp := a.val.(*appNode), b.val.(*appNode)
+		return aApp.fn == bApp.fn && aApp.arg == bApp.arg
+	case nodeLam:
+		aLam, bLam := a.val.(*lamNode), b.val.(*lamNode)
+		return aLam.param == bLam.param && aLam.body == bLam.body
+	case nodeWhen:
+		aWhen, bWhen := a.val.(*whenNode), b.val.(*whenNode)
+		return aWhen.unless == bWhen.unless && aWhen.test == bWhen.test && aWhen.body == bWhen.body
+	case nodeSeq:
+		aSeq, bSeq := a.val.(*seqNode), b.val.(*seqNode)
+		return aSeq.first == bSeq.first && aSeq.second == bSeq.second
+	case nodeLetrec:
+		aLetrec, bLetrec := a.val.(*letrecNode), b.val.(*letrecNode)
+		return aLetrec.name == bLetrec.name && aLetrec.val == bLetrec.val && aLetrec.body == bLetrec.body
+	case nodeDef:
+		aDef, bDef := a.val.(*defNode), b.val.(*defNode)
+		return aDef.name == bDef.name && aDef.val == bDef.val && aDef.body == bDef.body
+	default:
+		return a.val == b.val
+	}
+}
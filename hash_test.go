@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestHashNodeEqual(t *testing.T) {
+	// Parsing each program twice gives equal trees made of different
+	// nodes, which must have the same hash.
+	for _, pt := range parseTests {
+		a := newParser(pt.input).parse()
+		b := newParser(pt.input).parse()
+		if hashNode(a) != hashNode(b) {
+			t.Errorf("[%s]\ninput: %q\nequal trees have different hashes", pt.name, pt.input)
+		}
+	}
+	if hashNode(Num(5)) != hashNode(parseString("5")) {
+		t.Errorf("built and parsed numbers have different hashes")
+	}
+}
+
+func TestHashNodeDifferent(t *testing.T) {
+	programs := []string{
+		"x",
+		"y",
+		"xy",
+		"1",
+		"-1",
+		"0",
+		"256",
+		"true",
+		"false",
+		`"x"`,
+		`""`,
+		"app f x",
+		"app x f",
+		"app f y",
+		"app app f x y",
+		"app f app x y",
+		"lam x x",
+		"lam y y",
+		"lam x y",
+		"lam x 1",
+		"def x 1",
+		"def x 1 x",
+		"def x 1 y",
+		"def y 1 x",
+		"app lam x x 1",
+		"lam x app x 1",
+		"app add",
+		"when x y",
+		"unless x y",
+		"when y x",
+		"letrec f x y",
+		"letrec g x y",
+		"def f x y",
+	}
+	seen := make(map[uint64]string)
+	for _, p := range programs {
+		h := hashNode(parseString(p))
+		if other, ok := seen[h]; ok {
+			t.Errorf("%q and %q have the same hash: %x", p, other, h)
+		}
+		seen[h] = p
+	}
+}
+
+func TestParseStringShared(t *testing.T) {
+	for _, pt := range parseTests {
+		if root := parseStringShared(pt.input); !nodesEqual(root, pt.root) {
+			t.Errorf("[%s]\ninput: %q\nwant: %v\ngot: %v\n", pt.name, pt.input, pt.root, root)
+		}
+	}
+
+	root := parseStringShared("app app add 12345678901234567890 12345678901234567890")
+	outer := root.val.(*appNode)
+	inner := outer.fn.val.(*appNode)
+	if inner.arg != outer.arg {
+		t.Errorf("repeated number literals aren't shared")
+	}
+
+	root = parseStringShared("app (lam x app f x) (lam x app f x)")
+	if app := root.val.(*appNode); app.fn != app.arg {
+		t.Errorf("repeated lambdas aren't shared")
+	}
+
+	// The parameters differ, so the lambdas are different.
+	root = parseStringShared("app (lam x x) (lam y y)")
+	if app := root.val.(*appNode); app.fn == app.arg {
+		t.Errorf("different lambdas are shared")
+	}
+	if v := eval(parseStringShared("app app add app app add 2 2 app app add 2 2")); !v.Equal(mknumobj(8)) {
+		t.Errorf("shared tree evaluates to %v, want 8", v)
+	}
+}
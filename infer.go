@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type typeKind int
+
+// Constants indicating the kind of type stored in the typeExpr struct.
+const (
+	typeVariable typeKind = iota
+	typeNumber
+	typeBool
+	typeFunc
+	typeString
+	typeList
+	typePair
+)
+
+// A typeExpr represents a type in the type inferencer. Type variables are
+// resolved in place during unification by pointing them to another type.
+type typeExpr struct {
+	kind     typeKind
+	from, to *typeExpr // parameter and result types of a function type, or element types of a pair type
+	elem     *typeExpr // element type of a list type
+	id       int       // unique identifier of a type variable
+	instance *typeExpr // type that a type variable was unified with, if any
+}
+
+var (
+	numberType = &typeExpr{kind: typeNumber}
+	boolType   = &typeExpr{kind: typeBool}
+	stringType = &typeExpr{kind: typeString}
+)
+
+// funcType returns the type of a function that takes an argument of type from
+// and returns a value of type to.
+func funcType(from, to *typeExpr) *typeExpr {
+	return &typeExpr{kind: typeFunc, from: from, to: to}
+}
+
+// listType returns the type of a list whose elements have type elem.
+func listType(elem *typeExpr) *typeExpr {
+	return &typeExpr{kind: typeList, elem: elem}
+}
+
+// pairType returns the type of a pair whose elements have types fst and snd.
+func pairType(fst, snd *typeExpr) *typeExpr {
+	return &typeExpr{kind: typePair, from: fst, to: snd}
+}
+
+// prune returns the type that t stands for, skipping over any type variables
+// that have been unified with another type.
+func (t *typeExpr) prune() *typeExpr {
+	for t.kind == typeVariable && t.instance != nil {
+		t = t.instance
+	}
+	return t
+}
+
+// String returns the type in the usual arrow notation, e.g. "number -> bool".
+// Type variables are named a, b, c, etc. in order of appearance.
+func (t *typeExpr) String() string {
+	names := make(map[int]string)
+	var b bytes.Buffer
+	t.write(&b, names)
+	return b.String()
+}
+
+func (t *typeExpr) write(b *bytes.Buffer, names map[int]string) {
+	t = t.prune()
+	switch t.kind {
+	case typeVariable:
+		name, ok := names[t.id]
+		if !ok {
+			name = typeVariableName(len(names))
+			names[t.id] = name
+		}
+		b.WriteString(name)
+	case typeNumber:
+		b.WriteString("number")
+	case typeBool:
+		b.WriteString("bool")
+	case typeString:
+		b.WriteString("string")
+	case typeList:
+		b.WriteString("list ")
+		t.elem.writeOperand(b, names)
+	case typePair:
+		b.WriteString("pair ")
+		t.from.writeOperand(b, names)
+		b.WriteString(" ")
+		t.to.writeOperand(b, names)
+	case typeFunc:
+		if from := t.from.prune(); from.kind == typeFunc {
+			b.WriteString("(")
+			from.write(b, names)
+			b.WriteString(")")
+		} else {
+			from.write(b, names)
+		}
+		b.WriteString(" -> ")
+		t.to.write(b, names)
+	default:
+		// Shouldn't be possible
+		panic(fmt.Errorf("invalid type kind: %d", t.kind))
+	}
+}
+
+// writeOperand writes t as an operand of a list or pair type, in parentheses if
+// it's made up of several words itself.
+func (t *typeExpr) writeOperand(b *bytes.Buffer, names map[int]string) {
+	if t = t.prune(); t.kind == typeFunc || t.kind == typeList || t.kind == typePair {
+		b.WriteString("(")
+		t.write(b, names)
+		b.WriteString(")")
+	} else {
+		t.write(b, names)
+	}
+}
+
+// typeVariableName returns the name of the i-th type variable: a through z,
+// followed by a1 through z1, and so on.
+func typeVariableName(i int) string {
+	name := string(rune('a' + i%26))
+	if i >= 26 {
+		name += fmt.Sprint(i / 26)
+	}
+	return name
+}
+
+// A typeScheme is a type which is polymorphic over some of its type variables.
+// Each use of the scheme gets its own copy of those variables.
+type typeScheme struct {
+	vars []*typeExpr // generic type variables
+	t    *typeExpr
+}
+
+// A typeEnvironment maps the variables bound by enclosing lambdas and
+// definitions to their types. Like environment, it's immutable.
+type typeEnvironment struct {
+	parent *typeEnvironment
+	symbol string
+	scheme *typeScheme
+}
+
+// extend returns a new type environment containing the given symbol in
+// addition to the symbols in e.
+func (e *typeEnvironment) extend(symbol string, scheme *typeScheme) *typeEnvironment {
+	return &typeEnvironment{parent: e, symbol: symbol, scheme: scheme}
+}
+
+// lookup returns the scheme associated with a symbol, or nil if the symbol
+// isn't found.
+func (e *typeEnvironment) lookup(symbol string) *typeScheme {
+	for cur := e; cur != nil; cur = cur.parent {
+		if symbol == cur.symbol {
+			return cur.scheme
+		}
+	}
+	return nil
+}
+
+// builtinTypes contains the type of each built-in function. Each call creates a
+// fresh copy of the type's variables using the given inferrer.
+var builtinTypes = map[*object]func(i *inferrer) *typeExpr{
+	builtinAdd: numberOperatorType,
+	builtinIf: func(i *inferrer) *typeExpr {
+		a := i.newVariable()
+		return funcType(boolType, funcType(a, funcType(a, a)))
+	},
+	builtinGt:     numberComparisonType,
+	builtinGte:    numberComparisonType,
+	builtinLte:    numberComparisonType,
+	builtinBand:   numberOperatorType,
+	builtinBor:    numberOperatorType,
+	builtinBxor:   numberOperatorType,
+	builtinShl:    numberOperatorType,
+	builtinShr:    numberOperatorType,
+	builtinCmp:    numberOperatorType,
+	builtinMin:    numberOperatorType,
+	builtinMax:    numberOperatorType,
+	builtinPow:    numberOperatorType,
+	builtinIsnum:  predicateType,
+	builtinIsbool: predicateType,
+	builtinTypeof: func(i *inferrer) *typeExpr {
+		return funcType(i.newVariable(), numberType)
+	},
+	builtinIsqrt: func(i *inferrer) *typeExpr {
+		return funcType(numberType, numberType)
+	},
+	builtinNeg: func(i *inferrer) *typeExpr {
+		return funcType(numberType, numberType)
+	},
+	builtinFact: func(i *inferrer) *typeExpr {
+		return funcType(numberType, numberType)
+	},
+	builtinConcat: func(i *inferrer) *typeExpr {
+		return funcType(stringType, funcType(stringType, stringType))
+	},
+	builtinStrlen: func(i *inferrer) *typeExpr {
+		return funcType(stringType, numberType)
+	},
+	nilObject: func(i *inferrer) *typeExpr {
+		return listType(i.newVariable())
+	},
+	builtinCons: func(i *inferrer) *typeExpr {
+		a := i.newVariable()
+		return funcType(a, funcType(listType(a), listType(a)))
+	},
+	builtinHead: func(i *inferrer) *typeExpr {
+		a := i.newVariable()
+		return funcType(listType(a), a)
+	},
+	builtinTail: func(i *inferrer) *typeExpr {
+		a := i.newVariable()
+		return funcType(listType(a), listType(a))
+	},
+	builtinIsnil: func(i *inferrer) *typeExpr {
+		return funcType(listType(i.newVariable()), boolType)
+	},
+	builtinPrint: func(i *inferrer) *typeExpr {
+		a := i.newVariable()
+		return funcType(a, a)
+	},
+	builtinID: func(i *inferrer) *typeExpr {
+		a := i.newVariable()
+		return funcType(a, a)
+	},
+	builtinConst: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(a, funcType(b, a))
+	},
+	builtinCompose: func(i *inferrer) *typeExpr {
+		a, b, c := i.newVariable(), i.newVariable(), i.newVariable()
+		return funcType(funcType(b, c), funcType(funcType(a, b), funcType(a, c)))
+	},
+	builtinApply: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(funcType(a, b), funcType(a, b))
+	},
+	builtinCurry: func(i *inferrer) *typeExpr {
+		a, b, c := i.newVariable(), i.newVariable(), i.newVariable()
+		return funcType(funcType(pairType(a, b), c), funcType(a, funcType(b, c)))
+	},
+	builtinUncurry: func(i *inferrer) *typeExpr {
+		a, b, c := i.newVariable(), i.newVariable(), i.newVariable()
+		return funcType(funcType(a, funcType(b, c)), funcType(pairType(a, b), c))
+	},
+	builtinFold: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(funcType(a, funcType(b, b)), funcType(b, funcType(listType(a), b)))
+	},
+	builtinMap: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(funcType(a, b), funcType(listType(a), listType(b)))
+	},
+	builtinPair: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(a, funcType(b, pairType(a, b)))
+	},
+	builtinFst: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(pairType(a, b), a)
+	},
+	builtinSnd: func(i *inferrer) *typeExpr {
+		a, b := i.newVariable(), i.newVariable()
+		return funcType(pairType(a, b), b)
+	},
+}
+
+// numberOperatorType returns the type of a function taking two numbers and
+// returning a number.
+func numberOperatorType(i *inferrer) *typeExpr {
+	return funcType(numberType, funcType(numberType, numberType))
+}
+
+// numberComparisonType returns the type of a function taking two numbers and
+// returning a bool.
+func numberComparisonType(i *inferrer) *typeExpr {
+	return funcType(numberType, funcType(numberType, boolType))
+}
+
+// predicateType returns the type of a function taking any value and returning a
+// bool.
+func predicateType(i *inferrer) *typeExpr {
+	return funcType(i.newVariable(), boolType)
+}
+
+// inferrer contains the type inferrer's state.
+type inferrer struct {
+	nextID   int                        // identifier of the next type variable
+	closures map[*lamObject]*typeExpr   // types of the closures being inferred
+	types    map[*lamObject]*typeScheme // types of the closures inferred so far
+}
+
+// newVariable returns a new type variable.
+func (i *inferrer) newVariable() *typeExpr {
+	i.nextID++
+	return &typeExpr{kind: typeVariable, id: i.nextID}
+}
+
+// occurs returns true if the type variable v occurs in t.
+func occurs(v, t *typeExpr) bool {
+	t = t.prune()
+	switch {
+	case t == v:
+		return true
+	case t.kind == typeFunc || t.kind == typePair:
+		return occurs(v, t.from) || occurs(v, t.to)
+	case t.kind == typeList:
+		return occurs(v, t.elem)
+	default:
+		return false
+	}
+}
+
+// unify makes types a and b equal by binding type variables, or returns an
+// error if that's not possible.
+func unify(a, b *typeExpr) error {
+	a, b = a.prune(), b.prune()
+	switch {
+	case a == b:
+		return nil
+	case a.kind == typeVariable:
+		if occurs(a, b) {
+			return fmt.Errorf("infinite type: %s = %s", a, b)
+		}
+		a.instance = b
+		return nil
+	case b.kind == typeVariable:
+		return unify(b, a)
+	case a.kind == typeFunc && b.kind == typeFunc, a.kind == typePair && b.kind == typePair:
+		if err := unify(a.from, b.from); err != nil {
+			return err
+		}
+		return unify(a.to, b.to)
+	case a.kind == typeList && b.kind == typeList:
+		return unify(a.elem, b.elem)
+	case a.kind == b.kind:
+		return nil
+	default:
+		return fmt.Errorf("type mismatch: %s and %s", a, b)
+	}
+}
+
+// instantiate returns a copy of the scheme's type with fresh type variables in
+// place of the generic ones.
+func (i *inferrer) instantiate(s *typeScheme) *typeExpr {
+	if len(s.vars) == 0 {
+		return s.t
+	}
+	fresh := make(map[*typeExpr]*typeExpr)
+	for _, v := range s.vars {
+		fresh[v] = i.newVariable()
+	}
+	var cp func(t *typeExpr) *typeExpr
+	cp = func(t *typeExpr) *typeExpr {
+		t = t.prune()
+		switch t.kind {
+		case typeVariable:
+			if v, ok := fresh[t]; ok {
+				return v
+			}
+		case typeFunc:
+			return funcType(cp(t.from), cp(t.to))
+		case typeList:
+			return listType(cp(t.elem))
+		case typePair:
+			return pairType(cp(t.from), cp(t.to))
+		}
+		return t
+	}
+	return cp(s.t)
+}
+
+// freeVariables appends the unbound type variables in t to vars.
+func freeVariables(t *typeExpr, vars []*typeExpr) []*typeExpr {
+	t = t.prune()
+	switch t.kind {
+	case typeVariable:
+		for _, v := range vars {
+			if v == t {
+				return vars
+			}
+		}
+		return append(vars, t)
+	case typeFunc, typePair:
+		return freeVariables(t.to, freeVariables(t.from, vars))
+	case typeList:
+		return freeVariables(t.elem, vars)
+	default:
+		return vars
+	}
+}
+
+// generalize returns a scheme which is polymorphic over the type variables in t
+// that aren't used in the type environment.
+func generalize(t *typeExpr, tenv *typeEnvironment) *typeScheme {
+	var envVars []*typeExpr
+	for cur := tenv; cur != nil; cur = cur.parent {
+		envVars = freeVariables(cur.scheme.t, envVars)
+	}
+	s := &typeScheme{t: t}
+outer:
+	for _, v := range freeVariables(t, nil) {
+		for _, ev := range envVars {
+			if v == ev {
+				continue outer
+			}
+		}
+		s.vars = append(s.vars, v)
+	}
+	return s
+}
+
+// typeOfObject returns the type of a runtime object, which is how identifiers
+// that aren't bound within the expression being inferred get their types. A
+// closure which refers to itself, such as one defined with letrec, has the
+// same type wherever it appears within its own body. Otherwise, a closure's
+// type is generalized, and only inferred once. A partly applied built-in
+// function's type comes from the builtin's type and the arguments applied.
+func (i *inferrer) typeOfObject(name string, obj *object) (*typeExpr, error) {
+	switch obj.typ {
+	case objectNumber:
+		return numberType, nil
+	case objectBool:
+		return boolType, nil
+	case objectString:
+		return stringType, nil
+	case objectLam:
+		lam := obj.val.(*lamObject)
+		if s, ok := i.types[lam]; ok {
+			return i.instantiate(s), nil
+		}
+		if t, ok := i.closures[lam]; ok {
+			return t, nil
+		}
+		if i.closures == nil {
+			i.closures = make(map[*lamObject]*typeExpr)
+			i.types = make(map[*lamObject]*typeScheme)
+		}
+		v := i.newVariable()
+		i.closures[lam] = v
+		t, err := i.infer(&node{nodeLam, lam.node}, nil, lam.env)
+		delete(i.closures, lam)
+		if err != nil {
+			return nil, err
+		}
+		if err := unify(v, t); err != nil {
+			return nil, err
+		}
+		// The type can only be generalized if it doesn't depend on the
+		// types of the closures that are still being inferred.
+		var outer *typeEnvironment
+		for _, c := range i.closures {
+			outer = outer.extend("", &typeScheme{t: c})
+		}
+		s := generalize(t, outer)
+		if len(s.vars) < len(freeVariables(t, nil)) {
+			return t, nil
+		}
+		i.types[lam] = s
+		return i.instantiate(s), nil
+	case objectFunc:
+		f := obj.val.(*funcObject)
+		if f.appliedTo == nil {
+			break
+		}
+		fn, err := i.typeOfObject(name, f.appliedTo)
+		if err != nil {
+			return nil, err
+		}
+		arg, err := i.typeOfObject(name, f.arg)
+		if err != nil {
+			return nil, err
+		}
+		result := i.newVariable()
+		if err := unify(fn, funcType(arg, result)); err != nil {
+			return nil, err
+		}
+		return result, nil
+	case objectList:
+		elem := i.newVariable()
+		for cell := obj.val.(*consCell); cell != nil; cell = cell.tail.val.(*consCell) {
+			t, err := i.typeOfObject(name, cell.head)
+			if err != nil {
+				return nil, err
+			}
+			if err := unify(elem, t); err != nil {
+				return nil, err
+			}
+		}
+		return listType(elem), nil
+	case objectPair:
+		p := obj.val.(*pairValue)
+		fst, err := i.typeOfObject(name, p.fst)
+		if err != nil {
+			return nil, err
+		}
+		snd, err := i.typeOfObject(name, p.snd)
+		if err != nil {
+			return nil, err
+		}
+		return pairType(fst, snd), nil
+	}
+	if fn, ok := builtinTypes[obj]; ok {
+		return fn(i), nil
+	}
+	if obj.typ == objectError {
+		return nil, fmt.Errorf("%s", obj)
+	}
+	return nil, fmt.Errorf("unknown type: '%s'", name)
+}
+
+// infer returns the type of a node. Identifiers are looked up in tenv first,
+// which contains the variables bound within the expression, and then in env.
+func (i *inferrer) infer(n *node, tenv *typeEnvironment, env *environment) (*typeExpr, error) {
+	switch n.typ {
+	case nodeNumber:
+		return numberType, nil
+	case nodeBool:
+		return boolType, nil
+	case nodeString:
+		return stringType, nil
+	case nodeIdentifier:
+		name := n.val.(string)
+		if s := tenv.lookup(name); s != nil {
+			return i.instantiate(s), nil
+		}
+		return i.typeOfObject(name, env.lookup(name))
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		param := i.newVariable()
+		body, err := i.infer(lam.body, tenv.extend(lam.param, &typeScheme{t: param}), env)
+		if err != nil {
+			return nil, err
+		}
+		return funcType(param, body), nil
+	case nodeWhen:
+		// The value is nil when the body isn't evaluated, so the body
+		// must be a list as well.
+		when := n.val.(*whenNode)
+		test, err := i.infer(when.test, tenv, env)
+		if err != nil {
+			return nil, err
+		}
+		if err := unify(test, boolType); err != nil {
+			return nil, err
+		}
+		body, err := i.infer(when.body, tenv, env)
+		if err != nil {
+			return nil, err
+		}
+		if err := unify(body, listType(i.newVariable())); err != nil {
+			return nil, err
+		}
+		return body, nil
+	case nodeSeq:
+		// The first value is thrown away, so it can have any type.
+		seq := n.val.(*seqNode)
+		if _, err := i.infer(seq.first, tenv, env); err != nil {
+			return nil, err
+		}
+		return i.infer(seq.second, tenv, env)
+	case nodeLetrec:
+		// Within its own value, the name has a single type, which is
+		// only generalized for the body.
+		letrec := n.val.(*letrecNode)
+		self := i.newVariable()
+		val, err := i.infer(letrec.val, tenv.extend(letrec.name, &typeScheme{t: self}), env)
+		if err != nil {
+			return nil, err
+		}
+		if err := unify(self, val); err != nil {
+			return nil, err
+		}
+		return i.infer(letrec.body, tenv.extend(letrec.name, generalize(val, tenv)), env)
+	case nodeApp:
+		app := n.val.(*appNode)
+		fn, err := i.infer(app.fn, tenv, env)
+		if err != nil {
+			return nil, err
+		}
+		arg, err := i.infer(app.arg, tenv, env)
+		if err != nil {
+			return nil, err
+		}
+		result := i.newVariable()
+		if err := unify(fn, funcType(arg, result)); err != nil {
+			return nil, err
+		}
+		return result, nil
+	case nodeDef:
+		def := n.val.(*defNode)
+		val, err := i.infer(def.val, tenv, env)
+		if err != nil || def.body == nil {
+			return val, err
+		}
+		return i.infer(def.body, tenv.extend(def.name, generalize(val, tenv)), env)
+	case nodeError:
+		return nil, n.val.(error)
+	default:
+		// Shouldn't be possible
+		panic(fmt.Errorf("invalid node: %s", n.typ))
+	}
+}
+
+// inferType returns the type of a node, with identifiers that aren't bound
+// within the node resolved using env.
+func inferType(n *node, env *environment) (*typeExpr, error) {
+	return new(inferrer).infer(n, nil, env)
+}
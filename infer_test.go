@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+type inferTest struct {
+	name  string
+	input string
+	typ   string // expected type, or error message if the inference fails
+}
+
+var inferTests = []inferTest{
+	{"number", "3", "number"},
+	{"bool", "true", "bool"},
+	{"string", `"hi"`, "string"},
+	{"add", "add", "number -> number -> number"},
+	{"gt", "gt", "number -> number -> bool"},
+	{"gte", "app gte 1", "number -> bool"},
+	{"lte", "app app lte 1 2", "bool"},
+	{"if", "if", "bool -> a -> a -> a"},
+	{"partial application", "app add 1", "number -> number"},
+	{"identity", "lam x x", "a -> a"},
+	{"const", "lam x lam y x", "a -> b -> a"},
+	{"higher-order", "lam f lam x app f app f x", "(a -> a) -> a -> a"},
+	{"compose", "lam f lam g lam x app f app g x", "(a -> b) -> (c -> a) -> c -> b"},
+	{"if branches", "lam x app app app if x 1 2", "bool -> number"},
+	{"polymorphic def", "def id lam x x app app id add app id 1", "number -> number"},
+	{"ill-typed application", "app add true", "type mismatch: number and bool"},
+	{"if branch mismatch", "app app app if true 1 false", "type mismatch: number and bool"},
+	{"applying a number", "app 1 2", "type mismatch: number and number -> a"},
+	{"self-application", "lam x app x x", "infinite type: a = a -> b"},
+	{"monomorphic parameter", "lam f app app add (app f 1) (app f true)",
+		"type mismatch: number and bool"},
+	{"unknown identifier", "x", "unknown identifier: 'x'"},
+	{"nil", "nil", "list a"},
+	{"cons", "cons", "a -> list a -> list a"},
+	{"list", "app app cons 1 nil", "list number"},
+	{"list of functions", "app app cons add nil", "list (number -> number -> number)"},
+	{"head", "lam l app add app head l", "list number -> number -> number"},
+	{"tail", "app tail app app cons true nil", "list bool"},
+	{"isnil", "isnil", "list a -> bool"},
+	{"print", "app app add (app print 1) 2", "number"},
+	{"id", "id", "a -> a"},
+	{"const", "const", "a -> b -> a"},
+	{"compose", "compose", "(a -> b) -> (c -> a) -> c -> b"},
+	{"composition", "app app compose isqrt strlen", "string -> number"},
+	{"neg", "app neg 1", "number"},
+	{"min", "min", "number -> number -> number"},
+	{"max", "app max 1", "number -> number"},
+	{"pow", "lam n app app pow 2 n", "number -> number"},
+	{"fact", "fact", "number -> number"},
+	{"apply", "apply", "(a -> b) -> a -> b"},
+	{"apply non-function", "app apply 1", "type mismatch: a -> b and number"},
+	{"curry", "curry", "(pair a b -> c) -> a -> b -> c"},
+	{"uncurry", "app uncurry add", "pair number number -> number"},
+	{"pair", "app pair 1", "a -> pair number a"},
+	{"fst", "lam p app app add app fst p app snd p", "pair number number -> number"},
+	{"nested pair", "lam p app fst app snd p", "pair a (pair b c) -> b"},
+	{"pair of lists", "app app pair nil lam x x", "pair (list a) (b -> b)"},
+	{"fold", "fold", "(a -> b -> b) -> b -> list a -> b"},
+	{"fold sum", "app app fold add 0", "list number -> number"},
+	{"map", "map", "(a -> b) -> list a -> list b"},
+	{"map isnil", "app map isnil", "list (list a) -> list bool"},
+	{"heterogeneous list", "app app cons 1 app app cons true nil", "type mismatch: number and bool"},
+	{"when", "lam x when app isnil x app tail x", "list a -> list a"},
+	{"unless", "unless true nil", "list a"},
+	{"when with non-bool test", "when 1 nil", "type mismatch: number and bool"},
+	{"when with non-list body", "when true 1", "type mismatch: number and list a"},
+	{"letrec", "letrec f lam n app app app if app app gt n 0 app f app app add n -1 0 f", "number -> number"},
+	{"letrec polymorphic body", "letrec i lam x x app app cons app i 1 app app cons app i 2 nil", "list number"},
+	{"letrec generalized", "letrec i lam x x app i i", "a -> a"},
+}
+
+func TestInfer(t *testing.T) {
+	for _, it := range inferTests {
+		var got string
+		typ, err := inferType(parseString(it.input), defaultEnvironment)
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = typ.String()
+		}
+		if got != it.typ {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", it.name, it.input, it.typ, got)
+		}
+	}
+}
+
+func TestInferDefinitionChain(t *testing.T) {
+	// Each definition refers to the one before it twice, so its type has to
+	// be inferred once rather than every time it's referred to.
+	s := newSession(defaultEnvironment)
+	s.eval(parseString("def f0 lam x x"))
+	for i := 1; i <= 40; i++ {
+		s.eval(parseString(fmt.Sprintf("def f%d lam x app f%d app f%d x", i, i-1, i-1)))
+	}
+	typ, err := inferType(parseString("f40"), s.env)
+	if err != nil || typ.String() != "a -> a" {
+		t.Errorf("want: %q\ngot: %v (%v)", "a -> a", typ, err)
+	}
+}
+
+func TestInferSessionDefinitions(t *testing.T) {
+	s := newSession(defaultEnvironment)
+	s.eval(parseString("def x 1 def double lam y app app add y y def k app (lam a lam b a) x def l app app cons 1 app app cons 2 nil def inc app add 1 def f app app compose neg inc"))
+	env := s.env
+	tests := []inferTest{
+		{"number definition", "x", "number"},
+		{"lam definition", "double", "number -> number"},
+		{"closure", "k", "a -> number"},
+		{"list definition", "l", "list number"},
+		{"partly applied builtin", "inc", "number -> number"},
+		{"builtin applied to partly applied builtin", "f", "number -> number"},
+		{"shadowing definition", "lam x x", "a -> a"},
+		{"ill-typed use", "app double true", "type mismatch: number and bool"},
+	}
+	for _, it := range tests {
+		var got string
+		typ, err := inferType(parseString(it.input), env)
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = typ.String()
+		}
+		if got != it.typ {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", it.name, it.input, it.typ, got)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -17,6 +20,10 @@ const (
 	tokenIdentifier
 	tokenLeftParen
 	tokenRightParen
+	tokenString
+	tokenBackslash
+	tokenDot
+	tokenSemicolon
 )
 
 func (t tokenType) String() string {
@@ -35,6 +42,14 @@ func (t tokenType) String() string {
 		return "'('"
 	case tokenRightParen:
 		return "')'"
+	case tokenString:
+		return "string"
+	case tokenBackslash:
+		return "'\\'"
+	case tokenDot:
+		return "'.'"
+	case tokenSemicolon:
+		return "';'"
 	default:
 		// shouldn't be possible
 		panic(fmt.Errorf("invalid token type: %d", t))
@@ -45,6 +60,11 @@ func (t tokenType) String() string {
 type token struct {
 	typ tokenType
 	val string
+	pos int // byte offset of the start of the token in the input
+
+	// For error tokens, whether the error was caused by the input ending in
+	// the middle of the token, so that more input could fix it
+	atEOF bool
 }
 
 func (t token) String() string {
@@ -57,56 +77,151 @@ func (t token) String() string {
 // errorTokenf formats according to a format specifier (see fmt) and returns the
 // resulting string as an error token.
 func errorTokenf(format string, args ...interface{}) token {
-	return token{tokenError, fmt.Sprintf(format, args...)}
+	return token{typ: tokenError, val: fmt.Sprintf(format, args...)}
 }
 
-// lexer contains the lexer's execution state.
+// lexer contains the lexer's execution state. The input is read from an
+// io.RuneReader as it's needed, and only the current line is kept in memory,
+// which is enough to return the values of tokens and to describe the positions
+// of errors. Positions are byte offsets from the start of the input.
 type lexer struct {
-	input string
-	pos   int // current position in input
-	start int // start of current token in input
-	width int
+	r        io.RuneReader
+	err      error  // error from r, if any, other than io.EOF
+	buf      []byte // input read so far, starting at the current line
+	bufStart int    // position of buf[0] in the input
+	lines    int    // number of lines before bufStart
+
+	pos     int // current position in input
+	start   int // start of current token in input
+	lastPos int // position before the last call to next()
 }
 
 // newLexer creates a new lexer for the given input string.
 func newLexer(input string) *lexer {
-	return &lexer{
-		input: input,
-	}
+	return newReaderLexer(strings.NewReader(input))
+}
+
+// newReaderLexer creates a new lexer which reads its input from r.
+func newReaderLexer(r io.RuneReader) *lexer {
+	return &lexer{r: r}
 }
 
 var eof = rune(-1)
 
 // next returns the next rune in the input.
 func (l *lexer) next() rune {
-	if l.pos >= len(l.input) {
-		l.width = 0
+	l.lastPos = l.pos
+	if l.pos == l.bufStart+len(l.buf) && !l.read() {
 		return eof
 	}
-	ch, width := utf8.DecodeRuneInString(l.input[l.pos:])
+	ch, width := utf8.DecodeRune(l.buf[l.pos-l.bufStart:])
 	l.pos += width
-	l.width = width
 	return ch
 }
 
-// unnext steps back one rune. Only one rune is tracked, so this function can be
-// called only once for each call of next(). More than one call will result in
-// undefined behavior.
+// read reads the next rune from r into buf. It returns false if there isn't
+// one, either because the input has ended or because r failed.
+//
+// Since a RuneReader doesn't return the bytes of an invalid UTF-8 sequence, each
+// byte of one is stored as 0xff, which is also invalid. That way, buf stays the
+// same length as the input, so positions still line up with it.
+func (l *lexer) read() bool {
+	if l.err != nil {
+		return false
+	}
+	ch, width, err := l.r.ReadRune()
+	if err != nil {
+		if err != io.EOF {
+			l.err = err
+		}
+		return false
+	}
+	if ch == utf8.RuneError && width == 1 {
+		l.buf = append(l.buf, 0xff)
+	} else {
+		var enc [utf8.UTFMax]byte
+		l.buf = append(l.buf, enc[:utf8.EncodeRune(enc[:], ch)]...)
+	}
+	return true
+}
+
+// unnext steps back to the position before the last call to next(). Only one
+// position is tracked, so calling unnext() again before the next call to next()
+// has no further effect. If the last call to next() returned eof, unnext()
+// doesn't move the position at all.
 func (l *lexer) unnext() {
-	l.pos -= l.width
+	l.pos = l.lastPos
 }
 
 // val returns a string containing all of the runes accumulated so far.
 func (l *lexer) val() string {
-	return l.input[l.start:l.pos]
+	return string(l.buf[l.start-l.bufStart : l.pos-l.bufStart])
 }
 
 // emit returns a token with the given type which contains all of the runes
 // accumulated so far. It also sets the lexer's current position to the next token.
 func (l *lexer) emit(typ tokenType) token {
-	val := l.val()
+	t := token{typ: typ, val: l.val(), pos: l.start}
+	l.setStart()
+	return t
+}
+
+// setStart starts a new token at the current position. Lines of input before
+// the line it's on are discarded.
+func (l *lexer) setStart() {
+	// buf starts at the beginning of the line containing the previous
+	// start, so only the runes since then can contain a newline.
+	skipped := l.buf[l.start-l.bufStart : l.pos-l.bufStart]
+	if i := bytes.LastIndexByte(skipped, '\n'); i >= 0 {
+		l.lines += bytes.Count(skipped[:i+1], []byte("\n"))
+		n := l.start - l.bufStart + i + 1
+		l.buf = l.buf[n:]
+		l.bufStart += n
+	}
 	l.start = l.pos
-	return token{typ, val}
+}
+
+// contextWidth is the maximum number of bytes of input shown on either side of
+// an error's position by errorContext.
+const contextWidth = 20
+
+// errorContext returns a description of the given byte offset in the input: its
+// line and column (both starting at 1, with columns counted in runes) and the
+// surrounding part of the line, for use in error messages. The offset must be
+// on the current line. The rest of the line is read if it's needed.
+func (l *lexer) errorContext(offset int) string {
+	offset -= l.bufStart
+	for bytes.IndexByte(l.buf[offset:], '\n') < 0 && len(l.buf)-offset <= contextWidth+utf8.UTFMax && l.read() {
+	}
+	buf := l.buf
+	lineStart := bytes.LastIndexByte(buf[:offset], '\n') + 1
+	lineEnd := bytes.IndexByte(buf[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(buf)
+	} else {
+		lineEnd += offset
+	}
+	line := 1 + l.lines + bytes.Count(buf[:lineStart], []byte("\n"))
+	col := 1 + utf8.RuneCount(buf[lineStart:offset])
+
+	start, end := lineStart, lineEnd
+	prefix, suffix := "", ""
+	if offset-start > contextWidth {
+		start = offset - contextWidth
+		for start < offset && !utf8.RuneStart(buf[start]) {
+			start++
+		}
+		prefix = "..."
+	}
+	if end-offset > contextWidth {
+		end = offset + contextWidth
+		for end < lineEnd && !utf8.RuneStart(buf[end]) {
+			end++
+		}
+		suffix = "..."
+	}
+	snippet := strings.TrimSpace(string(buf[start:end]))
+	return fmt.Sprintf("line %d, column %d, near '%s%s%s'", line, col, prefix, snippet, suffix)
 }
 
 // skipSpaces advances the lexer's current position to the first non-space rune.
@@ -114,7 +229,7 @@ func (l *lexer) skipSpaces() {
 	for isSpace(l.next()) {
 	}
 	l.unnext()
-	l.start = l.pos
+	l.setStart()
 }
 
 // lexNumber scans a number and returns either a number token or an error token.
@@ -124,17 +239,19 @@ func (l *lexer) skipSpaces() {
 //   digits  = digit, { digit } ;
 //   number  = "-", digits | digits ;
 //
+// A minus sign must be followed immediately by a digit, so "- 5" is an error
+// rather than -5, and so is a minus sign on its own.
+//
 // Precondition: The next character is either a minus sign or a digit.
 func (l *lexer) lexNumber() token {
 	ch := l.next()
 	if ch == '-' {
-		ch = l.next()
-	}
-	if !isDigit(ch) {
-		if isBoundary(ch) {
-			l.unnext()
+		if ch = l.next(); !isDigit(ch) {
+			if isBoundary(ch) {
+				l.unnext()
+			}
+			return errorTokenf("minus sign without digits at %s", l.errorContext(l.start))
 		}
-		return errorTokenf("bad number syntax: '%s'", l.val())
 	}
 	for {
 		ch = l.next()
@@ -153,17 +270,16 @@ func (l *lexer) lexNumber() token {
 // bool token (special case of identifier), or an error token.
 //
 // Grammar:
-//   ident = letter, { letter | digit }
+//   ident = letter, { letter | digit } | "_" ;
 //   bool  = "true" | "false" ;
 //
-// Precondition: The first character is a letter that has already been consumed.
+// Precondition: The first character is a letter or an underscore that has
+// already been consumed.
 func (l *lexer) lexIdentifier() token {
-	var ch rune
-	for {
+	// An underscore can't be followed by anything else.
+	ch := l.next()
+	for l.buf[l.start-l.bufStart] != '_' && (isDigit(ch) || isLetter(ch)) {
 		ch = l.next()
-		if !isDigit(ch) && !isLetter(ch) {
-			break
-		}
 	}
 	if !isBoundary(ch) {
 		return errorTokenf("bad identifier syntax: '%s'", l.val())
@@ -178,28 +294,148 @@ func (l *lexer) lexIdentifier() token {
 	return l.emit(typ)
 }
 
+// lexString scans a string literal and returns either a string token or an
+// error token. The value of the string token is the literal as it appears in
+// the input, including the quotes and escape sequences (see unquote).
+//
+// Grammar:
+//   string = '"', { char | escape }, '"' ;
+//   escape = "\", ( '"' | "\" | "n" ) ;
+//
+// Precondition: The opening quote has already been consumed.
+func (l *lexer) lexString() token {
+	for {
+		switch l.next() {
+		case '"':
+			if ch := l.next(); !isBoundary(ch) {
+				return errorTokenf("bad string syntax: '%s'", l.val())
+			}
+			l.unnext()
+			return l.emit(tokenString)
+		case '\\':
+			switch l.next() {
+			case '"', '\\', 'n':
+			case eof:
+				tok := errorTokenf("unterminated string: '%s'", l.val())
+				tok.atEOF = true
+				return tok
+			default:
+				return errorTokenf("bad escape sequence in string: '%s'", l.val())
+			}
+		case eof:
+			tok := errorTokenf("unterminated string: '%s'", l.val())
+			tok.atEOF = true
+			return tok
+		}
+	}
+}
+
+// unquote returns the contents of a string literal with its escape sequences
+// replaced by the characters they represent.
+//
+// Precondition: s is the value of a string token.
+func unquote(s string) string {
+	var b bytes.Buffer
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			if s[i] == 'n' {
+				b.WriteByte('\n')
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// quote returns a string literal which represents s. It's the inverse of
+// unquote.
+func quote(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		case '\n':
+			b.WriteString("\\n")
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// nextToken returns the next token in the input, skipping any spaces before it.
+// Error tokens are given the position of the start of the token that couldn't
+// be lexed, like any other token.
 func (l *lexer) nextToken() token {
 	l.skipSpaces()
+	tok := l.lexToken()
+	if l.err != nil {
+		tok = errorTokenf("read error: %s", l.err)
+	}
+	if tok.typ == tokenError {
+		tok.pos = l.start
+	}
+	return tok
+}
 
+// lexToken scans the token starting at the current position.
+func (l *lexer) lexToken() token {
 	switch ch := l.next(); {
 	case ch == '-' || isDigit(ch):
 		l.unnext()
 		return l.lexNumber()
-	case isLetter(ch):
+	case isLetter(ch) || ch == '_':
 		return l.lexIdentifier()
 	case ch == '(':
 		return l.emit(tokenLeftParen)
 	case ch == ')':
 		return l.emit(tokenRightParen)
+	case ch == '"':
+		return l.lexString()
+	case ch == '\\':
+		return l.emit(tokenBackslash)
+	case ch == '.':
+		return l.emit(tokenDot)
+	case ch == ';':
+		return l.emit(tokenSemicolon)
 	case ch == eof:
 		return l.emit(tokenEOF)
 	default:
-		return errorTokenf("illegal character: '%c'", ch)
+		return errorTokenf("illegal character: '%c' at %s", ch, l.errorContext(l.lastPos))
+	}
+}
+
+// dumpTokens runs the lexer over the input and writes each token to w, one per
+// line, up to and including the EOF or error token. It returns false if the
+// lexer encountered an error.
+func dumpTokens(w io.Writer, input string) bool {
+	l := newLexer(input)
+	for {
+		t := l.nextToken()
+		fmt.Fprintln(w, t)
+		switch t.typ {
+		case tokenEOF:
+			return true
+		case tokenError:
+			return false
+		}
 	}
 }
 
+// isSpace returns true if r is white space as defined by Unicode, which includes
+// tabs, vertical tabs, form feeds, and no-break spaces as well as spaces and
+// line breaks. Only '\n' starts a new line when counting lines (see
+// errorContext), so a Windows line break, "\r\n", counts once, and a lone '\r'
+// doesn't count at all.
 func isSpace(r rune) bool {
-	return strings.ContainsRune(" \t\r\n", r)
+	return unicode.IsSpace(r)
 }
 
 func isLetter(r rune) bool {
@@ -211,7 +447,11 @@ func isDigit(r rune) bool {
 }
 
 // isBoundary returns true if the given rune terminates a run of letters or
-// digits. It's analogous to '\b' in regular expressions.
+// digits. It's analogous to '\b' in regular expressions. Parentheses are
+// boundaries so that they can be written next to other tokens, e.g. "app(f)2",
+// and so is the dot which can follow the parameter of a lambda written with a
+// backslash, e.g. "\x. x", and the semicolon which separates the expressions in
+// a sequence, e.g. "app print 1; 2".
 func isBoundary(r rune) bool {
-	return isSpace(r) || r == ')' || r == eof
+	return isSpace(r) || r == '(' || r == ')' || r == '.' || r == ';' || r == eof
 }
@@ -0,0 +1,27 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "testing"
+
+func FuzzLex(f *testing.F) {
+	for _, lt := range lexTests {
+		f.Add(lt.input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		l := newLexer(input)
+		// Every token other than EOF consumes at least one byte, so
+		// the lexer must finish within this many tokens.
+		for i := 0; i <= len(input); i++ {
+			tok := l.nextToken()
+			if l.pos < 0 || l.pos > len(input) {
+				t.Fatalf("input: %q\nposition %d out of range after %v", input, l.pos, tok)
+			}
+			if tok.typ == tokenEOF || tok.typ == tokenError {
+				return
+			}
+		}
+		t.Fatalf("input: %q\nlexer didn't terminate", input)
+	})
+}
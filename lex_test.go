@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func mktok(typ tokenType, val string) token {
-	return token{typ, val}
+	return token{typ: typ, val: val}
 }
 
 var (
@@ -37,7 +44,13 @@ var lexTests = []lexTest{
 	{"spaces", " \t\r\n", []token{eofTok}},
 	{"number", "3", []token{threeTok, eofTok}},
 	{"negative number", "-5", []token{minusFiveTok, eofTok}},
-	{"minus sign without number", "-", []token{errorTokenf("bad number syntax: '-'")}},
+	{"zero", "0", []token{mktok(tokenNumber, "0"), eofTok}},
+	{"negative zero", "-0", []token{mktok(tokenNumber, "-0"), eofTok}},
+	{"leading zeros", "007", []token{mktok(tokenNumber, "007"), eofTok}},
+	{"minus sign without number", "-", []token{errorTokenf("minus sign without digits at line 1, column 1, near '-'")}},
+	{"minus sign before space", "- 5", []token{errorTokenf("minus sign without digits at line 1, column 1, near '- 5'")}},
+	{"minus sign before letter", "app f -x", []token{appTok, mktok(tokenIdentifier, "f"),
+		errorTokenf("minus sign without digits at line 1, column 7, near 'app f -x'")}},
 	{"naked bool", "true", []token{trueTok, eofTok}},
 	{"bad number", "3/", []token{errorTokenf("bad number syntax: '3/'")}},
 	{"lam", "lam x x", []token{lamTok, xTok, xTok, eofTok}},
@@ -51,19 +64,61 @@ var lexTests = []lexTest{
 		[]token{appTok, lamTok, xTok, xTok, threeTok, eofTok}},
 	{"bad identifier", "lam x' x",
 		[]token{lamTok, errorTokenf("bad identifier syntax: 'x''")}},
+	{"underscore", "lam _ x", []token{lamTok, mktok(tokenIdentifier, "_"), xTok, eofTok}},
+	{"underscore before letter", "_x", []token{errorTokenf("bad identifier syntax: '_x'")}},
+	{"underscore after letter", "x_", []token{errorTokenf("bad identifier syntax: 'x_'")}},
 	{"illegal character", "lam x x ]",
-		[]token{lamTok, xTok, xTok, errorTokenf("illegal character: ']'")}},
+		[]token{lamTok, xTok, xTok, errorTokenf("illegal character: ']' at line 1, column 9, near 'lam x x ]'")}},
+	{"illegal character in multi-line program", "def double lam x app app add x x\n" +
+		"app double (app app add 1 2 $ 3)\nfalse",
+		[]token{mktok(tokenIdentifier, "def"), mktok(tokenIdentifier, "double"), lamTok, xTok,
+			appTok, appTok, mktok(tokenIdentifier, "add"), xTok, xTok,
+			appTok, mktok(tokenIdentifier, "double"), leftParenTok, appTok, appTok,
+			mktok(tokenIdentifier, "add"), oneTok, mktok(tokenNumber, "2"),
+			errorTokenf("illegal character: '$' at line 2, column 29, near '...le (app app add 1 2 $ 3)'")}},
+	{"illegal character after multibyte characters", `"é" ]`, []token{mktok(tokenString, `"é"`),
+		errorTokenf("illegal character: ']' at line 1, column 5, near '\"é\" ]'")}},
 	{"app", "app lam x x 3",
 		[]token{appTok, lamTok, xTok, xTok, threeTok, eofTok}},
 	{"example", "app app app if (app app gt 3 1) 10 5", []token{
 		appTok, appTok, appTok, ifTok,
 		leftParenTok, appTok, appTok, gtTok, threeTok, oneTok, rightParenTok,
 		tenTok, fiveTok, eofTok}},
+	{"string", `"hi"`, []token{mktok(tokenString, `"hi"`), eofTok}},
+	{"empty string", `""`, []token{mktok(tokenString, `""`), eofTok}},
+	{"string with escapes", `"a\"b\\c\nd"`, []token{mktok(tokenString, `"a\"b\\c\nd"`), eofTok}},
+	{"string with spaces", `app f "a b" `, []token{appTok, mktok(tokenIdentifier, "f"),
+		mktok(tokenString, `"a b"`), eofTok}},
+	{"string in parens", `("x")`, []token{leftParenTok, mktok(tokenString, `"x"`), rightParenTok, eofTok}},
+	{"unterminated string", `app "abc`, []token{appTok, errorTokenf(`unterminated string: '"abc'`)}},
+	{"unterminated string with escaped quote", `"abc\"`, []token{errorTokenf(`unterminated string: '"abc\"'`)}},
+	{"unterminated string ending with backslash", `"abc\`, []token{errorTokenf(`unterminated string: '"abc\'`)}},
+	{"bad escape", `"a\tb"`, []token{errorTokenf(`bad escape sequence in string: '"a\t'`)}},
+	{"number before paren", "3(", []token{threeTok, leftParenTok, eofTok}},
+	{"identifier before paren", "x(", []token{xTok, leftParenTok, eofTok}},
+	{"number after paren", ")3", []token{rightParenTok, threeTok, eofTok}},
+	{"string before paren", `"a"(`, []token{mktok(tokenString, `"a"`), leftParenTok, eofTok}},
+	{"minus sign before paren", "-(", []token{errorTokenf("minus sign without digits at line 1, column 1, near '-('")}},
+	{"no spaces", "app(lam x x)3", []token{appTok, leftParenTok, lamTok, xTok, xTok, rightParenTok, threeTok, eofTok}},
+	{"backslash", `\x x`, []token{mktok(tokenBackslash, `\`), xTok, xTok, eofTok}},
+	{"backslash with dot", `(\x. x)`, []token{leftParenTok, mktok(tokenBackslash, `\`), xTok,
+		mktok(tokenDot, "."), xTok, rightParenTok, eofTok}},
+	{"string without boundary", `"a"b`, []token{errorTokenf(`bad string syntax: '"a"b'`)}},
+	{"mixed whitespace", "app\v\fx\u00a0\t1\u2003", []token{appTok, xTok, oneTok, eofTok}},
+	{"CRLF line endings", "def x 1\r\nlam x x\r\n", []token{mktok(tokenIdentifier, "def"), xTok, oneTok,
+		lamTok, xTok, xTok, eofTok}},
+	{"illegal character after CRLF line endings", "app x\r\n\r\n\tx ]\r\nx",
+		[]token{appTok, xTok, xTok, errorTokenf("illegal character: ']' at line 3, column 4, near 'x ]'")}},
 }
 
 func collectTokens(input string) []token {
+	return collectLexerTokens(newLexer(input))
+}
+
+// collectLexerTokens returns the tokens produced by l up to and including the
+// EOF or error token.
+func collectLexerTokens(l *lexer) []token {
 	var tokens []token
-	l := newLexer(input)
 	for {
 		t := l.nextToken()
 		tokens = append(tokens, t)
@@ -94,3 +149,132 @@ func TestLexer(t *testing.T) {
 		}
 	}
 }
+
+// oneByteReader returns a reader which reads input one byte at a time, with as
+// little buffering as a RuneReader allows, so that the lexer has to read its
+// input in many small pieces.
+func oneByteReader(input string) io.RuneReader {
+	return bufio.NewReaderSize(iotest.OneByteReader(strings.NewReader(input)), 16)
+}
+
+func TestReaderLexer(t *testing.T) {
+	for _, lt := range lexTests {
+		want := collectTokens(lt.input)
+		tokens := collectLexerTokens(newReaderLexer(oneByteReader(lt.input)))
+		if !reflect.DeepEqual(tokens, want) {
+			t.Errorf("[%s]\ninput: %q\nwant: %+v\ngot: %+v\n", lt.name, lt.input, want, tokens)
+		}
+	}
+
+	r := bufio.NewReader(io.MultiReader(strings.NewReader("app f "), errReader{errors.New("broken")}))
+	want := []token{appTok, mktok(tokenIdentifier, "f"), errorTokenf("read error: broken")}
+	if tokens := collectLexerTokens(newReaderLexer(r)); !tokensEqual(tokens, want) {
+		t.Errorf("want: %s\ngot: %s\n", want, tokens)
+	}
+}
+
+func TestReaderLexerDiscardsLines(t *testing.T) {
+	input := strings.Repeat("app f x\n", 1000) + "app f ]"
+	l := newReaderLexer(oneByteReader(input))
+	tokens := collectLexerTokens(l)
+	want := errorTokenf("illegal character: ']' at line 1001, column 7, near 'app f ]'")
+	if tok := tokens[len(tokens)-1]; !tokensEqual([]token{tok}, []token{want}) || tok.pos != len(input)-1 {
+		t.Errorf("want: %s at %d\ngot: %s at %d", want, len(input)-1, tok, tok.pos)
+	}
+	if len(l.buf) > len("app f ]") {
+		t.Errorf("lexer kept %d bytes of input: %q", len(l.buf), l.buf)
+	}
+}
+
+func TestErrorTokenPos(t *testing.T) {
+	tests := []struct {
+		input string
+		pos   int
+	}{
+		{"x ]", 2},
+		{"app f 3/", 6},
+		{"lam x \"abc", 6},
+		{"(\n  -)", 4},
+	}
+	for _, tt := range tests {
+		tokens := collectTokens(tt.input)
+		tok := tokens[len(tokens)-1]
+		if tok.typ != tokenError || tok.pos != tt.pos {
+			t.Errorf("input: %q\nwant: error token at %d\ngot: %s at %d", tt.input, tt.pos, tok, tok.pos)
+		}
+	}
+}
+
+func TestTokenPosWhitespace(t *testing.T) {
+	input := "app\r\n\tf\v\f(x)\u00a0\r\n1"
+	want := []int{0, 6, 9, 10, 11, 16, 17}
+	var got []int
+	for _, tok := range collectTokens(input) {
+		got = append(got, tok.pos)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("input: %q\nwant: %v\ngot: %v", input, want, got)
+	}
+}
+
+func TestLexerUnnext(t *testing.T) {
+	// Each test runs a sequence of operations on the lexer: 'n' calls
+	// next() and 'u' calls unnext(). The runes returned by next() and the
+	// final position are checked.
+	tests := []struct {
+		name  string
+		input string
+		ops   string
+		runes string
+		pos   int
+	}{
+		{"unnext once", "ab", "nun", "aa", 1},
+		{"unnext twice", "ab", "nnuun", "abb", 2},
+		{"unnext at start", "ab", "un", "a", 1},
+		{"unnext at EOF", "a", "nnun", "a\x00\x00", 1},
+		{"unnext past EOF", "a", "nnnuu", "a\x00\x00", 1},
+		{"unnext after EOF in empty input", "", "nuun", "\x00\x00", 0},
+		{"unnext multibyte rune", "é世", "nnun", "é世世", 5},
+		{"unnext twice after multibyte rune", "é世", "nnuu", "é世", 2},
+	}
+	for _, tt := range tests {
+		l := newLexer(tt.input)
+		var runes []rune
+		for _, op := range tt.ops {
+			if op == 'n' {
+				ch := l.next()
+				if ch == eof {
+					ch = 0
+				}
+				runes = append(runes, ch)
+			} else {
+				l.unnext()
+			}
+		}
+		if string(runes) != tt.runes || l.pos != tt.pos {
+			t.Errorf("[%s]\ninput: %q, ops: %q\nwant: %q, %d\ngot: %q, %d\n",
+				tt.name, tt.input, tt.ops, tt.runes, tt.pos, string(runes), l.pos)
+		}
+	}
+}
+
+func TestDumpTokens(t *testing.T) {
+	tests := []struct {
+		input  string
+		ok     bool
+		output string
+	}{
+		{"app lam x x 3", true, "<4(identifier):'app'>\n<4(identifier):'lam'>\n" +
+			"<4(identifier):'x'>\n<4(identifier):'x'>\n<2(number):'3'>\nEOF\n"},
+		{"(true)", true, "<5('('):'('>\n<3(bool):'true'>\n<6(')'):')'>\nEOF\n"},
+		{"lam x ]", false, "<4(identifier):'lam'>\n<4(identifier):'x'>\n" +
+			"<0(error):'illegal character: ']' at line 1, column 7, near 'lam x ]''>\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		ok := dumpTokens(&buf, tt.input)
+		if ok != tt.ok || buf.String() != tt.output {
+			t.Errorf("input: %q\nwant: %v, %q\ngot: %v, %q\n", tt.input, tt.ok, tt.output, ok, buf.String())
+		}
+	}
+}
@@ -1,150 +1,933 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/chzyer/readline"
 )
 
-var formatFlag = flag.Bool("format", false, "print a formatted version of the program instead of evaluating it")
+var (
+	formatFlag      = flag.Bool("format", false, "print a formatted version of the program instead of evaluating it")
+	checkFlag       = flag.Bool("check", false, "check the program for parse errors and unknown identifiers instead of evaluating it")
+	formatWidthFlag = flag.Int("format-width", 0, "with -format, write expressions which fit within this many columns on a single line (0 means no limit is used)")
+	tokensFlag      = flag.Bool("tokens", false, "print the tokens in the program instead of evaluating it")
+	astFlag         = flag.Bool("dump-ast", false, "print the parse tree of the program instead of evaluating it")
+	dotFlag         = flag.Bool("dot", false, "print the parse tree of the program in the Graphviz DOT language instead of evaluating it")
+	dotLabelsFlag   = flag.Bool("ast-dot-labels", false, "with -dot, label each identifier as bound within the program or free, and color it accordingly")
+	sexprFlag       = flag.Bool("ast-sexpr", false, "print the parse tree of the program as an S-expression instead of evaluating it")
+	timeFlag        = flag.Bool("time", false, "print how long parsing and evaluation took to standard error")
+	versionFlag     = flag.Bool("version", false, "print the version of the interpreter and exit")
+	linesFlag       = flag.Bool("lines", false, "evaluate each line of standard input as a separate program")
+	streamFlag      = flag.Bool("stream", false, "evaluate each definition and expression on standard input as soon as it's read")
+	traceFlag       = flag.Bool("stacktrace", false, "print the applications that were being evaluated when a runtime error occurred")
+	promptFlag      = flag.String("prompt", ">> ", "the prompt shown by the interactive shell")
+	prompt2Flag     = flag.String("continuation-prompt", ".. ", "the prompt shown by the interactive shell while a program is being continued")
+	noColorFlag     = flag.Bool("no-color", false, "don't color the output of the interactive shell")
+	jsonFlag        = flag.Bool("json", false, "print the value of the program as a JSON document")
+	strictFlag      = flag.Bool("strict-arity", false, "report an error for built-in functions applied to the wrong number of arguments")
+	baseFlag        = flag.Int("base", 10, "the base that numbers in results are printed in: 2, 8, 10, or 16")
+	preludeFlag     = flag.String("prelude", "", "a file of definitions to evaluate before the program or the interactive shell")
+	builtinsFlag    = flag.String("builtins", "", "a comma-separated list of the only built-in functions to make available (all of them are by default)")
+	noBuiltinFlag   = flag.String("no-builtin", "", "a comma-separated list of built-in functions to leave out")
+	maxStepsFlag    = flag.Int("max-steps", 0, "stop evaluating a program after this many function applications (0 means no limit)")
+	evalFlag        string
+	evalGiven       bool // whether -e was given, since its program can be empty
+)
+
+// version is the version of the interpreter. Release builds set it with
+// "go build -ldflags '-X main.version=<version>'".
+var version = "dev"
+
+// versionString returns the version information printed by the -version flag.
+func versionString() string {
+	return fmt.Sprintf("laminterp %s (%s %s/%s)", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func init() {
+	const usage = "evaluate the given program instead of reading one from a file or standard input"
+	flag.StringVar(&evalFlag, "e", "", usage)
+	flag.StringVar(&evalFlag, "eval", "", usage)
+}
+
+// Exit codes returned by the interpreter. Note that the flag package also exits
+// with status 2 when given invalid flags.
+const (
+	exitSuccess      = 0 // the program ran successfully
+	exitFailure      = 1 // the program couldn't be run, e.g. due to an I/O error
+	exitParseError   = 2 // the program has a syntax error
+	exitRuntimeError = 3 // the program was evaluated to an error
+)
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("laminterp: ")
 
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "e" || f.Name == "eval" {
+			evalGiven = true
+		}
+	})
+	if !supportedBase(*baseFlag) {
+		log.Printf("unsupported base: %d (must be 2, 8, 10, or 16)", *baseFlag)
+		os.Exit(exitFailure)
+	}
 
-	if flag.NArg() > 1 {
-		log.Fatal("too many arguments")
+	if !*versionFlag && !evalGiven && flag.NArg() == 0 && readline.DefaultIsTerminal() {
+		interactiveMode()
+		return
 	}
+	os.Exit(runMain(os.Stdin, os.Stdout, os.Stderr, flag.Args()))
+}
 
-	if flag.NArg() == 1 {
-		f, err := os.Open(flag.Arg(0))
+// runMain runs the program given by the command-line arguments that remain
+// after parsing the flags, or reads it from stdin if there aren't any. The
+// value of the program is written to stdout and any errors are written to
+// stderr. It returns the exit code for the interpreter. If the -version flag is
+// set, it writes the version information instead.
+func runMain(stdin io.Reader, stdout, stderr io.Writer, args []string) int {
+	if *versionFlag {
+		fmt.Fprintln(stdout, versionString())
+		return exitSuccess
+	}
+	env, code := loadPrelude(stderr)
+	if code != exitSuccess {
+		return code
+	}
+	switch {
+	case evalGiven && len(args) > 0:
+		fmt.Fprintln(stderr, "laminterp: -e can't be used with a file argument")
+		return exitFailure
+	case *checkFlag && (*linesFlag || *streamFlag):
+		fmt.Fprintln(stderr, "laminterp: -check can't be used with -lines or -stream")
+		return exitFailure
+	case evalGiven:
+		return run(stdout, stderr, evalFlag, env)
+	case len(args) > 0:
+		return runFiles(stdout, stderr, args, env)
+	case *linesFlag:
+		return runLines(stdin, stdout, stderr, env)
+	case *streamFlag:
+		return runStream(stdin, stdout, stderr, env)
+	default:
+		program, err := ioutil.ReadAll(stdin)
 		if err != nil {
-			log.Fatal(err)
+			fmt.Fprintln(stderr, "laminterp:", err)
+			return exitFailure
 		}
-		defer f.Close()
-		scriptMode(f)
-	} else if readline.DefaultIsTerminal() {
-		interactiveMode()
-	} else {
-		scriptMode(os.Stdin)
+		return run(stdout, stderr, string(program), env)
+	}
+}
+
+// loadPrelude returns the environment that programs are evaluated within: the
+// built-in functions chosen by the -builtins and -no-builtin flags (see
+// builtinEnvironment), extended with the definitions in the file given by the
+// -prelude flag if it's set. If the flags are invalid or the prelude can't be
+// evaluated, the error is written to stderr and the exit code for it is
+// returned.
+func loadPrelude(stderr io.Writer) (*environment, int) {
+	env, err := builtinEnvironment(*builtinsFlag, *noBuiltinFlag)
+	if err != nil {
+		fmt.Fprintln(stderr, "laminterp:", err)
+		return nil, exitFailure
+	}
+	if *preludeFlag == "" {
+		return env, exitSuccess
+	}
+	return evalFile(stderr, *preludeFlag, env)
+}
+
+// builtinEnvironment returns the default environment, restricted to the
+// built-in functions in the comma-separated list only, unless it's empty, and
+// without the ones in the comma-separated list exclude. It returns an error if
+// either list contains a name which isn't a built-in.
+func builtinEnvironment(only, exclude string) (*environment, error) {
+	if only == "" && exclude == "" {
+		return defaultEnvironment, nil
 	}
+	names := func(list string) (map[string]bool, error) {
+		set := make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if defaultEnvironment.lookup(name).typ == objectError {
+				return nil, fmt.Errorf("unknown built-in: '%s'", name)
+			}
+			set[name] = true
+		}
+		return set, nil
+	}
+	keep, err := names(only)
+	if err != nil {
+		return nil, err
+	}
+	drop, err := names(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return defaultEnvironment.filter(func(symbol string) bool {
+		return (only == "" || keep[symbol]) && !drop[symbol]
+	}), nil
 }
 
 func interactiveMode() {
-	rl, err := readline.New("")
+	env, code := loadPrelude(os.Stderr)
+	if code != exitSuccess {
+		os.Exit(code)
+	}
+	s := newSession(env)
+	rl, err := readline.NewEx(&readline.Config{
+		AutoComplete: &completer{s},
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Colors are only useful when a person is reading the output.
+	s.color = !*noColorFlag && readline.IsTerminal(int(os.Stdout.Fd()))
+	s.mainPrompt, s.contPrompt = *promptFlag, *prompt2Flag
 	for {
-	ReadNew:
-		program := ""
-	ReadMore:
-		if program == "" {
-			rl.SetPrompt(">> ")
-		} else {
-			rl.SetPrompt(".. ")
-		}
+		rl.SetPrompt(s.prompt())
 		line, err := rl.Readline()
 		if err != nil && (err == io.EOF || err == readline.ErrInterrupt) {
 			// If the user interrupts with no prior input, they're
 			// probably trying to quit the interpreter. Otherwise,
 			// they're probably just trying to start another
 			// program.
-			if program == "" && line == "" {
+			if s.program == "" && line == "" {
 				break
-			} else {
-				goto ReadNew
 			}
+			s.program = ""
+			continue
 		} else if err != nil {
 			log.Fatal(err)
 		}
-		if trimmed := strings.TrimSpace(line); trimmed != "" {
-			program += trimmed + "\n"
-		}
-
-		// Since this language has a simple grammar, we can just
-		// attempt to parse the program entered so far to see if
-		// it's valid and then assume there's more if we get an
-		// unexpected EOF error.
-		node := parseString(program)
-		if node.typ == nodeError && isUnexpectedEOFError(node) {
-			goto ReadMore
-		} else if node.typ == nodeError {
-			fmt.Println("parse error:", node.val)
-		} else if *formatFlag {
-			format(node, "")
-			fmt.Println()
-		} else {
-			fmt.Println(eval(node))
+		s.handleLine(os.Stdout, line)
+	}
+}
+
+// runFiles runs the program in the last of the given files within env using
+// run. The files before it are evaluated first, and their definitions are made
+// available to the files that follow them. If the -tokens flag or one of the
+// flags handled by treeOutput is set, each file is tokenized or printed instead,
+// and if the -check flag is set, each file is checked with check, with the
+// definitions in the files before it counting as defined.
+func runFiles(stdout, stderr io.Writer, filenames []string, env *environment) int {
+	declared := make(map[string]bool)
+	for i, filename := range filenames {
+		if *checkFlag {
+			program, err := ioutil.ReadFile(filename)
+			if err != nil {
+				fmt.Fprintln(stderr, "laminterp:", err)
+				return exitFailure
+			}
+			if code := check(stderr, string(program), env, declared); code != exitSuccess {
+				return code
+			}
+			continue
+		}
+		if *tokensFlag || treeOutput() != nil || i == len(filenames)-1 {
+			program, err := ioutil.ReadFile(filename)
+			if err != nil {
+				fmt.Fprintln(stderr, "laminterp:", err)
+				return exitFailure
+			}
+			if code := run(stdout, stderr, string(program), env); code != exitSuccess {
+				return code
+			}
+			continue
+		}
+		var code int
+		if env, code = evalFile(stderr, filename, env); code != exitSuccess {
+			return code
 		}
 	}
+	return exitSuccess
 }
 
-func scriptMode(r io.Reader) {
-	program, err := ioutil.ReadAll(r)
+// evalFile evaluates the program in the given file within env and returns env
+// extended with its top-level definitions. Errors are written to stderr,
+// prefixed with the file name, and the exit code for them is returned.
+func evalFile(stderr io.Writer, filename string, env *environment) (*environment, int) {
+	program, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(stderr, "laminterp:", err)
+		return nil, exitFailure
 	}
-	node := parseString(string(program))
+	node, errs := parseAll(string(program))
 	if node.typ == nodeError {
-		log.Fatalln("parse error:", node.val)
-		return
+		for _, err := range errs {
+			fmt.Fprintf(stderr, "%s: parse error: %s\n", filename, err)
+		}
+		return nil, exitParseError
+	}
+	obj, defs := evalDefs(node, env)
+	if obj.typ == objectError {
+		fmt.Fprintf(stderr, "%s: runtime error: %s\n", filename, obj)
+		return nil, exitRuntimeError
+	}
+	return defs, exitSuccess
+}
+
+// run parses the given program and writes its value within env to stdout, or
+// its tokens if the -tokens flag is set, or its parse tree in the form chosen by
+// treeOutput, or checks it with check if the -check flag is set. Errors are
+// written to stderr instead. It returns the exit code for the interpreter.
+func run(stdout, stderr io.Writer, program string, env *environment) int {
+	if *checkFlag {
+		return check(stderr, program, env, make(map[string]bool))
+	}
+	if *tokensFlag {
+		if !dumpTokens(stdout, program) {
+			return exitParseError
+		}
+		return exitSuccess
+	}
+	if output := treeOutput(); output != nil {
+		node, errs := parseAll(program)
+		if node.typ == nodeError {
+			return reportParseErrors(stderr, errs)
+		}
+		output(stdout, node)
+		return exitSuccess
+	}
+	obj, errs, parseTime, evalTime := timedEval(program, env)
+	if *timeFlag {
+		fmt.Fprintf(stderr, "parse time: %v\neval time: %v\n", parseTime, evalTime)
+	}
+	if errs != nil {
+		return reportParseErrors(stderr, errs)
+	}
+	if *jsonFlag {
+		return writeJSON(stdout, stderr, obj)
+	}
+	if obj.typ == objectError {
+		fmt.Fprintln(stderr, "runtime error:", obj)
+		writeTrace(stderr, obj)
+		return exitRuntimeError
+	}
+	fmt.Fprintln(stdout, obj.Text(*baseFlag))
+	return exitSuccess
+}
+
+// check parses the given program and checks that each identifier in it is
+// either bound within the program, defined in env, or in declared, without
+// evaluating it. Parse errors and unknown identifiers are written to stderr,
+// and nothing is written if the program is fine. The names of the program's
+// top-level definitions are added to declared. It returns the exit code for the
+// interpreter, which is the one for parse errors if there are unknown
+// identifiers, since they're found before the program is evaluated.
+func check(stderr io.Writer, program string, env *environment, declared map[string]bool) int {
+	node, errs := parseAll(program)
+	if node.typ == nodeError {
+		return reportParseErrors(stderr, errs)
+	}
+	unbound := unboundIdentifiers(node, func(name string) bool {
+		return declared[name] || env.lookup(name).typ != objectError
+	})
+	if len(unbound) > 0 {
+		for _, name := range unbound {
+			fmt.Fprintf(stderr, "scope error: unknown identifier: '%s'\n", name)
+		}
+		return exitParseError
+	}
+	for n := node; n != nil && n.typ == nodeDef; n = n.val.(*defNode).body {
+		declared[n.val.(*defNode).name] = true
+	}
+	return exitSuccess
+}
+
+// supportedBase returns true if numbers can be printed in the given base with
+// the -base flag.
+func supportedBase(base int) bool {
+	switch base {
+	case 2, 8, 10, 16:
+		return true
+	default:
+		return false
+	}
+}
+
+// maxFrameWidth is the maximum number of characters of each frame printed by
+// writeTrace.
+const maxFrameWidth = 60
+
+// writeTrace writes the stack trace of the given error object to w, one frame
+// per line, innermost first. Each frame is an application written as an
+// S-expression, which is truncated if it's too long. Nothing is written if the
+// error doesn't have a stack trace.
+func writeTrace(w io.Writer, obj *object) {
+	for _, n := range errorTrace(obj) {
+		frame := sexpr(n)
+		if utf8.RuneCountInString(frame) > maxFrameWidth {
+			frame = string([]rune(frame)[:maxFrameWidth-3]) + "..."
+		}
+		fmt.Fprintln(w, "    in", frame)
+	}
+}
+
+// writeJSON writes the JSON representation of obj to stdout, including when
+// it's an error, and returns the exit code for the interpreter.
+func writeJSON(stdout, stderr io.Writer, obj *object) int {
+	enc := json.NewEncoder(stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		fmt.Fprintln(stderr, "laminterp:", err)
+		return exitFailure
+	}
+	if obj.typ == objectError {
+		return exitRuntimeError
+	}
+	return exitSuccess
+}
+
+// runLines evaluates each line read from r as a separate program and writes its
+// value to w, one line per program. Blank lines and lines starting with '#' are
+// skipped. Definitions are remembered for the following lines, as in the
+// interactive shell. Parse and runtime errors are written to w as well,
+// prefixed with the line number, and don't stop the rest of the lines from
+// being evaluated. The first line is evaluated within env. It returns the exit
+// code corresponding to the first error, if any.
+func runLines(r io.Reader, w, stderr io.Writer, env *environment) int {
+	s := newSession(env)
+	code := exitSuccess
+	fail := func(c int) {
+		if code == exitSuccess {
+			code = c
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		node, errs := parseAll(line)
+		if node.typ == nodeError {
+			for _, err := range errs {
+				fmt.Fprintf(w, "line %d: parse error: %s\n", lineno, err)
+			}
+			fail(exitParseError)
+			continue
+		}
+		obj := s.eval(node)
+		if obj.typ == objectError {
+			fmt.Fprintf(w, "line %d: runtime error: %s\n", lineno, obj)
+			fail(exitRuntimeError)
+			continue
+		}
+		fmt.Fprintln(w, obj.Text(*baseFlag))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(stderr, "laminterp:", err)
+		return exitFailure
+	}
+	return code
+}
+
+// runStream evaluates each definition and expression read from r and writes
+// its value to w, like runLines, except that statements may span lines or share
+// them. Each one is evaluated as soon as it's been read, without waiting for the
+// rest of the input, so r can be e.g. a pipe or a network connection which is
+// kept open. Errors are written to w and don't stop the rest of the input from
+// being evaluated. The first statement is evaluated within env. It returns the
+// exit code corresponding to the first error, if any.
+func runStream(r io.Reader, w, stderr io.Writer, env *environment) int {
+	s := newSession(env)
+	sp := newStreamParser(r)
+	code := exitSuccess
+	fail := func(c int) {
+		if code == exitSuccess {
+			code = c
+		}
 	}
-	if *formatFlag {
-		format(node, "")
-		fmt.Println()
-	} else {
-		obj := eval(node)
+	for {
+		node, err := sp.next()
+		if err != nil {
+			fmt.Fprintln(stderr, "laminterp:", err)
+			return exitFailure
+		}
+		if node == nil {
+			return code
+		}
+		if node.typ == nodeError {
+			fmt.Fprintln(w, "parse error:", node.val)
+			fail(exitParseError)
+			continue
+		}
+		obj := s.eval(node)
 		if obj.typ == objectError {
-			log.Fatalln("runtime error:", obj)
+			fmt.Fprintln(w, "runtime error:", obj)
+			fail(exitRuntimeError)
+			continue
 		}
-		fmt.Println(obj)
+		fmt.Fprintln(w, obj.Text(*baseFlag))
+	}
+}
+
+// treeOutput returns the function which writes a parse tree in the form chosen
+// by the -format, -dump-ast, -dot, or -ast-sexpr flag, or nil if none of them
+// are set and programs should be evaluated instead. The -ast-dot-labels flag
+// only has an effect along with -dot.
+func treeOutput() func(io.Writer, *node) {
+	switch {
+	case *formatFlag:
+		return func(w io.Writer, n *node) {
+			format(w, n, "", *formatWidthFlag)
+			fmt.Fprintln(w)
+		}
+	case *astFlag:
+		return dumpAST
+	case *dotFlag && *dotLabelsFlag:
+		return dotGraphScope
+	case *dotFlag:
+		return dotGraph
+	case *sexprFlag:
+		return func(w io.Writer, n *node) {
+			fmt.Fprintln(w, sexpr(n))
+		}
+	default:
+		return nil
 	}
 }
 
+// reportParseErrors writes each of the given parse errors to w and returns the
+// corresponding exit code.
+func reportParseErrors(w io.Writer, errs []error) int {
+	for _, err := range errs {
+		fmt.Fprintln(w, "parse error:", err)
+	}
+	return exitParseError
+}
+
+// timedEval parses the given program and evaluates it within env, returning its
+// value along with how long each step took. If there are parse errors, they're
+// returned instead and the program isn't evaluated. If the -strict-arity flag is
+// set, the program is checked with arityError first, and if the -stacktrace
+// flag is set, runtime errors include stack traces. Evaluation stops with an
+// error after the number of function applications given by the -max-steps flag,
+// if it's set.
+func timedEval(program string, env *environment) (obj *object, errs []error, parseTime, evalTime time.Duration) {
+	start := time.Now()
+	node, errs := parseAll(program)
+	parseTime = time.Since(start)
+	if node.typ == nodeError {
+		return nil, errs, parseTime, 0
+	}
+	start = time.Now()
+	if *strictFlag {
+		obj = arityError(node, env)
+	}
+	if obj == nil {
+		ev := &evaluator{trace: *traceFlag, maxSteps: *maxStepsFlag}
+		obj = ev.evalEnv(node, env)
+	}
+	evalTime = time.Since(start)
+	return obj, nil, parseTime, evalTime
+}
+
 func isSimpleNode(n *node) bool {
 	switch n.typ {
-	case nodeIdentifier, nodeNumber, nodeBool:
+	case nodeIdentifier, nodeNumber, nodeBool, nodeString:
 		return true
 	default:
 		return false
 	}
 }
 
+// simpleNodeString returns the source form of a simple node.
+func simpleNodeString(n *node) string {
+	if n.typ == nodeString {
+		return quote(n.val.(string))
+	}
+	return fmt.Sprint(n.val)
+}
+
 const formatIndent = "    "
 
-func format(n *node, indent string) {
+// format writes the program rooted at n to w in a readable form, indenting each
+// line with indent. Expressions whose operands are all simple are written on a
+// single line, and others are split over several lines, with their operands
+// indented. If width is positive, any expression which fits within that many
+// columns, including the indentation, is written on a single line as well.
+func format(w io.Writer, n *node, indent string, width int) {
+	if width > 0 && !isSimpleNode(n) {
+		line := formatInline(n)
+		if n.typ == nodeDef {
+			def := n.val.(*defNode)
+			line = fmt.Sprintf("def %s %s", def.name, formatInline(def.val))
+		}
+		if utf8.RuneCountInString(indent+line) <= width {
+			fmt.Fprintf(w, "%s%s", indent, line)
+			if n.typ == nodeDef && n.val.(*defNode).body != nil {
+				fmt.Fprintln(w)
+				format(w, n.val.(*defNode).body, indent, width)
+			}
+			return
+		}
+	}
 	switch {
 	case isSimpleNode(n):
-		fmt.Printf("%s%v", indent, n.val)
+		fmt.Fprintf(w, "%s%s", indent, simpleNodeString(n))
 	case n.typ == nodeLam:
 		lam := n.val.(*lamNode)
-		fmt.Printf("%slam %v ", indent, lam.param)
+		fmt.Fprintf(w, "%slam %v", indent, lam.param)
 		if isSimpleNode(lam.body) {
-			fmt.Print(lam.body.val)
+			fmt.Fprintf(w, " %s", simpleNodeString(lam.body))
 		} else {
-			fmt.Println()
-			format(lam.body, indent+formatIndent)
+			fmt.Fprintln(w)
+			format(w, lam.body, indent+formatIndent, width)
 		}
 	case n.typ == nodeApp:
 		app := n.val.(*appNode)
-		fmt.Printf("%sapp", indent)
+		fmt.Fprintf(w, "%sapp", indent)
 		if isSimpleNode(app.fn) && isSimpleNode(app.arg) {
-			fmt.Printf(" %v %v", app.fn.val, app.arg.val)
+			fmt.Fprintf(w, " %s %s", simpleNodeString(app.fn), simpleNodeString(app.arg))
+		} else {
+			fmt.Fprintln(w)
+			format(w, app.fn, indent+formatIndent, width)
+			fmt.Fprintln(w)
+			format(w, app.arg, indent+formatIndent, width)
+		}
+	case n.typ == nodeWhen:
+		when := n.val.(*whenNode)
+		fmt.Fprintf(w, "%s%s", indent, when.keyword())
+		if isSimpleNode(when.test) && isSimpleNode(when.body) {
+			fmt.Fprintf(w, " %s %s", simpleNodeString(when.test), simpleNodeString(when.body))
+		} else {
+			fmt.Fprintln(w)
+			format(w, when.test, indent+formatIndent, width)
+			fmt.Fprintln(w)
+			format(w, when.body, indent+formatIndent, width)
+		}
+	case n.typ == nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		fmt.Fprintf(w, "%sletrec %s", indent, letrec.name)
+		if isSimpleNode(letrec.val) && isSimpleNode(letrec.body) {
+			fmt.Fprintf(w, " %s %s", simpleNodeString(letrec.val), simpleNodeString(letrec.body))
+		} else {
+			fmt.Fprintln(w)
+			format(w, letrec.val, indent+formatIndent, width)
+			fmt.Fprintln(w)
+			format(w, letrec.body, indent+formatIndent, width)
+		}
+	case n.typ == nodeSeq:
+		// A seq expression runs up to the closing parenthesis, so it's
+		// always written in parentheses.
+		exprs := seqExprs(n)
+		fmt.Fprintf(w, "%s(seq", indent)
+		simple := true
+		for _, e := range exprs {
+			simple = simple && isSimpleNode(e)
+		}
+		for _, e := range exprs {
+			if simple {
+				fmt.Fprintf(w, " %s", simpleNodeString(e))
+			} else {
+				fmt.Fprintln(w)
+				format(w, e, indent+formatIndent, width)
+			}
+		}
+		fmt.Fprint(w, ")")
+	case n.typ == nodeDef:
+		def := n.val.(*defNode)
+		fmt.Fprintf(w, "%sdef %s", indent, def.name)
+		if isSimpleNode(def.val) {
+			fmt.Fprintf(w, " %s", simpleNodeString(def.val))
+		} else {
+			fmt.Fprintln(w)
+			format(w, def.val, indent+formatIndent, width)
+		}
+		if def.body != nil {
+			fmt.Fprintln(w)
+			format(w, def.body, indent, width)
+		}
+	default:
+		fmt.Fprintf(w, "%s%s", indent, formatError(n))
+	}
+}
+
+// formatInline returns the program rooted at n written on a single line, with
+// operands which aren't simple in parentheses, except for the bodies of lambdas
+// and functions which are applications themselves, e.g.
+// "app app f (lam x x) (app g 1)".
+func formatInline(n *node) string {
+	switch n.typ {
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		return fmt.Sprintf("lam %s %s", lam.param, formatInline(lam.body))
+	case nodeApp:
+		app := n.val.(*appNode)
+		fn := formatOperand(app.fn)
+		if app.fn.typ == nodeApp {
+			fn = formatInline(app.fn)
+		}
+		return fmt.Sprintf("app %s %s", fn, formatOperand(app.arg))
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return fmt.Sprintf("%s %s %s", when.keyword(), formatOperand(when.test), formatOperand(when.body))
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		return fmt.Sprintf("letrec %s %s %s", letrec.name, formatOperand(letrec.val), formatOperand(letrec.body))
+	case nodeSeq:
+		line := "(seq"
+		for _, e := range seqExprs(n) {
+			line += " " + formatOperand(e)
+		}
+		return line + ")"
+	case nodeDef:
+		def := n.val.(*defNode)
+		line := fmt.Sprintf("def %s %s", def.name, formatOperand(def.val))
+		if def.body != nil {
+			line += " " + formatInline(def.body)
+		}
+		return line
+	case nodeError:
+		return formatError(n)
+	default:
+		return simpleNodeString(n)
+	}
+}
+
+// seqExprs returns the expressions in the sequence n in the order that they're
+// evaluated, so that "seq a (seq b c)" gives a, b, and c.
+func seqExprs(n *node) []*node {
+	var exprs []*node
+	for n.typ == nodeSeq {
+		seq := n.val.(*seqNode)
+		exprs = append(exprs, seq.first)
+		n = seq.second
+	}
+	return append(exprs, n)
+}
+
+// formatError returns the form that format writes the error node n in. Error
+// nodes can't be written as source code, so it's a description of the error,
+// e.g. "<error: expecting expression; got EOF>".
+func formatError(n *node) string {
+	return fmt.Sprintf("<error: %s>", n.val)
+}
+
+// formatOperand is like formatInline, but it puts n in parentheses unless it's
+// simple, an error, or a seq expression, which is already in parentheses.
+func formatOperand(n *node) string {
+	if isSimpleNode(n) || n.typ == nodeError || n.typ == nodeSeq {
+		return formatInline(n)
+	}
+	return "(" + formatInline(n) + ")"
+}
+
+// dumpAST writes the parse tree rooted at n to w as an indented tree, with one
+// node per line. Unlike format, it shows the structure of the tree rather than
+// the source code, which makes it useful for debugging the parser.
+func dumpAST(w io.Writer, n *node) {
+	dumpASTNode(w, n, "", "")
+}
+
+// dumpASTNode writes n and its children. The first line is prefixed with first,
+// and the rest are prefixed with rest, which draws the branches of the
+// enclosing nodes.
+func dumpASTNode(w io.Writer, n *node, first, rest string) {
+	fmt.Fprintf(w, "%s%s\n", first, astLabel(n))
+	children := astChildren(n)
+	for i, child := range children {
+		if i == len(children)-1 {
+			dumpASTNode(w, child.n, rest+"└─ ", rest+"   ")
 		} else {
-			fmt.Println()
-			format(app.fn, indent+formatIndent)
-			fmt.Println()
-			format(app.arg, indent+formatIndent)
+			dumpASTNode(w, child.n, rest+"├─ ", rest+"│  ")
+		}
+	}
+}
+
+// astLabel returns a short description of a node for dumpAST and dotGraph,
+// consisting of its type and its value, if it has one besides its children.
+func astLabel(n *node) string {
+	switch n.typ {
+	case nodeApp:
+		return "App"
+	case nodeLam:
+		return "Lam " + n.val.(*lamNode).param
+	case nodeWhen:
+		if n.val.(*whenNode).unless {
+			return "Unless"
+		}
+		return "When"
+	case nodeLetrec:
+		return "Letrec " + n.val.(*letrecNode).name
+	case nodeSeq:
+		return "Seq"
+	case nodeDef:
+		return "Def " + n.val.(*defNode).name
+	case nodeIdentifier:
+		return fmt.Sprint("Ident ", n.val)
+	case nodeNumber:
+		return fmt.Sprint("Number ", n.val)
+	case nodeBool:
+		return fmt.Sprint("Bool ", n.val)
+	case nodeString:
+		return "String " + quote(n.val.(string))
+	default:
+		return fmt.Sprint("Error ", n.val)
+	}
+}
+
+// An astChild is a child of a node along with the name of the field it's
+// stored in.
+type astChild struct {
+	field string
+	n     *node
+}
+
+// astChildren returns the children of a node in the order that they appear in
+// the source code.
+func astChildren(n *node) []astChild {
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		return []astChild{{"fn", app.fn}, {"arg", app.arg}}
+	case nodeLam:
+		return []astChild{{"body", n.val.(*lamNode).body}}
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return []astChild{{"test", when.test}, {"body", when.body}}
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		return []astChild{{"val", letrec.val}, {"body", letrec.body}}
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return []astChild{{"first", seq.first}, {"second", seq.second}}
+	case nodeDef:
+		def := n.val.(*defNode)
+		if def.body == nil {
+			return []astChild{{"val", def.val}}
 		}
+		return []astChild{{"val", def.val}, {"body", def.body}}
+	default:
+		return nil
+	}
+}
+
+// dotGraph writes the parse tree rooted at n to w in the Graphviz DOT language,
+// so that it can be rendered with e.g. "dot -Tpng". Nodes are named n0, n1,
+// etc. in depth-first order, and each edge is labeled with the field of the
+// parent node that it represents.
+func dotGraph(w io.Writer, n *node) {
+	writeDotGraph(w, n, func(n *node) string {
+		return fmt.Sprintf("label=%q", astLabel(n))
+	})
+}
+
+// dotGraphScope is like dotGraph, except that each identifier is labeled as
+// bound if it refers to a binding within the tree, or as free otherwise (see
+// boundIdentifiers), e.g. "Ident x (bound)". Bound identifiers are drawn in
+// blue and free ones in red.
+func dotGraphScope(w io.Writer, n *node) {
+	bound := boundIdentifiers(n)
+	writeDotGraph(w, n, func(n *node) string {
+		switch {
+		case n.typ != nodeIdentifier:
+			return fmt.Sprintf("label=%q", astLabel(n))
+		case bound[n]:
+			return fmt.Sprintf("label=%q, color=blue", astLabel(n)+" (bound)")
+		default:
+			return fmt.Sprintf("label=%q, color=red", astLabel(n)+" (free)")
+		}
+	})
+}
+
+// writeDotGraph writes the parse tree rooted at n to w for dotGraph, with the
+// attributes of each node given by attrs.
+func writeDotGraph(w io.Writer, n *node, attrs func(*node) string) {
+	fmt.Fprintln(w, "digraph ast {")
+	id := 0
+	var visit func(n *node) int
+	visit = func(n *node) int {
+		self := id
+		id++
+		fmt.Fprintf(w, "\tn%d [%s];\n", self, attrs(n))
+		for _, child := range astChildren(n) {
+			fmt.Fprintf(w, "\tn%d -> n%d [label=%q];\n", self, visit(child.n), child.field)
+		}
+		return self
+	}
+	visit(n)
+	fmt.Fprintln(w, "}")
+}
+
+// sexpr returns the parse tree rooted at n as an S-expression, e.g.
+// "(app (app add 1) 3)". Lambdas and definitions are written as
+// "(lam param body)" and "(def name val [body])", when and unless expressions as
+// "(when test body)" and "(unless test body)", letrec expressions as
+// "(letrec name val body)", seq expressions as "(seq first second)", strings
+// are quoted, and error nodes are written as "(error message)" with the message
+// quoted.
+func sexpr(n *node) string {
+	var b bytes.Buffer
+	writeSexpr(&b, n)
+	return b.String()
+}
+
+func writeSexpr(b *bytes.Buffer, n *node) {
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		b.WriteString("(app ")
+		writeSexpr(b, app.fn)
+		b.WriteString(" ")
+		writeSexpr(b, app.arg)
+		b.WriteString(")")
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		fmt.Fprintf(b, "(lam %s ", lam.param)
+		writeSexpr(b, lam.body)
+		b.WriteString(")")
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		fmt.Fprintf(b, "(%s ", when.keyword())
+		writeSexpr(b, when.test)
+		b.WriteString(" ")
+		writeSexpr(b, when.body)
+		b.WriteString(")")
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		fmt.Fprintf(b, "(letrec %s ", letrec.name)
+		writeSexpr(b, letrec.val)
+		b.WriteString(" ")
+		writeSexpr(b, letrec.body)
+		b.WriteString(")")
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		b.WriteString("(seq ")
+		writeSexpr(b, seq.first)
+		b.WriteString(" ")
+		writeSexpr(b, seq.second)
+		b.WriteString(")")
+	case nodeDef:
+		def := n.val.(*defNode)
+		fmt.Fprintf(b, "(def %s ", def.name)
+		writeSexpr(b, def.val)
+		if def.body != nil {
+			b.WriteString(" ")
+			writeSexpr(b, def.body)
+		}
+		b.WriteString(")")
+	case nodeError:
+		fmt.Fprintf(b, "(error %s)", quote(fmt.Sprint(n.val)))
+	default:
+		b.WriteString(simpleNodeString(n))
 	}
 }
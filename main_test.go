@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type runTest struct {
+	name    string
+	program string
+	format  bool
+	code    int
+	stdout  string
+	stderr  string
+}
+
+var runTests = []runTest{
+	{"eval", "app app add 1 2", false, exitSuccess, "3\n", ""},
+	{"eval with definitions", "def x 2 app app gt x 1", false, exitSuccess, "true\n", ""},
+	{"format", "app app add 1 (app lam x x 2)", true, exitSuccess,
+		"app\n    app add 1\n    app\n        lam x x\n        2\n", ""},
+	{"format string", `app lam s s "a\"b\n"`, true, exitSuccess, "app\n    lam s s\n    \"a\\\"b\\n\"\n", ""},
+	{"format when", "lam x when (app isnil x) unless b x", true, exitSuccess,
+		"lam x\n    when\n        app isnil x\n        unless b x\n", ""},
+	{"format letrec", "letrec f lam x app f x app f 1", true, exitSuccess,
+		"letrec f\n    lam x\n        app f x\n    app f 1\n", ""},
+	{"parse error", "app app add 1", false, exitParseError, "",
+		"parse error: expecting expression; got EOF\n"},
+	{"multiple parse errors", "app (lam 1 x) (lam 2 y)", false, exitParseError, "",
+		"parse error: expecting identifier; got number\nparse error: expecting identifier; got number\n"},
+	{"parse error with format", "app app add 1", true, exitParseError, "",
+		"parse error: expecting expression; got EOF\n"},
+	{"runtime error", "app app add 1 true", false, exitRuntimeError, "",
+		"runtime error: add: not a number: 'true'\n"},
+}
+
+func TestRun(t *testing.T) {
+	defer func(format bool) { *formatFlag = format }(*formatFlag)
+	for _, rt := range runTests {
+		*formatFlag = rt.format
+		var stdout, stderr bytes.Buffer
+		code := run(&stdout, &stderr, rt.program, defaultEnvironment)
+		if code != rt.code || stdout.String() != rt.stdout || stderr.String() != rt.stderr {
+			t.Errorf("[%s]\ninput: %q\nwant: %d, %q, %q\ngot: %d, %q, %q\n", rt.name, rt.program,
+				rt.code, rt.stdout, rt.stderr, code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+type runFilesTest struct {
+	name   string
+	files  []string
+	format bool
+	code   int
+	output string
+}
+
+var runFilesTests = []runFilesTest{
+	{"single file", []string{"testdata/prelude.lam"}, false, exitSuccess, "4\n"},
+	{"prelude", []string{"testdata/prelude.lam", "testdata/main.lam"}, false, exitSuccess, "8\n"},
+	{"missing definitions", []string{"testdata/main.lam"}, false, exitRuntimeError, ""},
+	{"error in prelude", []string{"testdata/badprelude.lam", "testdata/main.lam"}, false, exitRuntimeError, ""},
+	{"missing file", []string{"testdata/nonexistent.lam", "testdata/main.lam"}, false, exitFailure, ""},
+	{"format", []string{"testdata/prelude.lam", "testdata/main.lam"}, true, exitSuccess,
+		"def double\n    lam x\n        app\n            app add x\n            x\n" +
+			"def four\n    app double 2\napp double four\n"},
+}
+
+func TestRunFiles(t *testing.T) {
+	defer func(format bool) { *formatFlag = format }(*formatFlag)
+	for _, rt := range runFilesTests {
+		*formatFlag = rt.format
+		var stdout, stderr bytes.Buffer
+		code := runFiles(&stdout, &stderr, rt.files, defaultEnvironment)
+		if code != rt.code || stdout.String() != rt.output {
+			t.Errorf("[%s]\nfiles: %q\nwant: %d, %q\ngot: %d, %q\n", rt.name, rt.files, rt.code, rt.output, code, stdout.String())
+		}
+	}
+}
+
+type runMainTest struct {
+	name   string
+	eval   string
+	args   []string
+	stdin  string
+	code   int
+	stdout string
+}
+
+var runMainTests = []runMainTest{
+	{"stdin", "", nil, "app app add 1 2", exitSuccess, "3\n"},
+	{"stdin parse error", "", nil, "app", exitParseError, ""},
+	{"stdin runtime error", "", nil, "x", exitRuntimeError, ""},
+	{"eval flag", "app lam x x 5", nil, "", exitSuccess, "5\n"},
+	{"eval flag with file", "1", []string{"testdata/main.lam"}, "", exitFailure, ""},
+	{"files", "", []string{"testdata/prelude.lam", "testdata/main.lam"}, "", exitSuccess, "8\n"},
+}
+
+func TestRunMain(t *testing.T) {
+	defer func(eval string, given bool) { evalFlag, evalGiven = eval, given }(evalFlag, evalGiven)
+	for _, rt := range runMainTests {
+		evalFlag, evalGiven = rt.eval, rt.eval != ""
+		var stdout, stderr bytes.Buffer
+		code := runMain(strings.NewReader(rt.stdin), &stdout, &stderr, rt.args)
+		if code != rt.code || stdout.String() != rt.stdout {
+			t.Errorf("[%s]\nwant: %d, %q\ngot: %d, %q\n", rt.name, rt.code, rt.stdout, code, stdout.String())
+		}
+	}
+}
+
+func TestRunMainEmptyEval(t *testing.T) {
+	defer func(eval string, given bool) { evalFlag, evalGiven = eval, given }(evalFlag, evalGiven)
+	// An empty program given with -e is evaluated instead of the one on
+	// stdin, and still can't be combined with a file argument.
+	evalFlag, evalGiven = "", true
+	var stdout, stderr bytes.Buffer
+	if code := runMain(strings.NewReader("app app add 1 2"), &stdout, &stderr, nil); code != exitParseError || stdout.Len() != 0 {
+		t.Errorf("want: %d, %q\ngot: %d, %q\n", exitParseError, "", code, stdout.String())
+	}
+	stdout.Reset()
+	if code := runMain(strings.NewReader(""), &stdout, &stderr, []string{"testdata/main.lam"}); code != exitFailure || stdout.Len() != 0 {
+		t.Errorf("want: %d, %q\ngot: %d, %q\n", exitFailure, "", code, stdout.String())
+	}
+}
+
+func TestTimedEval(t *testing.T) {
+	obj, errs, parseTime, evalTime := timedEval("app app add 1 2", defaultEnvironment)
+	if errs != nil || !obj.Equal(mknumobj(3)) {
+		t.Errorf("want: 3\ngot: %v, %v", obj, errs)
+	}
+	if parseTime < 0 || evalTime < 0 {
+		t.Errorf("negative durations: %v, %v", parseTime, evalTime)
+	}
+
+	obj, errs, parseTime, evalTime = timedEval("app app add 1", defaultEnvironment)
+	if obj != nil || len(errs) != 1 {
+		t.Errorf("want: parse error\ngot: %v, %v", obj, errs)
+	}
+	if parseTime < 0 || evalTime != 0 {
+		t.Errorf("unexpected durations: %v, %v", parseTime, evalTime)
+	}
+}
+
+func TestRunTime(t *testing.T) {
+	defer func(timeFlagValue bool) { *timeFlag = timeFlagValue }(*timeFlag)
+	*timeFlag = true
+	var stdout, stderr bytes.Buffer
+	if code := run(&stdout, &stderr, "app app add 1 2", defaultEnvironment); code != exitSuccess {
+		t.Fatalf("want: exit code %d\ngot: %d", exitSuccess, code)
+	}
+	if stdout.String() != "3\n" {
+		t.Errorf("want: %q\ngot: %q", "3\n", stdout.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "parse time: ") || !strings.HasPrefix(lines[1], "eval time: ") {
+		t.Errorf("unexpected timing output: %q", stderr.String())
+	}
+	for _, line := range lines {
+		if _, err := time.ParseDuration(line[strings.LastIndex(line, " ")+1:]); err != nil {
+			t.Errorf("bad duration in %q: %v", line, err)
+		}
+	}
+}
+
+func TestDumpAST(t *testing.T) {
+	program, err := ioutil.ReadFile("testdata/nested.lam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("testdata/nested.ast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	dumpAST(&buf, parseString(string(program)))
+	if buf.String() != string(want) {
+		t.Errorf("want:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
+
+// TestFormatFiles formats each program in testdata/format/*.in and compares
+// the result with the corresponding .fmt file. The formatted program must also
+// parse into the same tree as the original.
+func TestFormatFiles(t *testing.T) {
+	inFiles, err := filepath.Glob("testdata/format/*.in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inFiles) == 0 {
+		t.Fatal("no input files")
+	}
+	for _, inFile := range inFiles {
+		program, err := ioutil.ReadFile(inFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadFile(strings.TrimSuffix(inFile, ".in") + ".fmt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		root := parseString(string(program))
+		var buf bytes.Buffer
+		format(&buf, root, "", 0)
+		buf.WriteString("\n")
+		if buf.String() != string(want) {
+			t.Errorf("%s\nwant:\n%s\ngot:\n%s", inFile, want, buf.String())
+		}
+		if formatted := parseString(buf.String()); !nodesEqual(formatted, root) {
+			t.Errorf("%s: formatted program is different:\n%v\n%v", inFile, formatted, root)
+		}
+	}
+}
+
+func TestFormatNodeTypes(t *testing.T) {
+	errNode := errorNodef("expecting expression; got EOF")
+	tests := []struct {
+		name   string
+		n      *node
+		output string // output at width 0
+		inline string // output at width 80
+	}{
+		{"number", mknum(-5), "-5", "-5"},
+		{"bool", trueNode, "true", "true"},
+		{"identifier", xNode, "x", "x"},
+		{"string", &node{nodeString, "a\"b"}, `"a\"b"`, `"a\"b"`},
+		{"error", errNode, "<error: expecting expression; got EOF>", "<error: expecting expression; got EOF>"},
+		{"error in app", mkapp(xNode, errNode), "app\n    x\n    <error: expecting expression; got EOF>",
+			"app x <error: expecting expression; got EOF>"},
+		{"error in lam", mklam("x", errNode), "lam x\n    <error: expecting expression; got EOF>",
+			"lam x <error: expecting expression; got EOF>"},
+		{"seq", mkseq(mkapp(xNode, xNode), xNode), "(seq\n    app x x\n    x)", "(seq (app x x) x)"},
+	}
+	for _, tt := range tests {
+		for _, width := range []int{0, 80} {
+			want := tt.output
+			if width > 0 {
+				want = tt.inline
+			}
+			var buf bytes.Buffer
+			format(&buf, tt.n, "", width)
+			if buf.String() != want {
+				t.Errorf("[%s] width %d\nwant: %q\ngot: %q", tt.name, width, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestFormatWidth(t *testing.T) {
+	program, err := ioutil.ReadFile("testdata/wide.lam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := parseString(string(program))
+	for _, width := range []int{40, 80} {
+		want, err := ioutil.ReadFile(fmt.Sprintf("testdata/wide.%d.fmt", width))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		format(&buf, root, "", width)
+		buf.WriteString("\n")
+		if buf.String() != string(want) {
+			t.Errorf("width %d\nwant:\n%s\ngot:\n%s", width, want, buf.String())
+		}
+		for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+			if len(line) > width {
+				t.Errorf("width %d: line %d is too long: %q", width, i+1, line)
+			}
+		}
+		if formatted := parseString(buf.String()); !nodesEqual(formatted, root) {
+			t.Errorf("width %d: formatted program is different:\n%v\n%v", width, formatted, root)
+		}
+	}
+}
+
+func TestRunDumpAST(t *testing.T) {
+	defer func(ast bool) { *astFlag = ast }(*astFlag)
+	*astFlag = true
+	var stdout, stderr bytes.Buffer
+	code := run(&stdout, &stderr, "app lam x x 2", defaultEnvironment)
+	want := "App\n├─ Lam x\n│  └─ Ident x\n└─ Number 2\n"
+	if code != exitSuccess || stdout.String() != want || stderr.Len() != 0 {
+		t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitSuccess, want, "", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestDotGraph(t *testing.T) {
+	var buf bytes.Buffer
+	dotGraph(&buf, parseString("app (lam x x) 2"))
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph ast {\n") || !strings.HasSuffix(out, "}\n") {
+		t.Errorf("missing graph declaration:\n%s", out)
+	}
+	for _, want := range []string{
+		`n0 [label="App"];`,
+		`n1 [label="Lam x"];`,
+		`n2 [label="Ident x"];`,
+		`n3 [label="Number 2"];`,
+		`n0 -> n1 [label="fn"];`,
+		`n1 -> n2 [label="body"];`,
+		`n0 -> n3 [label="arg"];`,
+	} {
+		if !strings.Contains(out, "\t"+want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestDotGraphScope(t *testing.T) {
+	defer func(dot, labels bool) { *dotFlag, *dotLabelsFlag = dot, labels }(*dotFlag, *dotLabelsFlag)
+	*dotFlag, *dotLabelsFlag = true, true
+	var stdout, stderr bytes.Buffer
+	code := run(&stdout, &stderr, "def y 1 lam x app app x y z", defaultEnvironment)
+	out := stdout.String()
+	if code != exitSuccess || stderr.Len() != 0 {
+		t.Errorf("want: %d, %q\ngot: %d, %q", exitSuccess, "", code, stderr.String())
+	}
+	for _, want := range []string{
+		`n0 [label="Def y"];`,
+		`n1 [label="Number 1"];`,
+		`n2 [label="Lam x"];`,
+		`n5 [label="Ident x (bound)", color=blue];`,
+		`n6 [label="Ident y (bound)", color=blue];`,
+		`n7 [label="Ident z (free)", color=red];`,
+	} {
+		if !strings.Contains(out, "\t"+want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	var buf bytes.Buffer
+	dotGraphScope(&buf, parseString("lam x app x y"))
+	for _, want := range []string{
+		`n2 [label="Ident x (bound)", color=blue];`,
+		`n3 [label="Ident y (free)", color=red];`,
+	} {
+		if !strings.Contains(buf.String(), "\t"+want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunMainVersion(t *testing.T) {
+	defer func(v, eval string, given bool) {
+		version, evalFlag, evalGiven = v, eval, given
+	}(version, evalFlag, evalGiven)
+	defer func(flag bool) { *versionFlag = flag }(*versionFlag)
+	*versionFlag = true
+	version = "1.2.3"
+	// The version flag takes precedence over everything else, and no input
+	// is read.
+	evalFlag, evalGiven = "x", true
+	var stdout, stderr bytes.Buffer
+	code := runMain(strings.NewReader("app"), &stdout, &stderr, []string{"testdata/nonexistent.lam"})
+	want := "laminterp 1.2.3 (" + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + ")\n"
+	if code != exitSuccess || stdout.String() != want || stderr.Len() != 0 {
+		t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitSuccess, want, "", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestRunMainPrelude(t *testing.T) {
+	defer func(prelude, eval string, given bool) {
+		*preludeFlag, evalFlag, evalGiven = prelude, eval, given
+	}(*preludeFlag, evalFlag, evalGiven)
+	tests := []struct {
+		name, prelude string
+		code          int
+		stdout        string
+		stderr        string
+	}{
+		{"prelude", "testdata/prelude.lam", exitSuccess, "8\n", ""},
+		{"error in prelude", "testdata/badprelude.lam", exitRuntimeError, "",
+			"testdata/badprelude.lam: runtime error: add: not a number: 'true'\n"},
+		{"missing prelude", "testdata/nonexistent.lam", exitFailure, "",
+			"laminterp: open testdata/nonexistent.lam: no such file or directory\n"},
+	}
+	evalFlag, evalGiven = "app double four", true
+	for _, pt := range tests {
+		*preludeFlag = pt.prelude
+		var stdout, stderr bytes.Buffer
+		code := runMain(strings.NewReader(""), &stdout, &stderr, nil)
+		if code != pt.code || stdout.String() != pt.stdout || stderr.String() != pt.stderr {
+			t.Errorf("[%s]\nwant: %d, %q, %q\ngot: %d, %q, %q\n", pt.name, pt.code, pt.stdout, pt.stderr,
+				code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestRunMainBuiltins(t *testing.T) {
+	defer func(builtins, noBuiltin, eval string, given bool) {
+		*builtinsFlag, *noBuiltinFlag, evalFlag, evalGiven = builtins, noBuiltin, eval, given
+	}(*builtinsFlag, *noBuiltinFlag, evalFlag, evalGiven)
+	tests := []struct {
+		name, builtins, noBuiltin, program string
+		code                               int
+		stdout                             string
+		stderr                             string
+	}{
+		{"all", "", "", "app app gt 2 1", exitSuccess, "true\n", ""},
+		{"disabled", "", "gt", "app app gt 2 1", exitRuntimeError, "",
+			"runtime error: unknown identifier: 'gt'\n"},
+		{"others still available", "", "gt,lte", "app app add 2 1", exitSuccess, "3\n", ""},
+		{"only", "add, if", "", "app app app if true app app add 1 2 0", exitSuccess, "3\n", ""},
+		{"not in only", "add,if", "", "app app gt 2 1", exitRuntimeError, "",
+			"runtime error: unknown identifier: 'gt'\n"},
+		{"name used for a definition", "", "gt", "def gt 5 gt", exitSuccess, "5\n", ""},
+		{"unknown built-in", "", "gt,foo", "1", exitFailure, "", "laminterp: unknown built-in: 'foo'\n"},
+	}
+	for _, tt := range tests {
+		*builtinsFlag, *noBuiltinFlag, evalFlag, evalGiven = tt.builtins, tt.noBuiltin, tt.program, true
+		var stdout, stderr bytes.Buffer
+		code := runMain(strings.NewReader(""), &stdout, &stderr, nil)
+		if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+			t.Errorf("[%s]\nwant: %d, %q, %q\ngot: %d, %q, %q\n", tt.name, tt.code, tt.stdout, tt.stderr,
+				code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestRunLines(t *testing.T) {
+	input := "app app add 1 2\n" +
+		"\n" +
+		"  # a comment\n" +
+		"def x 5\n" +
+		"app app add x\n" +
+		"app app gt x 1\n" +
+		"y\n" +
+		"  app app add x x  \n"
+	want := "3\n" +
+		"5\n" +
+		"line 5: parse error: expecting expression; got EOF\n" +
+		"true\n" +
+		"line 7: runtime error: unknown identifier: 'y'\n" +
+		"10\n"
+	var stdout, stderr bytes.Buffer
+	code := runLines(strings.NewReader(input), &stdout, &stderr, defaultEnvironment)
+	if code != exitParseError || stdout.String() != want || stderr.Len() != 0 {
+		t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitParseError, want, "", code, stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	if code := runLines(strings.NewReader("1\n\ntrue"), &stdout, &stderr, defaultEnvironment); code != exitSuccess || stdout.String() != "1\ntrue\n" {
+		t.Errorf("want: %d, %q\ngot: %d, %q\n", exitSuccess, "1\ntrue\n", code, stdout.String())
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	// Each value should be written before the next input is, so the test
+	// waits for it after writing each piece of input.
+	steps := []struct {
+		input, want string
+	}{
+		{"def x\n", ""},
+		{"5 app app add x\n", "5\n"},
+		{"1\n", "6\n"},
+		{"app app gt x 1 y\n", "true\nruntime error: unknown identifier: 'y'\n"},
+		{") 2\n", "parse error: expecting expression; got ')'\n"},
+		{"(app (lam y y)\n_) \"a\n", "runtime error: unknown identifier: '_'\n"},
+		{"b\"\n", "a\nb\n"},
+	}
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan int)
+	go func() {
+		var stderr bytes.Buffer
+		code := runStream(inR, outW, &stderr, defaultEnvironment)
+		outW.Close()
+		done <- code
+	}()
+	out := bufio.NewReader(outR)
+	for _, step := range steps {
+		if _, err := io.WriteString(inW, step.input); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(step.want))
+		if _, err := io.ReadFull(out, got); err != nil {
+			t.Fatalf("input: %q\nerror reading output: %v", step.input, err)
+		}
+		if string(got) != step.want {
+			// The rest of the output can't be lined up with the
+			// input anymore.
+			t.Fatalf("input: %q\nwant: %q\ngot: %q", step.input, step.want, got)
+		}
+	}
+	inW.Close()
+	if rest, _ := ioutil.ReadAll(out); len(rest) != 0 {
+		t.Errorf("unexpected output: %q", rest)
+	}
+	if code := <-done; code != exitRuntimeError {
+		t.Errorf("want: %d\ngot: %d", exitRuntimeError, code)
+	}
+}
+
+func TestSexpr(t *testing.T) {
+	tests := []struct {
+		root *node
+		want string
+	}{
+		{mknum(-5), "-5"},
+		{mkident("x"), "x"},
+		{&node{nodeBool, true}, "true"},
+		{&node{nodeString, "a\"b\n"}, `"a\"b\n"`},
+		{mkapp(mkapp(mkident("add"), mknum(1)), mknum(3)), "(app (app add 1) 3)"},
+		{mklam("x", mkapp(mkident("f"), mkident("x"))), "(lam x (app f x))"},
+		{mkdef("x", mknum(1), nil), "(def x 1)"},
+		{mkdef("x", mknum(1), mkdef("y", mkident("x"), mkident("y"))), "(def x 1 (def y x y))"},
+		{mkwhen(mkident("b"), mkwhen(mkident("c"), mknum(1), true), false), "(when b (unless c 1))"},
+		{mkletrec("f", mklam("x", mkident("x")), mkident("f")), "(letrec f (lam x x) f)"},
+		{errorNodef("bad number: '1x'"), `(error "bad number: '1x'")`},
+		{newExpectError(syntaxExpression, token{typ: tokenEOF}), `(error "expecting expression; got EOF")`},
+	}
+	for _, tt := range tests {
+		if got := sexpr(tt.root); got != tt.want {
+			t.Errorf("%v\nwant: %s\ngot: %s", tt.root, tt.want, got)
+		}
+	}
+	// Every tree in parseTests should be written the same way as the tree
+	// that's actually parsed from its input.
+	for _, pt := range parseTests {
+		if want, got := sexpr(pt.root), sexpr(parseString(pt.input)); got != want {
+			t.Errorf("[%s]\ninput: %q\nwant: %s\ngot: %s", pt.name, pt.input, want, got)
+		}
+	}
+}
+
+func TestRunSexpr(t *testing.T) {
+	defer func(sexpr bool) { *sexprFlag = sexpr }(*sexprFlag)
+	*sexprFlag = true
+	var stdout, stderr bytes.Buffer
+	code := run(&stdout, &stderr, "app lam x x \\y. 2", defaultEnvironment)
+	want := "(app (lam x x) (lam y 2))\n"
+	if code != exitSuccess || stdout.String() != want || stderr.Len() != 0 {
+		t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitSuccess, want, "", code, stdout.String(), stderr.String())
+	}
+}
+
+func TestRunBase(t *testing.T) {
+	defer func(base int) { *baseFlag = base }(*baseFlag)
+	*baseFlag = 16
+	tests := []struct {
+		program string
+		code    int
+		stdout  string
+		stderr  string
+	}{
+		{"app app add 250 5", exitSuccess, "ff\n", ""},
+		{"app app shr 1 -20", exitRuntimeError, "", "runtime error: shr: negative shift count: '-20'\n"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run(&stdout, &stderr, tt.program, defaultEnvironment)
+		if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+			t.Errorf("program: %q\nwant: %d, %q, %q\ngot: %d, %q, %q", tt.program,
+				tt.code, tt.stdout, tt.stderr, code, stdout.String(), stderr.String())
+		}
+	}
+	for _, base := range []int{2, 8, 10, 16} {
+		if !supportedBase(base) {
+			t.Errorf("base %d isn't supported", base)
+		}
+	}
+	for _, base := range []int{0, 1, 3, 36} {
+		if supportedBase(base) {
+			t.Errorf("base %d is supported", base)
+		}
+	}
+}
+
+func TestRunJSON(t *testing.T) {
+	defer func(json bool) { *jsonFlag = json }(*jsonFlag)
+	*jsonFlag = true
+	tests := []struct {
+		program string
+		code    int
+		stdout  string
+	}{
+		{"app app add 1 2", exitSuccess, `{"type":"number","value":"3"}` + "\n"},
+		{"app add true", exitRuntimeError, `{"type":"error","message":"add: not a number: 'true'"}` + "\n"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run(&stdout, &stderr, tt.program, defaultEnvironment)
+		if code != tt.code || stdout.String() != tt.stdout || stderr.Len() != 0 {
+			t.Errorf("%s\nwant: %d, %q, %q\ngot: %d, %q, %q\n",
+				tt.program, tt.code, tt.stdout, "", code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestRunStacktrace(t *testing.T) {
+	defer func(trace bool) { *traceFlag = trace }(*traceFlag)
+	*traceFlag = true
+	var stdout, stderr bytes.Buffer
+	program := "def f lam x app app add x true app app add 1 app f 123456789012345678901234567890123456789012345678901234567890"
+	code := run(&stdout, &stderr, program, defaultEnvironment)
+	want := "runtime error: add: not a number: 'true'\n" +
+		"    in (app (app add x) true)\n" +
+		"    in (app f 12345678901234567890123456789012345678901234567890...\n" +
+		"    in (app (app add 1) (app f 123456789012345678901234567890123...\n"
+	if code != exitRuntimeError || stdout.Len() != 0 || stderr.String() != want {
+		t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitRuntimeError, "", want, code, stdout.String(), stderr.String())
+	}
+}
+
+func TestRunMaxSteps(t *testing.T) {
+	defer func(maxSteps int) { *maxStepsFlag = maxSteps }(*maxStepsFlag)
+	*maxStepsFlag = 1000
+	var stdout, stderr bytes.Buffer
+	code := run(&stdout, &stderr, "app (lam x app x x) (lam x app x x)", defaultEnvironment)
+	want := "runtime error: evaluation exceeded step budget\n"
+	if code != exitRuntimeError || stdout.Len() != 0 || stderr.String() != want {
+		t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitRuntimeError, "", want, code, stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	if code := run(&stdout, &stderr, "app app add 1 2", defaultEnvironment); code != exitSuccess || stdout.String() != "3\n" {
+		t.Errorf("want: %d, %q\ngot: %d, %q\n", exitSuccess, "3\n", code, stdout.String())
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	defer func(check bool, eval string, given bool) {
+		*checkFlag, evalFlag, evalGiven = check, eval, given
+	}(*checkFlag, evalFlag, evalGiven)
+	*checkFlag = true
+	tests := []struct {
+		name   string
+		eval   string
+		args   []string
+		stdin  string
+		code   int
+		stderr string
+	}{
+		{"valid", "def double lam x app app add x x app double 2", nil, "", exitSuccess, ""},
+		{"valid stdin", "", nil, "app lam x x 1", exitSuccess, ""},
+		{"parse error", "app app add 1", nil, "", exitParseError, "parse error: expecting expression; got EOF\n"},
+		{"unknown identifier", "", nil, "lam x app app add x y", exitParseError,
+			"scope error: unknown identifier: 'y'\n"},
+		{"several unknown identifiers", "app app f (lam x x) app f y", nil, "", exitParseError,
+			"scope error: unknown identifier: 'f'\nscope error: unknown identifier: 'y'\n"},
+		{"definition used in its own value", "def f lam x app f x app f 1", nil, "", exitParseError,
+			"scope error: unknown identifier: 'f'\n"},
+		{"runtime error isn't reported", "app add true", nil, "", exitSuccess, ""},
+		{"non-terminating program isn't evaluated", "app (lam x app x x) (lam x app x x)", nil, "", exitSuccess, ""},
+		{"files", "", []string{"testdata/prelude.lam", "testdata/main.lam"}, "", exitSuccess, ""},
+		{"file without definitions", "", []string{"testdata/main.lam"}, "", exitParseError,
+			"scope error: unknown identifier: 'double'\nscope error: unknown identifier: 'four'\n"},
+	}
+	for _, ct := range tests {
+		evalFlag, evalGiven = ct.eval, ct.eval != ""
+		var stdout, stderr bytes.Buffer
+		code := runMain(strings.NewReader(ct.stdin), &stdout, &stderr, ct.args)
+		if code != ct.code || stdout.Len() != 0 || stderr.String() != ct.stderr {
+			t.Errorf("[%s]\nwant: %d, %q, %q\ngot: %d, %q, %q\n", ct.name, ct.code, "", ct.stderr,
+				code, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestRunCheckLines(t *testing.T) {
+	defer func(check, lines, stream bool) {
+		*checkFlag, *linesFlag, *streamFlag = check, lines, stream
+	}(*checkFlag, *linesFlag, *streamFlag)
+	*checkFlag = true
+	want := "laminterp: -check can't be used with -lines or -stream\n"
+	for _, mode := range []*bool{linesFlag, streamFlag} {
+		*linesFlag, *streamFlag = false, false
+		*mode = true
+		var stdout, stderr bytes.Buffer
+		code := runMain(strings.NewReader("app print 1\nzz\n"), &stdout, &stderr, nil)
+		if code != exitFailure || stdout.Len() != 0 || stderr.String() != want {
+			t.Errorf("want: %d, %q, %q\ngot: %d, %q, %q\n", exitFailure, "", want, code, stdout.String(), stderr.String())
+		}
+	}
+}
@@ -4,9 +4,9 @@ package main
 
 import "strconv"
 
-const _nodeType_name = "nodeErrornodeAppnodeLamnodeIdentifiernodeNumbernodeBool"
+const _nodeType_name = "nodeErrornodeAppnodeLamnodeIdentifiernodeNumbernodeBoolnodeDefnodeStringnodeWhennodeLetrecnodeSeq"
 
-var _nodeType_index = [...]uint8{0, 9, 16, 23, 37, 47, 55}
+var _nodeType_index = [...]uint8{0, 9, 16, 23, 37, 47, 55, 62, 72, 80, 90, 97}
 
 func (i nodeType) String() string {
 	if i < 0 || i >= nodeType(len(_nodeType_index)-1) {
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// pureBuiltins contains the built-in functions and values whose results depend
+// only on their arguments, which makes it safe to evaluate them ahead of time.
+var pureBuiltins = map[*object]bool{
+	builtinAdd:     true,
+	builtinIf:      true,
+	builtinGt:      true,
+	builtinGte:     true,
+	builtinLte:     true,
+	builtinBand:    true,
+	builtinBor:     true,
+	builtinBxor:    true,
+	builtinShl:     true,
+	builtinShr:     true,
+	builtinCmp:     true,
+	builtinIsnum:   true,
+	builtinIsbool:  true,
+	builtinTypeof:  true,
+	builtinIsqrt:   true,
+	builtinNeg:     true,
+	builtinMin:     true,
+	builtinMax:     true,
+	builtinPow:     true,
+	builtinFact:    true,
+	builtinConcat:  true,
+	builtinStrlen:  true,
+	nilObject:      true,
+	builtinCons:    true,
+	builtinHead:    true,
+	builtinTail:    true,
+	builtinIsnil:   true,
+	builtinID:      true,
+	builtinConst:   true,
+	builtinCompose: true,
+	builtinApply:   true,
+	builtinCurry:   true,
+	builtinUncurry: true,
+	builtinFold:    true,
+	builtinMap:     true,
+	builtinPair:    true,
+	builtinFst:     true,
+	builtinSnd:     true,
+}
+
+// fold returns a copy of the tree rooted at n in which each application of pure
+// built-in functions to literals has been replaced by the literal it evaluates
+// to, e.g. "app app add 1 2" becomes "3". Identifiers which aren't bound within
+// the tree are assumed to refer to the default environment. Applications which
+// result in an error or a value that can't be written as a literal, such as a
+// function, are left as they are.
+func fold(n *node) *node {
+	return foldBound(n, make(map[string]int))
+}
+
+// foldBound is like fold, but it also takes the number of enclosing bindings of
+// each name so that identifiers which refer to them aren't mistaken for
+// built-in functions.
+func foldBound(n *node, bound map[string]int) *node {
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		n = &node{nodeApp, &appNode{foldBound(app.fn, bound), foldBound(app.arg, bound)}}
+		if !isConstant(n, bound) {
+			return n
+		}
+		if lit := literalNode(evalEnv(n, defaultEnvironment)); lit != nil {
+			return lit
+		}
+		return n
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		bound[lam.param]++
+		body := foldBound(lam.body, bound)
+		bound[lam.param]--
+		return &node{nodeLam, &lamNode{lam.param, body}}
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return &node{nodeWhen, &whenNode{foldBound(when.test, bound), foldBound(when.body, bound), when.unless}}
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return &node{nodeSeq, &seqNode{foldBound(seq.first, bound), foldBound(seq.second, bound)}}
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		bound[letrec.name]++
+		l := &letrecNode{letrec.name, foldBound(letrec.val, bound), foldBound(letrec.body, bound)}
+		bound[letrec.name]--
+		return &node{nodeLetrec, l}
+	case nodeDef:
+		def := n.val.(*defNode)
+		d := &defNode{name: def.name, val: foldBound(def.val, bound)}
+		if def.body != nil {
+			bound[def.name]++
+			d.body = foldBound(def.body, bound)
+			bound[def.name]--
+		}
+		return &node{nodeDef, d}
+	default:
+		return n
+	}
+}
+
+// isConstant returns true if n consists only of literals and applications of
+// pure built-in functions.
+func isConstant(n *node, bound map[string]int) bool {
+	switch n.typ {
+	case nodeNumber, nodeBool, nodeString:
+		return true
+	case nodeIdentifier:
+		name := n.val.(string)
+		return bound[name] == 0 && pureBuiltins[defaultEnvironment.lookup(name)]
+	case nodeApp:
+		app := n.val.(*appNode)
+		return isConstant(app.fn, bound) && isConstant(app.arg, bound)
+	default:
+		return false
+	}
+}
+
+// literalNode returns a literal node representing the given object, or nil if
+// the object can't be written as a literal.
+func literalNode(obj *object) *node {
+	switch obj.typ {
+	case objectNumber:
+		return &node{nodeNumber, obj.val}
+	case objectBool:
+		return &node{nodeBool, obj.val}
+	case objectString:
+		return &node{nodeString, obj.val}
+	default:
+		return nil
+	}
+}
+
+// occursFree returns true if the identifier name occurs free in n, that is,
+// somewhere that isn't within a lambda function or definition which binds the
+// same name.
+func occursFree(name string, n *node) bool {
+	switch n.typ {
+	case nodeIdentifier:
+		return n.val.(string) == name
+	case nodeApp:
+		app := n.val.(*appNode)
+		return occursFree(name, app.fn) || occursFree(name, app.arg)
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		return lam.param != name && occursFree(name, lam.body)
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return occursFree(name, when.test) || occursFree(name, when.body)
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return occursFree(name, seq.first) || occursFree(name, seq.second)
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		return letrec.name != name && (occursFree(name, letrec.val) || occursFree(name, letrec.body))
+	case nodeDef:
+		def := n.val.(*defNode)
+		if occursFree(name, def.val) {
+			return true
+		}
+		return def.body != nil && def.name != name && occursFree(name, def.body)
+	default:
+		return false
+	}
+}
+
+// countFree returns the number of times the identifier name occurs free in n.
+// See occursFree.
+func countFree(name string, n *node) int {
+	switch n.typ {
+	case nodeIdentifier:
+		if n.val.(string) == name {
+			return 1
+		}
+		return 0
+	case nodeApp:
+		app := n.val.(*appNode)
+		return countFree(name, app.fn) + countFree(name, app.arg)
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		if lam.param == name {
+			return 0
+		}
+		return countFree(name, lam.body)
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return countFree(name, when.test) + countFree(name, when.body)
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return countFree(name, seq.first) + countFree(name, seq.second)
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		if letrec.name == name {
+			return 0
+		}
+		return countFree(name, letrec.val) + countFree(name, letrec.body)
+	case nodeDef:
+		def := n.val.(*defNode)
+		count := countFree(name, def.val)
+		if def.body != nil && def.name != name {
+			count += countFree(name, def.body)
+		}
+		return count
+	default:
+		return 0
+	}
+}
+
+// inlineDefs returns a copy of the tree rooted at n in which each definition
+// that's used only once in the rest of the program has been removed and its
+// value substituted for the use, e.g. "def f lam x x app f 1" becomes
+// "app lam x x 1", and each definition that isn't used at all has been removed.
+// Only definitions whose values can't fail or have side effects when they're
+// evaluated are changed, since their values may end up being evaluated later
+// than before, or not at all; those are literals, lambda functions, and
+// identifiers which refer to earlier definitions or the default environment.
+// The last definition in a program is always kept, since it's the program's
+// value.
+func inlineDefs(n *node) *node {
+	return inlineDefsBound(n, make(map[string]int))
+}
+
+// inlineDefsBound is like inlineDefs, but it also takes the number of earlier
+// definitions of each name, which are used to tell whether identifiers are
+// bound.
+func inlineDefsBound(n *node, bound map[string]int) *node {
+	if n.typ != nodeDef {
+		return n
+	}
+	def := n.val.(*defNode)
+	if def.body == nil {
+		return n
+	}
+	bound[def.name]++
+	body := inlineDefsBound(def.body, bound)
+	bound[def.name]--
+	if isSafeValue(def.val, bound) {
+		switch countFree(def.name, body) {
+		case 0:
+			return body
+		case 1:
+			return substitute(body, def.name, def.val)
+		}
+	}
+	return &node{nodeDef, &defNode{def.name, def.val, body}}
+}
+
+// isSafeValue returns true if evaluating n can't fail or have side effects, and
+// doesn't do any work beyond looking up an identifier.
+func isSafeValue(n *node, bound map[string]int) bool {
+	switch n.typ {
+	case nodeNumber, nodeBool, nodeString, nodeLam:
+		return true
+	case nodeIdentifier:
+		name := n.val.(string)
+		return bound[name] > 0 || defaultEnvironment.lookup(name).typ != objectError
+	default:
+		return false
+	}
+}
+
+// etaReduce returns a copy of the tree rooted at n in which each lambda function
+// of the form "lam x app f x" has been replaced by f, provided that x doesn't
+// occur free in f. Since evaluation is strict, f is evaluated when it replaces
+// the lambda function instead of each time that it's called, so it's only
+// replaced if that can't make a difference: if it's a literal, a lambda
+// function, or an identifier other than the name of an enclosing letrec
+// expression or definition whose value is being evaluated, as in
+// "letrec f lam x app f x 1".
+func etaReduce(n *node) *node {
+	return etaReduceDefining(n, make(map[string]int))
+}
+
+// etaReduceDefining is like etaReduce, but it also takes the number of
+// enclosing letrec expressions and definitions whose values n is part of for
+// each name.
+func etaReduceDefining(n *node, defining map[string]int) *node {
+	reduce := func(n *node) *node { return etaReduceDefining(n, defining) }
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		return &node{nodeApp, &appNode{reduce(app.fn), reduce(app.arg)}}
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		// The parameter shadows any enclosing letrec or definition.
+		shadowed := defining[lam.param]
+		delete(defining, lam.param)
+		body := reduce(lam.body)
+		if shadowed > 0 {
+			defining[lam.param] = shadowed
+		}
+		if body.typ == nodeApp {
+			app := body.val.(*appNode)
+			isParam := app.arg.typ == nodeIdentifier && app.arg.val.(string) == lam.param
+			if isParam && !occursFree(lam.param, app.fn) && isDelayable(app.fn, defining) {
+				return app.fn
+			}
+		}
+		return &node{nodeLam, &lamNode{lam.param, body}}
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return &node{nodeWhen, &whenNode{reduce(when.test), reduce(when.body), when.unless}}
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return &node{nodeSeq, &seqNode{reduce(seq.first), reduce(seq.second)}}
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		defining[letrec.name]++
+		val := reduce(letrec.val)
+		defining[letrec.name]--
+		return &node{nodeLetrec, &letrecNode{letrec.name, val, reduce(letrec.body)}}
+	case nodeDef:
+		def := n.val.(*defNode)
+		defining[def.name]++
+		d := &defNode{name: def.name, val: reduce(def.val)}
+		defining[def.name]--
+		if def.body != nil {
+			d.body = reduce(def.body)
+		}
+		return &node{nodeDef, d}
+	default:
+		return n
+	}
+}
+
+// isDelayable returns true if evaluating n gives the same result, without any
+// side effects, as evaluating it later, when the letrec expressions and
+// definitions counted in defining have been evaluated. See etaReduce.
+func isDelayable(n *node, defining map[string]int) bool {
+	switch n.typ {
+	case nodeNumber, nodeBool, nodeString, nodeLam:
+		return true
+	case nodeIdentifier:
+		return defining[n.val.(string)] == 0
+	default:
+		return false
+	}
+}
+
+// maxReduceSteps is the number of beta reductions that equivalent performs on
+// each term before giving up on finding its normal form.
+const maxReduceSteps = 1000
+
+// reduce returns the normal form of the tree rooted at n, which is found by
+// repeatedly applying lambda functions to their arguments by substitution,
+// starting with the leftmost, outermost application. A definition is treated
+// like an application of a lambda function to the definition's value, and so is
+// a letrec expression whose value doesn't refer to itself; recursive ones are
+// only reduced within, since unfolding them might never end. Other
+// identifiers are left as they are, including built-in functions, which aren't
+// evaluated. If the normal form isn't reached within maxSteps reductions,
+// perhaps because there isn't one, the partly reduced tree is returned along
+// with false.
+func reduce(n *node, maxSteps int) (*node, bool) {
+	for i := 0; i < maxSteps; i++ {
+		next, ok := reduceStep(n)
+		if !ok {
+			return n, true
+		}
+		n = next
+	}
+	_, ok := reduceStep(n)
+	return n, !ok
+}
+
+// reduceStep performs the leftmost, outermost reduction in the tree rooted at
+// n. It returns the resulting tree, or n and false if there was nothing to
+// reduce.
+func reduceStep(n *node) (*node, bool) {
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		if app.fn.typ == nodeLam {
+			lam := app.fn.val.(*lamNode)
+			return substitute(lam.body, lam.param, app.arg), true
+		}
+		if fn, ok := reduceStep(app.fn); ok {
+			return &node{nodeApp, &appNode{fn, app.arg}}, true
+		}
+		if arg, ok := reduceStep(app.arg); ok {
+			return &node{nodeApp, &appNode{app.fn, arg}}, true
+		}
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		if body, ok := reduceStep(lam.body); ok {
+			return &node{nodeLam, &lamNode{lam.param, body}}, true
+		}
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		if test, ok := reduceStep(when.test); ok {
+			return &node{nodeWhen, &whenNode{test, when.body, when.unless}}, true
+		}
+		if body, ok := reduceStep(when.body); ok {
+			return &node{nodeWhen, &whenNode{when.test, body, when.unless}}, true
+		}
+	case nodeSeq:
+		// The first expression is kept even if it's a value, since it
+		// might be evaluated for its effect.
+		seq := n.val.(*seqNode)
+		if first, ok := reduceStep(seq.first); ok {
+			return &node{nodeSeq, &seqNode{first, seq.second}}, true
+		}
+		if second, ok := reduceStep(seq.second); ok {
+			return &node{nodeSeq, &seqNode{seq.first, second}}, true
+		}
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		if !occursFree(letrec.name, letrec.val) {
+			return substitute(letrec.body, letrec.name, letrec.val), true
+		}
+		if val, ok := reduceStep(letrec.val); ok {
+			return &node{nodeLetrec, &letrecNode{letrec.name, val, letrec.body}}, true
+		}
+		if body, ok := reduceStep(letrec.body); ok {
+			return &node{nodeLetrec, &letrecNode{letrec.name, letrec.val, body}}, true
+		}
+	case nodeDef:
+		def := n.val.(*defNode)
+		if def.body == nil {
+			return def.val, true
+		}
+		return substitute(def.body, def.name, def.val), true
+	}
+	return n, false
+}
+
+// substitute returns a copy of the tree rooted at n in which each free
+// occurrence of the identifier name has been replaced by val. Lambda parameters
+// and definitions which would capture a free identifier in val are renamed.
+func substitute(n *node, name string, val *node) *node {
+	switch n.typ {
+	case nodeIdentifier:
+		if n.val.(string) == name {
+			return val
+		}
+		return n
+	case nodeApp:
+		app := n.val.(*appNode)
+		return &node{nodeApp, &appNode{substitute(app.fn, name, val), substitute(app.arg, name, val)}}
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		if lam.param == name {
+			return n
+		}
+		param, body := avoidCapture(lam.param, lam.body, name, val)
+		return &node{nodeLam, &lamNode{param, substitute(body, name, val)}}
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return &node{nodeWhen, &whenNode{substitute(when.test, name, val), substitute(when.body, name, val), when.unless}}
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return &node{nodeSeq, &seqNode{substitute(seq.first, name, val), substitute(seq.second, name, val)}}
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		if letrec.name == name {
+			return n
+		}
+		// The name is bound in both the value and the body, so they're
+		// renamed together.
+		recName, scope := avoidCapture(letrec.name, letrecScope(letrec), name, val)
+		app := substitute(scope, name, val).val.(*appNode)
+		return &node{nodeLetrec, &letrecNode{recName, app.fn, app.arg}}
+	case nodeDef:
+		def := n.val.(*defNode)
+		d := &defNode{name: def.name, val: substitute(def.val, name, val)}
+		if def.body != nil {
+			if def.name == name {
+				d.body = def.body
+			} else {
+				d.name, d.body = avoidCapture(def.name, def.body, name, val)
+				d.body = substitute(d.body, name, val)
+			}
+		}
+		return &node{nodeDef, d}
+	default:
+		return n
+	}
+}
+
+// avoidCapture returns the name of a binding and the body it's bound within,
+// renaming the binding if substituting val for name in the body would cause it
+// to capture a free identifier in val. The new name consists of the old one
+// followed by a number.
+func avoidCapture(binding string, body *node, name string, val *node) (string, *node) {
+	if !occursFree(binding, val) || !occursFree(name, body) {
+		return binding, body
+	}
+	for i := 1; ; i++ {
+		fresh := fmt.Sprintf("%s%d", binding, i)
+		if !occursFree(fresh, val) && !occursFree(fresh, body) {
+			return fresh, substitute(body, binding, &node{nodeIdentifier, fresh})
+		}
+	}
+}
+
+// letrecScope returns an app node whose function and argument are the value and
+// body of a letrec expression, so that they can be treated as a single tree
+// within which the letrec's name is bound.
+func letrecScope(letrec *letrecNode) *node {
+	return &node{nodeApp, &appNode{letrec.val, letrec.body}}
+}
+
+// alphaEquivalent returns true if the trees rooted at a and b are the same
+// except for the names of their lambda parameters and definitions, e.g.
+// "lam x x" and "lam y y".
+func alphaEquivalent(a, b *node) bool {
+	var equal func(a, b *node, depth int) bool
+	aBound := make(map[string]int)
+	bBound := make(map[string]int)
+	// bind records that the given names are bound at depth while checking that
+	// the bodies are equal.
+	bind := func(aName, bName string, aBody, bBody *node, depth int) bool {
+		aOld, bOld := aBound[aName], bBound[bName]
+		aBound[aName], bBound[bName] = depth, depth
+		eq := equal(aBody, bBody, depth+1)
+		aBound[aName], bBound[bName] = aOld, bOld
+		return eq
+	}
+	equal = func(a, b *node, depth int) bool {
+		if a.typ != b.typ {
+			return false
+		}
+		switch a.typ {
+		case nodeIdentifier:
+			aName, bName := a.val.(string), b.val.(string)
+			aDepth, bDepth := aBound[aName], bBound[bName]
+			if aDepth == 0 && bDepth == 0 {
+				return aName == bName
+			}
+			return aDepth == bDepth
+		case nodeNumber:
+			return a.val.(*big.Int).Cmp(b.val.(*big.Int)) == 0
+		case nodeBool, nodeString:
+			return a.val == b.val
+		case nodeApp:
+			aApp, bApp := a.val.(*appNode), b.val.(*appNode)
+			return equal(aApp.fn, bApp.fn, depth) && equal(aApp.arg, bApp.arg, depth)
+		case nodeLam:
+			aLam, bLam := a.val.(*lamNode), b.val.(*lamNode)
+			return bind(aLam.param, bLam.param, aLam.body, bLam.body, depth)
+		case nodeWhen:
+			aWhen, bWhen := a.val.(*whenNode), b.val.(*whenNode)
+			return aWhen.unless == bWhen.unless && equal(aWhen.test, bWhen.test, depth) && equal(aWhen.body, bWhen.body, depth)
+		case nodeSeq:
+			aSeq, bSeq := a.val.(*seqNode), b.val.(*seqNode)
+			return equal(aSeq.first, bSeq.first, depth) && equal(aSeq.second, bSeq.second, depth)
+		case nodeLetrec:
+			aLetrec, bLetrec := a.val.(*letrecNode), b.val.(*letrecNode)
+			return bind(aLetrec.name, bLetrec.name, letrecScope(aLetrec), letrecScope(bLetrec), depth)
+		case nodeDef:
+			aDef, bDef := a.val.(*defNode), b.val.(*defNode)
+			if !equal(aDef.val, bDef.val, depth) || (aDef.body == nil) != (bDef.body == nil) {
+				return false
+			}
+			return aDef.body == nil || bind(aDef.name, bDef.name, aDef.body, bDef.body, depth)
+		default:
+			return false
+		}
+	}
+	return equal(a, b, 1)
+}
+
+// equivalent returns true if a and b are beta-eta equivalent, that is, if they
+// have the same normal form up to eta reduction and the names of their lambda
+// parameters. Free identifiers, including built-in functions, are treated as
+// unknown values, so "app app add 1 2" isn't equivalent to "3". If either term
+// doesn't reach its normal form within maxReduceSteps reductions, it returns
+// false, since it can't tell whether the terms are equivalent.
+func equivalent(a, b *node) bool {
+	a, ok := reduce(a, maxReduceSteps)
+	if !ok {
+		return false
+	}
+	b, ok = reduce(b, maxReduceSteps)
+	if !ok {
+		return false
+	}
+	return alphaEquivalent(etaReduce(a), etaReduce(b))
+}
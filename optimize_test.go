@@ -0,0 +1,216 @@
+package main
+
+import "testing"
+
+type optimizeTest struct {
+	name   string
+	input  string
+	output string
+}
+
+var foldTests = []optimizeTest{
+	{"literal", "1", "1"},
+	{"add", "app app add 1 2", "3"},
+	{"nested", "app app add (app app add 1 2) (app isqrt 16)", "7"},
+	{"bool result", "app app gt 2 1", "true"},
+	{"string result", `app app concat "a" "b"`, `"ab"`},
+	{"if", "app app app if (app app gt 1 2) 3 4", "4"},
+	{"list head", "app head app app cons 1 nil", "1"},
+	{"free variable", "app app add x 2", "app app add x 2"},
+	{"free variable in argument", "app app add 1 app app add x 2", "app app add 1 app app add x 2"},
+	{"partial application", "app add 1", "app add 1"},
+	{"list result", "app app cons 1 nil", "app app cons 1 nil"},
+	{"error", "app isqrt -1", "app isqrt -1"},
+	{"error in argument", "app app add 1 app app pow 2 -1", "app app add 1 app app pow 2 -1"},
+	{"inside lam", "lam x app app add x app app add 1 2", "lam x app app add x 3"},
+	{"lam applied to constant", "app lam x x 1", "app lam x x 1"},
+	{"shadowed builtin", "lam add app app add 1 2", "lam add app app add 1 2"},
+	{"builtin after shadowing lam", "app lam add add app app add 1 2", "app lam add add 3"},
+	{"def", "def x app app add 1 2 app app add x 1", "def x 3 app app add x 1"},
+	{"shadowing def", "def add gt app app add 1 2", "def add gt app app add 1 2"},
+}
+
+func TestFold(t *testing.T) {
+	for _, ot := range foldTests {
+		root := parseString(ot.input)
+		got := fold(root)
+		if want := parseString(ot.output); !nodesEqual(got, want) {
+			t.Errorf("[%s]\ninput: %q\nwant: %v\ngot: %v\n", ot.name, ot.input, want, got)
+		}
+		if !nodesEqual(root, parseString(ot.input)) {
+			t.Errorf("[%s]\ninput: %q\ninput tree was modified: %v\n", ot.name, ot.input, root)
+		}
+	}
+}
+
+var etaReduceTests = []optimizeTest{
+	{"identifier", "x", "x"},
+	{"builtin", "lam x app add x", "add"},
+	{"partial application", "lam x app app add 1 x", "lam x app app add 1 x"},
+	{"self-application", "lam x app x x", "lam x app x x"},
+	{"parameter in function", "lam x app (app add x) x", "lam x app (app add x) x"},
+	{"parameter bound in function", "lam x app (lam x x) x", "lam x x"},
+	{"argument isn't the parameter", "lam x app f y", "lam x app f y"},
+	{"body isn't an app", "lam x x", "lam x x"},
+	{"nested", "lam y app (lam x app f x) y", "f"},
+	{"inside app", "app (lam x app f x) 1", "app f 1"},
+	{"def", "def g lam x app f x app g 1", "def g f app g 1"},
+	{"def refers to itself", "def f lam x app f x f", "def f lam x app f x f"},
+	{"letrec", "letrec f lam x app f x 1", "letrec f lam x app f x 1"},
+	{"letrec body", "letrec f lam n n lam x app f x", "letrec f lam n n f"},
+	{"letrec name shadowed", "letrec f lam f lam x app f x 1", "letrec f lam f f 1"},
+	{"side effect", "lam x app (app print 1) x", "lam x app (app print 1) x"},
+}
+
+func TestEtaReduce(t *testing.T) {
+	for _, ot := range etaReduceTests {
+		root := parseString(ot.input)
+		got := etaReduce(root)
+		if want := parseString(ot.output); !nodesEqual(got, want) {
+			t.Errorf("[%s]\ninput: %q\nwant: %v\ngot: %v\n", ot.name, ot.input, want, got)
+		}
+		if !nodesEqual(root, parseString(ot.input)) {
+			t.Errorf("[%s]\ninput: %q\ninput tree was modified: %v\n", ot.name, ot.input, root)
+		}
+	}
+}
+
+func TestOccursFree(t *testing.T) {
+	tests := []struct {
+		input string
+		free  bool
+	}{
+		{"x", true},
+		{"y", false},
+		{"app f x", true},
+		{"lam x x", false},
+		{"lam y x", true},
+		{"app (lam x x) x", true},
+		{"def x 1 x", false},
+		{"def y x y", true},
+		{"def x x", true},
+	}
+	for _, tt := range tests {
+		if got := occursFree("x", parseString(tt.input)); got != tt.free {
+			t.Errorf("input: %q\nwant: %v\ngot: %v\n", tt.input, tt.free, got)
+		}
+	}
+}
+
+var inlineDefsTests = []optimizeTest{
+	{"single use", "def x 1 app f x", "app f 1"},
+	{"single use of lambda", "def f lam x x app f 1", "app (lam x x) 1"},
+	{"twice used", "def x 1 app app add x x", "def x 1 app app add x x"},
+	{"unused", "def x 1 app f 2", "app f 2"},
+	{"last definition", "def x 1", "def x 1"},
+	{"chain", "def x 1 def y x app f y", "app f 1"},
+	{"used twice by later definition", "def x 1 def y app app add x x app f y", "def x 1 def y app app add x x app f y"},
+	{"used once by later definition", "def x 1 def y app g x app f y", "def y app g 1 app f y"},
+	{"application", "def x app f 1 app g x", "def x app f 1 app g x"},
+	{"unused application", "def x app print 1 2", "def x app print 1 2"},
+	{"builtin", "def plus add app app plus 1 2", "app app add 1 2"},
+	{"unknown identifier", "def x y app f x", "def x y app f x"},
+	{"earlier definition", "def y app f 1 def x y app g x", "def y app f 1 app g y"},
+	{"later definition", "def x y def y app f 1 app g x", "def x y def y app f 1 app g x"},
+	{"shadowed", "def x 1 app (lam x x) x", "app (lam x x) 1"},
+	{"captured", "def y app f 1 def x y app (lam y app x y) 2", "def y app f 1 app (lam y1 app y y1) 2"},
+	{"inlined into lambda", "def x 1 lam z app z x", "lam z app z 1"},
+}
+
+func TestInlineDefs(t *testing.T) {
+	for _, ot := range inlineDefsTests {
+		root := parseString(ot.input)
+		got := inlineDefs(root)
+		if want := parseString(ot.output); !nodesEqual(got, want) {
+			t.Errorf("[%s]\ninput: %q\nwant: %v\ngot: %v\n", ot.name, ot.input, want, got)
+		}
+		if !nodesEqual(root, parseString(ot.input)) {
+			t.Errorf("[%s]\ninput: %q\ninput tree was modified: %v\n", ot.name, ot.input, root)
+		}
+	}
+}
+
+func TestCountFree(t *testing.T) {
+	tests := []struct {
+		input string
+		count int
+	}{
+		{"y", 0},
+		{"x", 1},
+		{"app app add x x", 2},
+		{"app (lam x x) x", 1},
+		{"def x 1 x", 0},
+		{"def y x app y x", 2},
+		{"letrec x x x", 0},
+		{"when x unless x x", 3},
+	}
+	for _, tt := range tests {
+		if got := countFree("x", parseString(tt.input)); got != tt.count {
+			t.Errorf("input: %q\nwant: %d\ngot: %d\n", tt.input, tt.count, got)
+		}
+	}
+}
+
+var reduceTests = []optimizeTest{
+	{"identity", "app (lam x x) y", "y"},
+	{"normal form", "lam x app f x", "lam x app f x"},
+	{"under lam", "lam y app (lam x x) y", "lam y y"},
+	{"leftmost outermost", "app (lam x 1) app (lam x app x x) (lam x app x x)", "1"},
+	{"capture", "app (lam x lam y app x y) y", "lam y1 app y y1"},
+	{"shadowed", "app (lam x lam x x) 1", "lam x x"},
+	{"def", "def f lam x x app f 2", "2"},
+	{"last def", "def f 1", "1"},
+	{"builtins", "app app add 1 2", "app app add 1 2"},
+	{"when", "when (app (lam x x) b) app (lam y lam x y) x", "when b lam x1 x"},
+	{"letrec without recursion", "letrec f lam x x app f 2", "2"},
+	{"recursive letrec", "letrec f lam x app f app (lam y y) x f", "letrec f lam x app f x f"},
+	{"letrec capture", "app (lam y letrec f lam x app f y f) f", "letrec f1 lam x app f1 f f1"},
+}
+
+func TestReduce(t *testing.T) {
+	for _, ot := range reduceTests {
+		root := parseString(ot.input)
+		got, ok := reduce(root, maxReduceSteps)
+		if want := parseString(ot.output); !ok || !nodesEqual(got, want) {
+			t.Errorf("[%s]\ninput: %q\nwant: %v\ngot: %v (%v)\n", ot.name, ot.input, want, got, ok)
+		}
+		if !nodesEqual(root, parseString(ot.input)) {
+			t.Errorf("[%s]\ninput: %q\ninput tree was modified: %v\n", ot.name, ot.input, root)
+		}
+	}
+	if _, ok := reduce(parseString(omega), maxReduceSteps); ok {
+		t.Errorf("%s\nreduction terminated", omega)
+	}
+}
+
+func TestEquivalent(t *testing.T) {
+	const (
+		zero = "lam f lam x x"
+		one  = "lam f lam x app f x"
+		two  = "lam f lam x app f app f x"
+		succ = "lam n lam f lam x app f app app n f x"
+	)
+	tests := []struct {
+		a, b       string
+		equivalent bool
+	}{
+		{"lam x app f x", "f", true},
+		{"app (lam x x) (lam y y)", "lam z z", true},
+		{"app (lam x x) id", "id", true},
+		{"lam x lam y x", "lam a lam b a", true},
+		{"lam x lam y x", "lam x lam y y", false},
+		{"app (" + succ + ") " + one, two, true},
+		{"app (" + succ + ") " + zero, two, false},
+		{"lam x app f x", "g", false},
+		{"lam x y", "lam y y", false},
+		{"lam x app x x", "lam x lam y app x y", false},
+		{omega, omega, false},
+		{"1", "1", true},
+		{"\"a\"", "\"b\"", false},
+	}
+	for _, tt := range tests {
+		if got := equivalent(parseString(tt.a), parseString(tt.b)); got != tt.equivalent {
+			t.Errorf("a: %q\nb: %q\nwant: %v\ngot: %v\n", tt.a, tt.b, tt.equivalent, got)
+		}
+	}
+}
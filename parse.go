@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"math/big"
 )
 
@@ -44,21 +46,85 @@ func errorNodef(format string, args ...interface{}) *node {
 	return &node{nodeError, fmt.Errorf(format, args...)}
 }
 
+// SyntaxError is implemented by the errors that Parse returns for input which
+// doesn't follow the grammar, so that callers can tell what went wrong without
+// looking at the message. (The name ParseError is taken by the ErrorKind of the
+// same errors when they're evaluated.) Errors for input which can't be split
+// into tokens, such as an unterminated string, don't implement it.
+type SyntaxError interface {
+	error
+
+	// Want returns the kind of syntax which the parser expected, e.g.
+	// "expression" or "')'".
+	Want() string
+
+	// Got returns what the parser found instead. If a token of the wrong
+	// type was found, it's the type of the token, e.g. "EOF" or "number";
+	// if the token had the right type but wasn't valid, such as a keyword
+	// used as an identifier, it's the token itself, e.g. "app".
+	Got() string
+
+	// Pos returns the byte offset of the start of the token in the input.
+	Pos() int
+}
+
 // expectError represents a specific kind of parse error where there's a
 // mismatch between an expected grammatical object and the received token.
 type expectError struct {
 	want syntaxType
 	got  tokenType
+	pos  int // byte offset of the start of the token in the input
 }
 
-func newExpectError(want syntaxType, got tokenType) *node {
-	return &node{nodeError, &expectError{want: want, got: got}}
+func newExpectError(want syntaxType, got token) *node {
+	return &node{nodeError, &expectError{want: want, got: got.typ, pos: got.pos}}
 }
 
 func (e *expectError) Error() string {
 	return fmt.Sprintf("expecting %s; got %s", e.want, e.got)
 }
 
+func (e *expectError) Want() string { return e.want.String() }
+func (e *expectError) Got() string  { return e.got.String() }
+func (e *expectError) Pos() int     { return e.pos }
+
+// badTokenError represents a parse error where a token of the expected type was
+// found, but its value isn't allowed, e.g. a number which doesn't fit the
+// grammar or a keyword used as an identifier.
+type badTokenError struct {
+	msg  string // description of the problem, e.g. "bad number"
+	want syntaxType
+	tok  token
+}
+
+func newBadTokenError(msg string, want syntaxType, tok token) *node {
+	return &node{nodeError, &badTokenError{msg: msg, want: want, tok: tok}}
+}
+
+func (e *badTokenError) Error() string {
+	return fmt.Sprintf("%s: '%s'", e.msg, e.tok.val)
+}
+
+func (e *badTokenError) Want() string { return e.want.String() }
+func (e *badTokenError) Got() string  { return e.tok.val }
+func (e *badTokenError) Pos() int     { return e.tok.pos }
+
+// lexError represents a parse error caused by a token which couldn't be lexed.
+// It keeps the lexer's message along with the position of the token.
+type lexError struct {
+	msg   string
+	pos   int  // byte offset of the start of the token in the input
+	atEOF bool // whether the token was cut off by the end of the input, e.g. an unterminated string
+}
+
+func newLexError(tok token) *node {
+	return &node{nodeError, &lexError{msg: tok.val, pos: tok.pos, atEOF: tok.atEOF}}
+}
+
+func (e *lexError) Error() string {
+	return e.msg
+}
+
 //go:generate stringer -type=nodeType
 type nodeType int
 
@@ -70,6 +136,11 @@ const (
 	nodeIdentifier                 // node.val is set to a string which contains the name of the identifier
 	nodeNumber                     // node.val is set to an object of type *big.Int
 	nodeBool                       // node.val is set to a boolean value
+	nodeDef                        // node.val is set to an object of type defNode
+	nodeString                     // node.val is set to a string which contains the contents of the string
+	nodeWhen                       // node.val is set to an object of type whenNode
+	nodeLetrec                     // node.val is set to an object of type letrecNode
+	nodeSeq                        // node.val is set to an object of type seqNode
 )
 
 // node represents a generic node in the parse tree.
@@ -93,10 +164,50 @@ type lamNode struct {
 	body  *node
 }
 
+// whenNode represents a parsed when or unless expression.
+type whenNode struct {
+	test, body *node
+	unless     bool // whether body is evaluated when test is false rather than true
+}
+
+// keyword returns the keyword that introduces the expression.
+func (w *whenNode) keyword() string {
+	if w.unless {
+		return "unless"
+	}
+	return "when"
+}
+
+// letrecNode represents a parsed letrec expression, which binds name to val
+// within both val and body.
+type letrecNode struct {
+	name      string
+	val, body *node
+}
+
+// seqNode represents a parsed sequence of two expressions, which are evaluated
+// in order. Longer sequences are nested in second, e.g. "seq a b c" is parsed
+// like "seq a (seq b c)".
+type seqNode struct {
+	first, second *node
+}
+
+// defNode represents a parsed top-level definition.
+type defNode struct {
+	name string
+	val  *node
+	body *node // rest of the program; nil if the program ends with the definition
+}
+
 // parser contains the parser's execution state.
 type parser struct {
 	lex *lexer
-	buf *token // storage for unnext()
+	buf []token // stack of tokens saved by unnext()
+
+	// Error recovery state (see parseAll)
+	recovering bool    // whether to continue parsing after an error
+	depth      int     // current nesting level of parentheses
+	errs       []error // errors collected so far
 }
 
 // newParser returns a new parser for the given input string.
@@ -106,25 +217,94 @@ func newParser(input string) *parser {
 	}
 }
 
-// next returns the next token from the lexer.
+// next returns the next token, taking the most recently saved token from buf
+// if there is one, and otherwise reading one from the lexer.
 func (p *parser) next() token {
-	if p.buf != nil {
-		ret := *p.buf
-		p.buf = nil
+	if n := len(p.buf); n > 0 {
+		ret := p.buf[n-1]
+		p.buf = p.buf[:n-1]
 		return ret
 	}
 	return p.lex.nextToken()
 }
 
 // unnext saves the given token to be returned the next time next() is called.
-// There's room for only one token, so the last token saved with unnext() needs
-// to be retrieved with next() before another one can be stored. If this
-// condition is not met, the function will panic.
+// Any number of tokens can be saved; they're returned in the reverse order, so
+// unnext() should be called with tokens in the opposite order that next()
+// returned them.
 func (p *parser) unnext(t token) {
-	if p.buf != nil {
-		panic(fmt.Errorf("internal parser error: multiple unnext"))
+	p.buf = append(p.buf, t)
+}
+
+// recoverFrom records the error stored in the error node n and reports whether
+// the parser should keep going. It always returns false if the parser isn't in
+// recovery mode, in which case the caller should return n as usual.
+//
+// An error node may be passed up through several levels before it ends up in
+// the tree, so errors are only recorded once. Also, once the end of the input is
+// reached, every expression that follows fails the same way, so only the first
+// unexpected EOF error is recorded.
+func (p *parser) recoverFrom(n *node) bool {
+	if !p.recovering {
+		return false
+	}
+	for _, err := range p.errs {
+		if err == n.val {
+			return true
+		}
+		if isEOFError(err) && isUnexpectedEOFError(n) {
+			return true
+		}
 	}
-	p.buf = &t
+	p.errs = append(p.errs, n.val.(error))
+	return true
+}
+
+// skipParen skips tokens up to and including the ')' which closes the current
+// parenthesized expression, taking nested parentheses into account. It stops
+// early at EOF. It's used to resynchronize after an error in recovery mode.
+func (p *parser) skipParen() {
+	depth := 0
+	for {
+		switch tok := p.next(); tok.typ {
+		case tokenLeftParen:
+			depth++
+		case tokenRightParen:
+			if depth == 0 {
+				return
+			}
+			depth--
+		case tokenEOF:
+			p.unnext(tok)
+			return
+		}
+	}
+}
+
+// keywords contains the words with a special meaning to the parser.
+var keywords = []string{"app", "lam", "def", "when", "unless", "letrec", "seq"}
+
+// isKeyword returns true if name is one of the keywords.
+func isKeyword(name string) bool {
+	for _, k := range keywords {
+		if name == k {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBinding parses the name bound by a lambda or a definition and returns
+// either an identifier node or an error node. Keywords are rejected, since an
+// identifier with the same name as a keyword could never be referred to.
+func (p *parser) parseBinding() *node {
+	tok := p.next()
+	p.unnext(tok)
+	n := p.parseIdentifier()
+	if n.typ == nodeIdentifier && isKeyword(n.val.(string)) {
+		return newBadTokenError("keyword used as identifier", syntaxIdentifier, tok)
+	}
+	return n
 }
 
 // parseIdentifier parses an identifier and returns either an identifier node or
@@ -132,20 +312,22 @@ func (p *parser) unnext(t token) {
 func (p *parser) parseIdentifier() *node {
 	tok := p.next()
 	if tok.typ != tokenIdentifier {
-		return newExpectError(syntaxIdentifier, tok.typ)
+		return newExpectError(syntaxIdentifier, tok)
 	}
 	return &node{nodeIdentifier, tok.val}
 }
 
 // parseNumber parses a number and returns either a number node or an error
-// node.
+// node. Numbers are always decimal, so leading zeros are allowed and ignored,
+// e.g. "007" is 7 rather than an octal number. Similarly, "-0" is the same as
+// "0"; big.Int never represents zero as negative.
 //
 // Precondition: The next token from the lexer is a number token.
 func (p *parser) parseNumber() *node {
 	tok := p.next()
 	n, ok := new(big.Int).SetString(tok.val, 10)
 	if !ok {
-		return errorNodef("bad number: '%s'", tok.val)
+		return newBadTokenError("bad number", syntaxNumber, tok)
 	}
 	return &node{nodeNumber, n}
 }
@@ -163,11 +345,19 @@ func (p *parser) parseBool() *node {
 		val = false
 	default:
 		// shouldn't be possible since bools are validated by the lexer
-		return errorNodef("bad bool: '%s'", tok.val)
+		return newBadTokenError("bad bool", syntaxBool, tok)
 	}
 	return &node{nodeBool, val}
 }
 
+// parseStringLiteral parses a string literal and returns a string node.
+//
+// Precondition: The next token from the lexer is a string token.
+func (p *parser) parseStringLiteral() *node {
+	tok := p.next()
+	return &node{nodeString, unquote(tok.val)}
+}
+
 // parseApp parses a function application expression and returns either an app
 // node or an error node.
 //
@@ -179,92 +369,308 @@ func (p *parser) parseBool() *node {
 func (p *parser) parseApp() *node {
 	app := &appNode{}
 	app.fn = p.parseExpression()
-	if app.fn.typ == nodeError {
+	if app.fn.typ == nodeError && !p.recoverFrom(app.fn) {
 		return app.fn
 	}
 	app.arg = p.parseExpression()
-	if app.arg.typ == nodeError {
+	if app.arg.typ == nodeError && !p.recoverFrom(app.arg) {
 		return app.arg
 	}
 	return &node{nodeApp, app}
 }
 
 // parseLam parses a lambda function expression and returns either a lam node or
-// an error node.
+// an error node. If shorthand is true, the lambda was introduced by a backslash
+// rather than the 'lam' keyword, and the parameter may be followed by a dot.
 //
 // Grammar:
 //   expr = "lam", ident, expr
+//   | "\", ident, [ "." ], expr
 //
-// Precondition: The 'lam' token has been consumed and an identifier is being
-// expected.
-func (p *parser) parseLam() *node {
+// Precondition: The 'lam' or '\' token has been consumed and an identifier is
+// being expected.
+func (p *parser) parseLam(shorthand bool) *node {
 	lam := &lamNode{}
-	param := p.parseIdentifier()
+	param := p.parseBinding()
 	if param.typ == nodeError {
-		return param
+		if !p.recoverFrom(param) {
+			return param
+		}
+	} else {
+		lam.param = param.val.(string)
+	}
+	if tok := p.next(); !shorthand || tok.typ != tokenDot {
+		p.unnext(tok)
 	}
-	lam.param = param.val.(string)
 	lam.body = p.parseExpression()
-	if lam.body.typ == nodeError {
+	if lam.body.typ == nodeError && !p.recoverFrom(lam.body) {
 		return lam.body
 	}
 	return &node{nodeLam, lam}
 }
 
+// parseWhen parses a when expression and returns either a when node or an error
+// node.
+//
+// Grammar:
+//   expr = "when", expr, expr
+//
+// Precondition: The 'when' token has been consumed and an expression is being
+// expected.
+func (p *parser) parseWhen() *node {
+	return p.parseConditional(false)
+}
+
+// parseUnless parses an unless expression, which is the opposite of a when
+// expression, and returns either a when node or an error node.
+//
+// Grammar:
+//   expr = "unless", expr, expr
+//
+// Precondition: The 'unless' token has been consumed and an expression is being
+// expected.
+func (p *parser) parseUnless() *node {
+	return p.parseConditional(true)
+}
+
+// parseConditional parses the test and body of a when or unless expression.
+func (p *parser) parseConditional(unless bool) *node {
+	when := &whenNode{unless: unless}
+	when.test = p.parseExpression()
+	if when.test.typ == nodeError && !p.recoverFrom(when.test) {
+		return when.test
+	}
+	when.body = p.parseExpression()
+	if when.body.typ == nodeError && !p.recoverFrom(when.body) {
+		return when.body
+	}
+	return &node{nodeWhen, when}
+}
+
+// parseLetrec parses a letrec expression and returns either a letrec node or an
+// error node.
+//
+// Grammar:
+//   expr = "letrec", ident, expr, expr
+//
+// Precondition: The 'letrec' token has been consumed and an identifier is being
+// expected.
+func (p *parser) parseLetrec() *node {
+	letrec := &letrecNode{}
+	name := p.parseBinding()
+	if name.typ == nodeError {
+		if !p.recoverFrom(name) {
+			return name
+		}
+	} else {
+		letrec.name = name.val.(string)
+	}
+	letrec.val = p.parseExpression()
+	if letrec.val.typ == nodeError && !p.recoverFrom(letrec.val) {
+		return letrec.val
+	}
+	letrec.body = p.parseExpression()
+	if letrec.body.typ == nodeError && !p.recoverFrom(letrec.body) {
+		return letrec.body
+	}
+	return &node{nodeLetrec, letrec}
+}
+
+// parseSeq parses a seq expression and returns either a seq node, the
+// expression if there's only one, or an error node. Since the number of
+// expressions isn't fixed, they run up to the next ')', ';', or the end of the
+// input, so a seq expression which is an operand of another expression has to
+// be in parentheses, e.g. "app (seq a f) x".
+//
+// Grammar:
+//   expr = "seq", expr, { expr }
+//
+// Precondition: The 'seq' token has been consumed and an expression is being
+// expected.
+func (p *parser) parseSeq() *node {
+	first := p.parseExpression()
+	if first.typ == nodeError && !p.recoverFrom(first) {
+		return first
+	}
+	switch tok := p.next(); tok.typ {
+	case tokenRightParen, tokenSemicolon, tokenEOF:
+		p.unnext(tok)
+		return first
+	default:
+		p.unnext(tok)
+	}
+	second := p.parseSeq()
+	if second.typ == nodeError && !p.recoverFrom(second) {
+		return second
+	}
+	return &node{nodeSeq, &seqNode{first, second}}
+}
+
+// parseSequence parses one or more expressions separated by semicolons and
+// returns either the expression if there's only one, a seq node, or an error
+// node. Sequences like this can only be written in parentheses or at the end
+// of a program, since a semicolon doesn't end any other expression.
+//
+// Grammar:
+//   sequence = expr, { ";", expr } ;
+func (p *parser) parseSequence() *node {
+	first := p.parseExpression()
+	if first.typ == nodeError && !p.recoverFrom(first) {
+		return first
+	}
+	if tok := p.next(); tok.typ != tokenSemicolon {
+		p.unnext(tok)
+		return first
+	}
+	second := p.parseSequence()
+	if second.typ == nodeError && !p.recoverFrom(second) {
+		return second
+	}
+	return &node{nodeSeq, &seqNode{first, second}}
+}
+
 // parseExpression parses an expression and returns a node.
 //
 // Grammar:
-//   expr = "(", expr, ")"
+//   expr = "(", sequence, ")"
 //   | "lam", ident, expr
+//   | "\", ident, [ "." ], expr
 //   | "app", expr, expr
+//   | "when", expr, expr
+//   | "unless", expr, expr
+//   | "letrec", ident, expr, expr
+//   | "seq", expr, { expr }
 //   | literal
 //   | ident ;
 func (p *parser) parseExpression() *node {
 	switch tok := p.next(); {
 	case tok.typ == tokenLeftParen:
-		e := p.parseExpression()
-		if e.typ == nodeError {
+		p.depth++
+		defer func() { p.depth-- }()
+		e := p.parseSequence()
+		if e.typ == nodeError && !p.recoverFrom(e) {
 			return e
 		}
 		tok := p.next()
 		if tok.typ != tokenRightParen {
-			return newExpectError(syntaxRightParen, tok.typ)
+			err := newExpectError(syntaxRightParen, tok)
+			if !p.recoverFrom(err) {
+				return err
+			}
+			p.unnext(tok)
+			p.skipParen()
 		}
 		return e
 	case tok.typ == tokenRightParen:
-		return newExpectError(syntaxExpression, tokenRightParen)
+		if p.recovering && p.depth > 0 {
+			// Leave the ')' for the enclosing parenthesized
+			// expression so that it doesn't report it again.
+			p.unnext(tok)
+		}
+		return newExpectError(syntaxExpression, tok)
 	case tok.typ == tokenIdentifier && tok.val == "lam":
-		return p.parseLam()
+		return p.parseLam(false)
+	case tok.typ == tokenBackslash:
+		return p.parseLam(true)
 	case tok.typ == tokenIdentifier && tok.val == "app":
 		return p.parseApp()
+	case tok.typ == tokenIdentifier && tok.val == "when":
+		return p.parseWhen()
+	case tok.typ == tokenIdentifier && tok.val == "unless":
+		return p.parseUnless()
+	case tok.typ == tokenIdentifier && tok.val == "letrec":
+		return p.parseLetrec()
+	case tok.typ == tokenIdentifier && tok.val == "seq":
+		return p.parseSeq()
 	case tok.typ == tokenNumber:
 		p.unnext(tok)
 		return p.parseNumber()
 	case tok.typ == tokenBool:
 		p.unnext(tok)
 		return p.parseBool()
+	case tok.typ == tokenString:
+		p.unnext(tok)
+		return p.parseStringLiteral()
 	case tok.typ == tokenIdentifier:
 		p.unnext(tok)
 		return p.parseIdentifier()
 	case tok.typ == tokenError:
-		return &node{nodeError, fmt.Errorf("%s", tok.val)}
+		return newLexError(tok)
 	case tok.typ == tokenEOF:
-		return newExpectError(syntaxExpression, tokenEOF)
+		return newExpectError(syntaxExpression, tok)
 	default:
 		return errorNodef("illegal token: %s", tok)
 	}
 }
 
+// parseProgram parses a whole program, which is an expression optionally
+// preceded by definitions, and returns a node.
+//
+// Grammar:
+//   program = def, [ program ]
+//   | sequence ;
+//   def = "def", ident, expr ;
+func (p *parser) parseProgram() *node {
+	if tok := p.next(); tok.typ != tokenIdentifier || tok.val != "def" {
+		p.unnext(tok)
+		return p.parseSequence()
+	}
+	def := &defNode{}
+	name := p.parseBinding()
+	if name.typ == nodeError {
+		if !p.recoverFrom(name) {
+			return name
+		}
+	} else {
+		def.name = name.val.(string)
+	}
+	def.val = p.parseExpression()
+	if def.val.typ == nodeError && !p.recoverFrom(def.val) {
+		return def.val
+	}
+	tok := p.next()
+	p.unnext(tok)
+	if tok.typ != tokenEOF {
+		def.body = p.parseProgram()
+		if def.body.typ == nodeError && !p.recoverFrom(def.body) {
+			return def.body
+		}
+	}
+	return &node{nodeDef, def}
+}
+
+// parseStatement parses a single top-level definition, without the rest of the
+// program after it, or a single expression. It's used to parse a program one
+// piece at a time (see streamParser).
+//
+// Grammar:
+//   statement = def | sequence ;
+func (p *parser) parseStatement() *node {
+	if tok := p.next(); tok.typ != tokenIdentifier || tok.val != "def" {
+		p.unnext(tok)
+		return p.parseSequence()
+	}
+	name := p.parseBinding()
+	if name.typ == nodeError {
+		return name
+	}
+	val := p.parseExpression()
+	if val.typ == nodeError {
+		return val
+	}
+	return &node{nodeDef, &defNode{name.val.(string), val, nil}}
+}
+
 // parse runs the parser and returns the root of the parse tree.
 func (p *parser) parse() *node {
-	root := p.parseExpression()
+	root := p.parseProgram()
 	if root.typ == nodeError {
 		return root
 	}
 
 	// Make sure there aren't any trailing tokens
 	if tok := p.next(); tok.typ != tokenEOF {
-		return newExpectError(syntaxEOF, tok.typ)
+		return newExpectError(syntaxEOF, tok)
 	}
 	return root
 }
@@ -273,14 +679,251 @@ func parseString(s string) *node {
 	return newParser(s).parse()
 }
 
+// Parse parses a program and returns the root of its parse tree. If the program
+// has a syntax error, the first one is returned instead, which implements
+// SyntaxError unless it was caused by a token that couldn't be lexed.
+func Parse(input string) (*node, error) {
+	n := parseString(input)
+	if n.typ == nodeError {
+		return nil, n.val.(error)
+	}
+	return n, nil
+}
+
+// parseStringShared is like parseString, except that structurally identical
+// subtrees in the result are represented by the same nodes (see interner), which
+// saves memory for programs with a lot of repetition. Since the nodes may be
+// shared, the tree must not be modified.
+func parseStringShared(s string) *node {
+	n := parseString(s)
+	if n.typ == nodeError {
+		return n
+	}
+	n, _ = newInterner().intern(n)
+	return n
+}
+
+// parseAll is like parseString, except that instead of stopping at the first
+// error, it attempts to recover and keep going so that all of the errors in the
+// input can be reported at once. If any errors are found, the returned node is
+// an error node containing the first one.
+//
+// Once the program has been parsed, any tokens that are left over are parsed
+// as further programs so that the errors within them are found as well. After
+// an error which the parser couldn't recover from, parsing resumes at the next
+// keyword or after the next ')'.
+func parseAll(s string) (*node, []error) {
+	p := newParser(s)
+	p.recovering = true
+	root := p.parseProgram()
+	failed := root.typ == nodeError
+	if failed {
+		p.recoverFrom(root)
+	}
+	for {
+		tok := p.next()
+		if tok.typ == tokenEOF {
+			break
+		}
+		if failed {
+			if !p.resync(tok) {
+				break
+			}
+		} else {
+			p.recoverFrom(newExpectError(syntaxEOF, tok))
+			if tok.typ != tokenRightParen {
+				p.unnext(tok)
+			}
+		}
+		tok = p.next()
+		p.unnext(tok)
+		if tok.typ == tokenEOF {
+			break
+		}
+		n := p.parseProgram()
+		failed = n.typ == nodeError
+		if failed {
+			p.recoverFrom(n)
+		}
+	}
+	if len(p.errs) > 0 {
+		return &node{nodeError, p.errs[0]}, p.errs
+	}
+	return root, nil
+}
+
+// resync skips tokens, starting with tok, up to the next keyword or ')' so that
+// parsing can resume after an error. A ')' is skipped as well, while a keyword
+// is saved to start the next expression. It returns false if the end of the
+// input is reached first.
+func (p *parser) resync(tok token) bool {
+	for ; tok.typ != tokenEOF; tok = p.next() {
+		switch {
+		case tok.typ == tokenRightParen:
+			return true
+		case tok.typ == tokenIdentifier && isKeyword(tok.val):
+			p.unnext(tok)
+			return true
+		}
+	}
+	p.unnext(tok)
+	return false
+}
+
+// A streamParser parses the definitions and expressions in a program one at a
+// time as it's read from an io.Reader, so that each one can be evaluated before
+// the rest of the input is available. The input is read a line at a time, and
+// since no token other than a string can span more than one line, a statement
+// which is complete at the end of a line can't be continued by the next one.
+type streamParser struct {
+	r   *bufio.Reader
+	buf string // input which has been read but not parsed yet
+	err error  // error from the last read, if any, such as io.EOF
+}
+
+// newStreamParser returns a new streamParser which reads from r.
+func newStreamParser(r io.Reader) *streamParser {
+	return &streamParser{r: bufio.NewReader(r)}
+}
+
+// next returns the next statement in the input (see parseStatement), reading
+// more lines as needed to complete it. It returns nil at the end of the input,
+// along with the error that stopped the input unless it's io.EOF. A statement
+// with a syntax error is returned as an error node, and the rest of the input
+// read so far, which is the rest of the line with the error, is skipped.
+func (sp *streamParser) next() (*node, error) {
+	for {
+		if n := sp.parseBuffered(); n != nil {
+			return n, nil
+		}
+		if sp.err == io.EOF {
+			return nil, nil
+		} else if sp.err != nil {
+			return nil, sp.err
+		}
+		var line string
+		line, sp.err = sp.r.ReadString('\n')
+		sp.buf += line
+	}
+}
+
+// parseBuffered parses the next statement in the buffered input and removes it
+// from the buffer. It returns nil if there isn't a whole statement in the buffer,
+// unless the end of the input has been reached, in which case an incomplete
+// statement is returned as an error node.
+func (sp *streamParser) parseBuffered() *node {
+	p := newParser(sp.buf)
+	tok := p.next()
+	if tok.typ == tokenEOF {
+		// Don't keep blank lines around.
+		sp.buf = ""
+		return nil
+	}
+	p.unnext(tok)
+	n := p.parseStatement()
+	if n.typ == nodeError {
+		if isUnexpectedEOFError(n) && sp.err != io.EOF {
+			return nil
+		}
+		sp.buf = ""
+		return n
+	}
+	if tok := p.next(); tok.typ == tokenEOF {
+		sp.buf = ""
+	} else {
+		sp.buf = sp.buf[tok.pos:]
+	}
+	return n
+}
+
+// isUnexpectedEOFError returns true if n is an error node for an error which was
+// caused by reaching the end of the input too early. See isEOFError.
 func isUnexpectedEOFError(n *node) bool {
 	if n.typ != nodeError {
 		return false
 	}
-	switch v := n.val.(type) {
+	err, ok := n.val.(error)
+	return ok && isEOFError(err)
+}
+
+// isEOFError returns true if err is a parse error which was caused by reaching
+// the end of the input too early, e.g. before an expression or a closing
+// parenthesis, or in the middle of a string. Such errors can be fixed by
+// adding more input.
+func isEOFError(err error) bool {
+	switch e := err.(type) {
 	case *expectError:
-		return v.got == tokenEOF
+		return e.got == tokenEOF
+	case *lexError:
+		return e.atEOF
 	default:
 		return false
 	}
 }
+
+// walk traverses the tree rooted at n in depth-first order, calling fn for each
+// node before its children. The children of an app node are visited function
+// first, those of a when node test first, those of a seq node in order, and
+// those of a letrec or def node value first. If fn returns false, the
+// traversal stops immediately and walk returns false; otherwise it returns true.
+func walk(n *node, fn func(*node) bool) bool {
+	if !fn(n) {
+		return false
+	}
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		return walk(app.fn, fn) && walk(app.arg, fn)
+	case nodeLam:
+		return walk(n.val.(*lamNode).body, fn)
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return walk(when.test, fn) && walk(when.body, fn)
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		return walk(letrec.val, fn) && walk(letrec.body, fn)
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return walk(seq.first, fn) && walk(seq.second, fn)
+	case nodeDef:
+		def := n.val.(*defNode)
+		if !walk(def.val, fn) {
+			return false
+		}
+		return def.body == nil || walk(def.body, fn)
+	}
+	return true
+}
+
+// cloneNode returns a copy of the tree rooted at n which doesn't share any nodes
+// or numbers with it, so that either one can be modified without affecting the
+// other. Errors are shared, since they're never modified.
+func cloneNode(n *node) *node {
+	if n == nil {
+		return nil
+	}
+	switch n.typ {
+	case nodeApp:
+		app := n.val.(*appNode)
+		return &node{nodeApp, &appNode{cloneNode(app.fn), cloneNode(app.arg)}}
+	case nodeLam:
+		lam := n.val.(*lamNode)
+		return &node{nodeLam, &lamNode{lam.param, cloneNode(lam.body)}}
+	case nodeWhen:
+		when := n.val.(*whenNode)
+		return &node{nodeWhen, &whenNode{cloneNode(when.test), cloneNode(when.body), when.unless}}
+	case nodeLetrec:
+		letrec := n.val.(*letrecNode)
+		return &node{nodeLetrec, &letrecNode{letrec.name, cloneNode(letrec.val), cloneNode(letrec.body)}}
+	case nodeSeq:
+		seq := n.val.(*seqNode)
+		return &node{nodeSeq, &seqNode{cloneNode(seq.first), cloneNode(seq.second)}}
+	case nodeDef:
+		def := n.val.(*defNode)
+		return &node{nodeDef, &defNode{def.name, cloneNode(def.val), cloneNode(def.body)}}
+	case nodeNumber:
+		return &node{nodeNumber, new(big.Int).Set(n.val.(*big.Int))}
+	default:
+		return &node{n.typ, n.val}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "testing"
+
+func FuzzParse(f *testing.F) {
+	for _, pt := range parseTests {
+		f.Add(pt.input)
+	}
+	for _, pt := range parseAllTests {
+		f.Add(pt.input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		root := parseString(input)
+		if root == nil {
+			t.Fatalf("input: %q\nparseString returned nil", input)
+		}
+		if _, ok := root.val.(error); root.typ == nodeError && !ok {
+			t.Fatalf("input: %q\nerror node without an error: %v", input, root)
+		}
+		root, errs := parseAll(input)
+		if (root.typ == nodeError) != (len(errs) > 0) {
+			t.Fatalf("input: %q\nparseAll returned %v with errors %q", input, root, errs)
+		}
+	})
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"math/big"
+	"strings"
 	"testing"
 )
 
@@ -41,7 +45,12 @@ var parseTests = []parseTest{
 	{"empty", "", errorNodef("expecting expression; got EOF")},
 	{"number", "2", mknum(2)},
 	{"negative number", "-7", mknum(-7)},
-	{"bad number", "2s", errorNodef("bad number syntax: '2s'")},
+	{"zero", "0", mknum(0)},
+	{"negative zero", "-0", mknum(0)},
+	{"leading zeros", "007", mknum(7)},
+	{"negative with leading zeros", "-007", mknum(-7)},
+	{"bad number", "2s", mklexerr("bad number syntax: '2s'", 0, false)},
+	{"bad number in app", "app f 2s", mklexerr("bad number syntax: '2s'", 6, false)},
 	{"bool", "true", trueNode},
 	{"ident", "x", xNode},
 	{"paren", "(x)", xNode},
@@ -69,9 +78,85 @@ var parseTests = []parseTest{
 				mkapp(mkapp(fNode, yNode), xNode)))),
 				mklam("x", mklam("y", xNode))),
 			mknum(3)), mknum(4))},
+	{"string", `"hi"`, &node{nodeString, "hi"}},
+	{"string with escapes", `"a\"b\\c\nd"`, &node{nodeString, "a\"b\\c\nd"}},
+	{"string argument", `app f "x"`, mkapp(fNode, &node{nodeString, "x"})},
+	{"unterminated string", `app f "x`, mklexerr(`unterminated string: '"x'`, 6, true)},
+	{"unterminated string ending with backslash", `app f "x\`, mklexerr(`unterminated string: '"x\'`, 6, true)},
+	{"def", "def x 1", mkdef("x", mknum(1), nil)},
+	{"def with body", "def x 1 def f lam y y app f x",
+		mkdef("x", mknum(1), mkdef("f", mklam("y", yNode), mkapp(fNode, xNode)))},
+	{"def missing value", "def x", errorNodef("expecting expression; got EOF")},
+	{"def illegal name", "def 1 2", errorNodef("expecting identifier; got number")},
+	{"parens without spaces", "app(lam x x)(app(f)2)",
+		mkapp(mklam("x", mkident("x")), mkapp(mkident("f"), mknum(2)))},
+	{"backslash lam", `\x x`, mklam("x", mkident("x"))},
+	{"backslash lam with dot", `\x. x`, mklam("x", mkident("x"))},
+	{"nested backslash lams", `\x.\y. app x y`, mklam("x", mklam("y", mkapp(mkident("x"), mkident("y"))))},
+	{"backslash lam missing parameter", `\ 1`, errorNodef("expecting identifier; got number")},
+	{"dot after lam", "lam x. x", errorNodef("illegal token: <9('.'):'.'>")},
+	{"keyword parameter app", "lam app x", errorNodef("keyword used as identifier: 'app'")},
+	{"keyword parameter lam", "lam lam x", errorNodef("keyword used as identifier: 'lam'")},
+	{"keyword parameter def", "lam def x", errorNodef("keyword used as identifier: 'def'")},
+	{"keyword parameter with backslash", `\app x`, errorNodef("keyword used as identifier: 'app'")},
+	{"keyword definition name", "def lam 1 2", errorNodef("keyword used as identifier: 'lam'")},
+	{"keyword prefix", "lam apple apple", mklam("apple", mkident("apple"))},
+	{"when", "when true 1", mkwhen(&node{nodeBool, true}, mknum(1), false)},
+	{"unless", "unless app isnil x app head x",
+		mkwhen(mkapp(mkident("isnil"), mkident("x")), mkapp(mkident("head"), mkident("x")), true)},
+	{"nested when", "lam x when (app app gt x 0) unless app app gt x 9 x",
+		mklam("x", mkwhen(mkapp(mkapp(mkident("gt"), mkident("x")), mknum(0)),
+			mkwhen(mkapp(mkapp(mkident("gt"), mkident("x")), mknum(9)), mkident("x"), true), false))},
+	{"when missing body", "when true", errorNodef("expecting expression; got EOF")},
+	{"keyword when as parameter", "lam when when", errorNodef("keyword used as identifier: 'when'")},
+	{"keyword unless as definition name", "def unless 1 2", errorNodef("keyword used as identifier: 'unless'")},
+	{"letrec", "letrec f lam x app f x app f 1",
+		mkletrec("f", mklam("x", mkapp(mkident("f"), mkident("x"))), mkapp(mkident("f"), mknum(1)))},
+	{"letrec missing body", "letrec f 1", errorNodef("expecting expression; got EOF")},
+	{"letrec keyword name", "letrec app 1 2", errorNodef("keyword used as identifier: 'app'")},
+	{"keyword letrec as parameter", "lam letrec 1", errorNodef("keyword used as identifier: 'letrec'")},
+	{"seq", "seq app print 1 2", mkseq(mkapp(mkident("print"), mknum(1)), mknum(2))},
+	{"seq of three", "seq a b c", mkseq(mkident("a"), mkseq(mkident("b"), mkident("c")))},
+	{"seq of one", "seq a", mkident("a")},
+	{"seq in parens", "app (seq a f) (seq b x)",
+		mkapp(mkseq(mkident("a"), mkident("f")), mkseq(mkident("b"), mkident("x")))},
+	{"seq missing expression", "seq", errorNodef("expecting expression; got EOF")},
+	{"semicolons", "app print 1; app print 2; 3",
+		mkseq(mkapp(mkident("print"), mknum(1)), mkseq(mkapp(mkident("print"), mknum(2)), mknum(3)))},
+	{"semicolons in parens", "app (a; f) x", mkapp(mkseq(mkident("a"), mkident("f")), mkident("x"))},
+	{"semicolons after defs", "def x 1 a; x", mkdef("x", mknum(1), mkseq(mkident("a"), mkident("x")))},
+	{"semicolon ends seq", "(seq a b; c)", mkseq(mkseq(mkident("a"), mkident("b")), mkident("c"))},
+	{"semicolon without parens", "app f a; b", mkseq(mkapp(mkident("f"), mkident("a")), mkident("b"))},
+	{"semicolon in operand", "app f (a; b", errorNodef("expecting ')'; got EOF")},
+	{"trailing semicolon", "a;", errorNodef("expecting expression; got EOF")},
+	{"semicolon without space", "a;b", mkseq(mkident("a"), mkident("b"))},
+	{"keyword seq as parameter", "lam seq 1", errorNodef("keyword used as identifier: 'seq'")},
+}
+
+func mkdef(name string, val, body *node) *node {
+	return &node{nodeDef, &defNode{name, val, body}}
+}
+
+func mkletrec(name string, val, body *node) *node {
+	return &node{nodeLetrec, &letrecNode{name, val, body}}
+}
+
+func mkwhen(test, body *node, unless bool) *node {
+	return &node{nodeWhen, &whenNode{test, body, unless}}
+}
+
+func mkseq(first, second *node) *node {
+	return &node{nodeSeq, &seqNode{first, second}}
+}
+
+func mklexerr(msg string, pos int, atEOF bool) *node {
+	return &node{nodeError, &lexError{msg, pos, atEOF}}
 }
 
 func nodesEqual(a, b *node) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
 	if a.typ != b.typ {
 		return false
 	}
@@ -88,7 +173,28 @@ func nodesEqual(a, b *node) bool {
 		av := a.val.(*lamNode)
 		bv := b.val.(*lamNode)
 		return av.param == bv.param && nodesEqual(av.body, bv.body)
+	case nodeWhen:
+		av := a.val.(*whenNode)
+		bv := b.val.(*whenNode)
+		return av.unless == bv.unless && nodesEqual(av.test, bv.test) && nodesEqual(av.body, bv.body)
+	case nodeLetrec:
+		av := a.val.(*letrecNode)
+		bv := b.val.(*letrecNode)
+		return av.name == bv.name && nodesEqual(av.val, bv.val) && nodesEqual(av.body, bv.body)
+	case nodeSeq:
+		av := a.val.(*seqNode)
+		bv := b.val.(*seqNode)
+		return nodesEqual(av.first, bv.first) && nodesEqual(av.second, bv.second)
+	case nodeDef:
+		av := a.val.(*defNode)
+		bv := b.val.(*defNode)
+		return av.name == bv.name && nodesEqual(av.val, bv.val) && nodesEqual(av.body, bv.body)
 	case nodeError:
+		ae, aok := a.val.(*lexError)
+		be, bok := b.val.(*lexError)
+		if aok || bok {
+			return aok && bok && *ae == *be
+		}
 		return a.val.(error).Error() == b.val.(error).Error()
 	default:
 		return a.val == b.val
@@ -103,3 +209,329 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+type parseAllTest struct {
+	name  string
+	input string
+	errs  []string
+}
+
+var parseAllTests = []parseAllTest{
+	{"no errors", "app (lam x x) 2", nil},
+	{"single error", "lam 1 x", []string{"expecting identifier; got number"}},
+	{"two errors", "app (lam 1 x) (lam 2 y)", []string{
+		"expecting identifier; got number",
+		"expecting identifier; got number"}},
+	{"lexer and parser errors", "app (lam x ]) (lam true y)", []string{
+		"illegal character: ']' at line 1, column 12, near 'app (lam x ]) (lam true y)'",
+		"expecting identifier; got bool"}},
+	{"unclosed paren after error", "app (app 1 2 3) ()", []string{
+		"expecting ')'; got number",
+		"expecting expression; got ')'"}},
+	{"single EOF error", "app app add", []string{"expecting expression; got EOF"}},
+	{"keyword parameters", "app (lam app 1) (lam lam 2)", []string{
+		"keyword used as identifier: 'app'",
+		"keyword used as identifier: 'lam'"}},
+	{"trailing tokens", "app ) 1 2", []string{
+		"expecting expression; got ')'",
+		"expecting EOF; got number"}},
+	{"several trailing expressions", "app app add 1 2 3 4", []string{
+		"expecting EOF; got number",
+		"expecting EOF; got number"}},
+	{"errors after trailing tokens", "app ) ) (lam 3 x) app", []string{
+		"expecting expression; got ')'",
+		"expecting expression; got ')'",
+		"expecting EOF; got '('",
+		"expecting identifier; got number",
+		"expecting EOF; got identifier",
+		"expecting expression; got EOF"}},
+	{"trailing paren", "x )", []string{"expecting EOF; got ')'"}},
+	{"resync at keyword", "1s 2 lam 3 x", []string{
+		"bad number syntax: '1s'",
+		"expecting identifier; got number"}},
+	{"resync after paren", "2s 1 ) app 3", []string{
+		"bad number syntax: '2s'",
+		"expecting expression; got EOF"}},
+}
+
+func TestParseAll(t *testing.T) {
+	for _, pt := range parseAllTests {
+		root, errs := parseAll(pt.input)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(pt.errs) {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", pt.name, pt.input, pt.errs, got)
+		}
+		if (root.typ == nodeError) != (len(pt.errs) > 0) {
+			t.Errorf("[%s]\ninput: %q\nunexpected root: %v\n", pt.name, pt.input, root)
+		}
+	}
+}
+
+func TestIsUnexpectedEOFError(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"app f", true},
+		{"(x", true},
+		{`app f "x`, true},
+		{"app f 2s", false},
+		{"app f )", false},
+		{"app f x", false},
+	}
+	for _, tt := range tests {
+		n := newParser(tt.input).parse()
+		if got := isUnexpectedEOFError(n); got != tt.want {
+			t.Errorf("input: %q\nwant: %v\ngot: %v (%v)\n", tt.input, tt.want, got, n)
+		}
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		got   string
+		pos   int
+	}{
+		{"app f", "expression", "EOF", 5},
+		{"app f )", "expression", "')'", 6},
+		{"lam 1 x", "identifier", "number", 4},
+		{"(x y)", "')'", "identifier", 3},
+		{"x y", "EOF", "identifier", 2},
+		{"lam app x", "identifier", "app", 4},
+		{"def x 1 def seq 2 x", "identifier", "seq", 12},
+	}
+	for _, tt := range tests {
+		n, err := Parse(tt.input)
+		if n != nil {
+			t.Errorf("input: %q\nwant: nil node\ngot: %v\n", tt.input, n)
+		}
+		serr, ok := err.(SyntaxError)
+		if !ok {
+			t.Errorf("input: %q\nwant: SyntaxError\ngot: %T (%v)\n", tt.input, err, err)
+			continue
+		}
+		if serr.Want() != tt.want || serr.Got() != tt.got || serr.Pos() != tt.pos {
+			t.Errorf("input: %q\nwant: %s, %s, %d\ngot: %s, %s, %d\n",
+				tt.input, tt.want, tt.got, tt.pos, serr.Want(), serr.Got(), serr.Pos())
+		}
+	}
+
+	if n, err := Parse("app f x"); err != nil || !nodesEqual(n, mkapp(mkident("f"), mkident("x"))) {
+		t.Errorf("want: %v, nil\ngot: %v, %v\n", mkapp(mkident("f"), mkident("x")), n, err)
+	}
+	if _, err := Parse(`app f "x`); err == nil {
+		t.Errorf("no error for an unterminated string")
+	} else if _, ok := err.(SyntaxError); ok {
+		t.Errorf("lex error implements SyntaxError: %v", err)
+	}
+}
+
+func TestParserUnnext(t *testing.T) {
+	p := newParser("app f (x)")
+	var toks []token
+	for i := 0; i < 4; i++ {
+		toks = append(toks, p.next())
+	}
+	for i := len(toks) - 1; i >= 0; i-- {
+		p.unnext(toks[i])
+	}
+	for i, want := range toks {
+		if got := p.next(); got != want {
+			t.Errorf("token %d\nwant: %v\ngot: %v\n", i, want, got)
+		}
+	}
+	want := []tokenType{tokenRightParen, tokenEOF}
+	for i, typ := range want {
+		if got := p.next(); got.typ != typ {
+			t.Errorf("token %d\nwant: %v\ngot: %v\n", len(toks)+i, typ, got)
+		}
+	}
+}
+
+// TestParserTwoTokenLookahead checks that the parser still works after looking
+// ahead by two tokens, as would be needed to tell a definition apart from an
+// expression that starts with 'def' without committing to either.
+func TestParserTwoTokenLookahead(t *testing.T) {
+	p := newParser("def x 1 app f x")
+	first, second := p.next(), p.next()
+	if first.val != "def" || second.typ != tokenIdentifier {
+		t.Fatalf("unexpected lookahead: %v %v", first, second)
+	}
+	p.unnext(second)
+	p.unnext(first)
+	want := mkdef("x", mknum(1), mkapp(mkident("f"), mkident("x")))
+	if root := p.parse(); !nodesEqual(root, want) {
+		t.Errorf("want: %v\ngot: %v\n", want, root)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	root := parseString("def f lam x app app add x 1 app f (lam y y)")
+	var visited []string
+	counts := make(map[nodeType]int)
+	walk(root, func(n *node) bool {
+		counts[n.typ]++
+		switch v := n.val.(type) {
+		case string:
+			visited = append(visited, v)
+		case *big.Int:
+			visited = append(visited, v.String())
+		case *lamNode:
+			visited = append(visited, "lam "+v.param)
+		case *defNode:
+			visited = append(visited, "def "+v.name)
+		case *appNode:
+			visited = append(visited, "app")
+		}
+		return true
+	})
+	want := "[def f lam x app app add x 1 app f lam y y]"
+	if got := fmt.Sprint(visited); got != want {
+		t.Errorf("visit order\nwant: %s\ngot: %s\n", want, got)
+	}
+	wantCounts := map[nodeType]int{nodeDef: 1, nodeLam: 2, nodeApp: 3, nodeIdentifier: 4, nodeNumber: 1}
+	if fmt.Sprint(counts) != fmt.Sprint(wantCounts) {
+		t.Errorf("node counts\nwant: %v\ngot: %v\n", wantCounts, counts)
+	}
+}
+
+func TestWalkStop(t *testing.T) {
+	root := parseString("app app add x (app f y)")
+	var visited []string
+	ok := walk(root, func(n *node) bool {
+		if n.typ == nodeIdentifier {
+			visited = append(visited, n.val.(string))
+		}
+		return n.typ != nodeIdentifier || n.val != "x"
+	})
+	if ok {
+		t.Errorf("walk returned true after being stopped")
+	}
+	if want := "[add x]"; fmt.Sprint(visited) != want {
+		t.Errorf("want: %s\ngot: %s\n", want, visited)
+	}
+}
+
+func TestCloneNode(t *testing.T) {
+	input := `def f lam x app app add x 1 letrec g lam y when (app isnil y) app g "s" app f 2`
+	root := parseString(input)
+	clone := cloneNode(root)
+	if !nodesEqual(root, clone) {
+		t.Fatalf("want: %v\ngot: %v\n", root, clone)
+	}
+	shared := make(map[interface{}]bool)
+	walk(root, func(n *node) bool {
+		shared[n] = true
+		if num, ok := n.val.(*big.Int); ok {
+			shared[num] = true
+		}
+		return true
+	})
+	walk(clone, func(n *node) bool {
+		if shared[n] {
+			t.Errorf("node shared with the original: %v", n)
+		}
+		if num, ok := n.val.(*big.Int); ok && shared[num] {
+			t.Errorf("number shared with the original: %v", n)
+		}
+		return true
+	})
+
+	// Modify each node in the clone once they've all been found.
+	var nodes []*node
+	walk(clone, func(n *node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+	for _, n := range nodes {
+		switch v := n.val.(type) {
+		case *big.Int:
+			v.SetInt64(42)
+		case *lamNode:
+			v.param = "z"
+		case *appNode:
+			v.arg = mkident("w")
+		case *whenNode:
+			v.unless = true
+		case *letrecNode:
+			v.name = "h"
+		case *defNode:
+			v.name = "e"
+		}
+	}
+	if !nodesEqual(root, parseString(input)) {
+		t.Errorf("original was modified: %v", root)
+	}
+	if cloneNode(nil) != nil {
+		t.Errorf("clone of nil isn't nil")
+	}
+}
+
+func TestBackslashLam(t *testing.T) {
+	for _, input := range []string{`\x app f x`, `\x. app f x`, `(\x.app f x)`} {
+		if got, want := parseString(input), parseString("lam x app f x"); !nodesEqual(got, want) {
+			t.Errorf("input: %q\nwant: %v\ngot: %v\n", input, want, got)
+		}
+	}
+}
+
+// errReader is an io.Reader which always fails with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestStreamParser(t *testing.T) {
+	input := "1 2\n" +
+		"app f\n" +
+		"\n" +
+		"x (lam x\n" +
+		"x) def y\n" +
+		"3 \"a\n" +
+		"b\" ) 5\n" +
+		"4\n" +
+		"app f"
+	want := []string{
+		"1",
+		"2",
+		"(app f x)",
+		"(lam x x)",
+		"(def y 3)",
+		`"a\nb"`,
+		`(error "expecting expression; got ')'")`,
+		"4",
+		`(error "expecting expression; got EOF")`,
+	}
+	sp := newStreamParser(strings.NewReader(input))
+	var got []string
+	for {
+		n, err := sp.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n == nil {
+			break
+		}
+		got = append(got, sexpr(n))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("want: %q\ngot: %q", want, got)
+	}
+
+	readErr := errors.New("read failed")
+	sp = newStreamParser(io.MultiReader(strings.NewReader("1\napp f"), errReader{readErr}))
+	if n, err := sp.next(); err != nil || sexpr(n) != "1" {
+		t.Errorf("want: 1, <nil>\ngot: %v, %v", n, err)
+	}
+	if n, err := sp.next(); n != nil || err != readErr {
+		t.Errorf("want: <nil>, %v\ngot: %v, %v", readErr, n, err)
+	}
+}
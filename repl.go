@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// session contains the state of an interactive session.
+type session struct {
+	env     *environment // environment used to evaluate programs
+	base    *environment // environment that env starts out as and is reset to
+	program string       // lines of the program being entered so far
+	color   bool         // whether to color the output (see colorize)
+
+	// Prompts shown when reading the first line of a program and the lines
+	// after it, respectively
+	mainPrompt, contPrompt string
+}
+
+// newSession creates a new session which starts out with the given
+// environment, e.g. defaultEnvironment.
+func newSession(env *environment) *session {
+	return &session{
+		env:        env,
+		base:       env,
+		mainPrompt: ">> ",
+		contPrompt: ".. ",
+	}
+}
+
+// prompt returns the prompt to show before reading the next line: the main
+// prompt if a new program is starting, or the continuation prompt if the rest
+// of a program is being entered.
+func (s *session) prompt() string {
+	if s.program == "" {
+		return colorize(s.color, colorPrompt, s.mainPrompt)
+	}
+	return colorize(s.color, colorPrompt, s.contPrompt)
+}
+
+// eval evaluates a node within the session environment. Any top-level
+// definitions are added to the session environment so that later programs can
+// refer to them. If the -strict-arity flag is set, the node is checked with
+// arityError first, and if the -max-steps flag is set, evaluation stops after
+// that many function applications.
+func (s *session) eval(n *node) *object {
+	if *strictFlag {
+		if err := arityError(n, s.env); err != nil {
+			return err
+		}
+	}
+	ev := &evaluator{maxSteps: *maxStepsFlag}
+	obj, env := ev.evalDefs(n, s.env)
+	s.env = env
+	return obj
+}
+
+// handleLine processes a line read by the REPL and writes any output to w. A
+// line which starts with a colon is a command, which is run. Otherwise, the
+// line is added to the program being entered, which is evaluated once it's
+// complete. The value of each program which is evaluated successfully is bound
+// to _, shadowing the previous value, so that the next program can refer to it.
+// Since a command can't appear in the middle of a program, only :reset is
+// recognized there, which discards the program. It returns true if the REPL
+// should keep reading the rest of the program.
+func (s *session) handleLine(w io.Writer, line string) bool {
+	if isCommand(line) && (s.program == "" || strings.TrimSpace(line) == ":reset") {
+		s.command(w, line)
+		return false
+	}
+	if trimmed := strings.TrimSpace(line); trimmed != "" {
+		s.program += trimmed + "\n"
+	}
+
+	// Since this language has a simple grammar, we can just attempt to
+	// parse the program entered so far to see if it's valid and then assume
+	// there's more if it ends early.
+	node, errs, more := parseInput(s.program)
+	if more {
+		return true
+	}
+	s.program = ""
+	if node.typ == nodeError {
+		for _, err := range errs {
+			fmt.Fprintln(w, colorize(s.color, colorError, "parse error: "+err.Error()))
+		}
+	} else if output := treeOutput(); output != nil {
+		output(w, node)
+	} else {
+		obj := s.eval(node)
+		if obj.typ == objectError {
+			fmt.Fprintln(w, colorize(s.color, colorError, obj.String()))
+		} else {
+			s.printResult(w, node, obj)
+			s.env = s.env.extend("_", obj)
+		}
+	}
+	return false
+}
+
+// printResult writes the value of a program which was evaluated successfully.
+// If the program consists only of definitions, each one is written along with
+// its value, as :env does, instead of the value of the last one.
+func (s *session) printResult(w io.Writer, n *node, obj *object) {
+	defs := 0
+	for n != nil && n.typ == nodeDef {
+		defs++
+		n = n.val.(*defNode).body
+	}
+	if n != nil {
+		fmt.Fprintln(w, colorize(s.color, colorResult, obj.Text(*baseFlag)))
+		return
+	}
+	// The definitions are the most recent bindings in the environment.
+	bindings := make([]*environment, defs)
+	for i, cur := defs-1, s.env; i >= 0; i, cur = i-1, cur.parent {
+		bindings[i] = cur
+	}
+	for _, b := range bindings {
+		fmt.Fprintln(w, colorize(s.color, colorResult, b.symbol+" = "+b.val.Text(*baseFlag)))
+	}
+}
+
+// ANSI escape sequences for the colors used by the REPL.
+const (
+	colorError  = "\x1b[31m" // red
+	colorResult = "\x1b[32m" // green
+	colorPrompt = "\x1b[36m" // cyan
+	colorReset  = "\x1b[0m"
+)
+
+// colorize returns s wrapped in the escape sequences which display it in the
+// given color, or s as it is if enabled is false.
+func colorize(enabled bool, color, s string) string {
+	if !enabled {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// parseInput parses the program entered so far in the REPL. If the program is
+// incomplete, meaning that it ends in the middle of an expression, such as
+// before a closing parenthesis or within a string, it returns true instead of
+// reporting an error so that the REPL can keep reading. A program with unclosed
+// parentheses is known to be incomplete without parsing it, so it's only lexed,
+// which keeps long multi-line programs responsive while they're being entered.
+// Any parse errors before the parentheses are reported once they're closed.
+func parseInput(program string) (n *node, errs []error, more bool) {
+	if unclosedParens(program) {
+		return nil, nil, true
+	}
+	n, errs = parseAll(program)
+	if n.typ == nodeError && isUnexpectedEOFError(n) {
+		return nil, nil, true
+	}
+	return n, errs, false
+}
+
+// unclosedParens returns true if the program contains a '(' which isn't closed
+// by a matching ')' before the end of the input. It returns false if the
+// program contains a lex error or an unmatched ')', since more input can't fix
+// either of those.
+func unclosedParens(program string) bool {
+	l := newLexer(program)
+	depth := 0
+	for {
+		switch l.nextToken().typ {
+		case tokenLeftParen:
+			depth++
+		case tokenRightParen:
+			if depth--; depth < 0 {
+				return false
+			}
+		case tokenError:
+			return false
+		case tokenEOF:
+			return depth > 0
+		}
+	}
+}
+
+// isCommand returns true if the given line is a REPL command rather than a
+// part of a program. Commands start with a colon.
+func isCommand(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), ":")
+}
+
+// command runs the REPL command contained in line and writes its output to w.
+//
+// Precondition: isCommand(line) is true.
+func (s *session) command(w io.Writer, line string) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ":env":
+		s.printEnv(w)
+	case ":reset":
+		s.env = s.base
+		s.program = ""
+	case ":type":
+		s.printType(w, strings.TrimPrefix(strings.TrimSpace(line), ":type"))
+	default:
+		fmt.Fprintf(w, "unknown command: '%s'\n", fields[0])
+	}
+}
+
+// printEnv writes each symbol in the session environment along with its value,
+// in the order that they were defined. Shadowed symbols are omitted.
+func (s *session) printEnv(w io.Writer) {
+	for _, b := range s.env.bindings() {
+		fmt.Fprintf(w, "%s = %s\n", b.symbol, b.val)
+	}
+}
+
+// printType writes the inferred type of the given program.
+func (s *session) printType(w io.Writer, program string) {
+	n := parseString(program)
+	if n.typ == nodeError {
+		fmt.Fprintln(w, "parse error:", n.val)
+		return
+	}
+	t, err := inferType(n, s.env)
+	if err != nil {
+		fmt.Fprintln(w, "type error:", err)
+		return
+	}
+	fmt.Fprintln(w, t)
+}
+
+// completions returns the keywords and symbols in the session environment that
+// start with the given prefix, in sorted order.
+func (s *session) completions(prefix string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	add := func(word string) {
+		if strings.HasPrefix(word, prefix) && !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	// Keywords are offered as completions along with the symbols in the
+	// session environment.
+	for _, word := range keywords {
+		add(word)
+	}
+	for cur := s.env; cur != nil; cur = cur.parent {
+		add(cur.symbol)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// completer completes identifiers in the REPL using the symbols in a session.
+// It satisfies the readline.AutoCompleter interface.
+type completer struct {
+	s *session
+}
+
+// Do returns the candidates for completing the identifier which ends at pos in
+// line. Each candidate contains only the part that comes after the cursor.
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	start := pos
+	for start > 0 && (isLetter(line[start-1]) || isDigit(line[start-1]) || line[start-1] == '_') {
+		start--
+	}
+	// Identifiers start with a letter, so there's nothing to complete
+	// after a digit.
+	if start < pos && isDigit(line[start]) {
+		return nil, 0
+	}
+	prefix := string(line[start:pos])
+	var candidates [][]rune
+	for _, word := range c.s.completions(prefix) {
+		candidates = append(candidates, []rune(word[len(prefix):]))
+	}
+	return candidates, pos - start
+}
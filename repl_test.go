@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+type commandTest struct {
+	name   string
+	env    *environment
+	line   string
+	output string
+}
+
+var commandTests = []commandTest{
+	{"env", newEnvironment(nil, "add", builtinAdd).extend("if", builtinIf), ":env",
+		"add = <builtin add>\nif = <builtin if>\n"},
+	{"env with definitions",
+		newEnvironment(nil, "add", builtinAdd).extend("gt", builtinGt).
+			extend("x", mknumobj(1)).extend("gt", mknumobj(2)).extend("x", mknumobj(3)),
+		"  :env  ", "add = <builtin add>\ngt = 2\nx = 3\n"},
+	{"type", defaultEnvironment, ":type lam x app app add x 1", "number -> number\n"},
+	{"type error", defaultEnvironment, ":type app add true", "type error: type mismatch: number and bool\n"},
+	{"type letrec definition", defaultEnvironment.extend("f", evalEnv(parseString("letrec g lam n app g n g"), defaultEnvironment)),
+		":type f", "a -> b\n"},
+	{"type parse error", defaultEnvironment, ":type app add", "parse error: expecting expression; got EOF\n"},
+	{"unknown command", defaultEnvironment, ":foo bar", "unknown command: ':foo'\n"},
+}
+
+func TestCommand(t *testing.T) {
+	for _, ct := range commandTests {
+		if !isCommand(ct.line) {
+			t.Errorf("[%s]\nnot a command: %q", ct.name, ct.line)
+			continue
+		}
+		s := newSession(defaultEnvironment)
+		s.env = ct.env
+		var buf bytes.Buffer
+		s.command(&buf, ct.line)
+		if buf.String() != ct.output {
+			t.Errorf("[%s]\ninput: %q\nwant: %q\ngot: %q\n", ct.name, ct.line, ct.output, buf.String())
+		}
+	}
+}
+
+func TestParseInput(t *testing.T) {
+	tests := []struct {
+		input string
+		more  bool
+		err   string
+	}{
+		{"app app add 1 2", false, ""},
+		{"app app add 1", true, ""},
+		{"(lam x", true, ""},
+		{"(lam x x", true, ""},
+		{"(lam x x)", false, ""},
+		{"app ((lam x x)\n", true, ""},
+		{"app (lam x x) 1)", false, "expecting EOF; got ')'"},
+		{"def f 1", false, ""},
+		{"def f", true, ""},
+		{"(lam x (app", true, ""},
+		{`"abc`, true, ""},
+		{"app (lam x x) \"ab\ncd", true, ""},
+		{`app "abc" "de`, true, ""},
+		{`"abc\`, true, ""},
+		{`app ) "abc`, false, "expecting expression; got ')'"},
+		{`"a\tb"`, false, `bad escape sequence in string: '"a\t'`},
+		{"app add ?", false, "illegal character: '?' at line 1, column 9, near 'app add ?'"},
+	}
+	for _, tt := range tests {
+		n, errs, more := parseInput(tt.input)
+		if more != tt.more {
+			t.Errorf("%q\nwant more: %v\ngot: %v", tt.input, tt.more, more)
+			continue
+		}
+		if more {
+			continue
+		}
+		var err string
+		if n.typ == nodeError {
+			err = fmt.Sprint(errs[0])
+		}
+		if err != tt.err {
+			t.Errorf("%q\nwant error: %q\ngot: %q", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestSessionDefinitions(t *testing.T) {
+	lines := []struct {
+		input, output string
+	}{
+		{"def double lam x app app add x x", "<lam x>"},
+		{"app double 4", "8"},
+		{"def x", "parse error: expecting expression; got EOF"},
+		{"def x app double true", "add: not a number: 'true'"},
+		{"x", "unknown identifier: 'x'"},
+		{"def double lam x app app add x 2", "<lam x>"},
+		{"app double 4", "6"},
+		{"def y 1 def y app double y y", "3"},
+		{"y", "3"},
+	}
+	s := newSession(defaultEnvironment)
+	for _, line := range lines {
+		n := parseString(line.input)
+		var got string
+		if n.typ == nodeError {
+			got = fmt.Sprint("parse error: ", n.val)
+		} else {
+			got = s.eval(n).String()
+		}
+		if got != line.output {
+			t.Errorf("input: %q\nwant: %q\ngot: %q\n", line.input, line.output, got)
+		}
+	}
+}
+
+func TestHandleLine(t *testing.T) {
+	lines := []struct {
+		input, output string
+		more          bool
+	}{
+		{"def double lam x app app add x x", "double = <lam x>\n", false},
+		{"app double 4", "8\n", false},
+		{":reset", "", false},
+		{"app double 4", "unknown identifier: 'double'\n", false},
+		{"app app add 1 2", "3\n", false},
+		{"app app add", "", true},
+		{"1", "", true},
+		{"2", "3\n", false},
+		{"def x 1", "x = 1\n", false},
+		{"app app add", "", true},
+		{":reset", "", false},
+		{"x", "unknown identifier: 'x'\n", false},
+		{"app add ?", "parse error: illegal character: '?' at line 1, column 9, near 'app add ?'\n", false},
+		{":foo", "unknown command: ':foo'\n", false},
+		{"def a 1 def b 2 def a 3", "a = 1\nb = 2\na = 3\n", false},
+		{"def c 1 app app add c 1", "2\n", false},
+	}
+	s := newSession(defaultEnvironment)
+	for _, line := range lines {
+		var buf bytes.Buffer
+		more := s.handleLine(&buf, line.input)
+		if buf.String() != line.output || more != line.more {
+			t.Errorf("input: %q\nwant: %q (more: %v)\ngot: %q (more: %v)\n",
+				line.input, line.output, line.more, buf.String(), more)
+		}
+	}
+}
+
+func TestHandleLineLastResult(t *testing.T) {
+	lines := []struct {
+		input, output string
+	}{
+		{"_", "unknown identifier: '_'\n"},
+		{"app app add 1 2", "3\n"},
+		{"app app add _ 1", "4\n"},
+		{"app app add _ true", "add: not a number: 'true'\n"},
+		{"_", "4\n"},
+		{"def double lam x app app add x x", "double = <lam x>\n"},
+		{"app _ 5", "10\n"},
+		{"def x 1 app app add x _", "11\n"},
+		{":reset", ""},
+		{"_", "unknown identifier: '_'\n"},
+	}
+	s := newSession(defaultEnvironment)
+	for _, line := range lines {
+		var buf bytes.Buffer
+		s.handleLine(&buf, line.input)
+		if buf.String() != line.output {
+			t.Errorf("input: %q\nwant: %q\ngot: %q\n", line.input, line.output, buf.String())
+		}
+	}
+}
+
+func TestHandleLineLastResultShadowed(t *testing.T) {
+	s := newSession(defaultEnvironment)
+	for _, line := range []string{"1", "2", "3"} {
+		s.handleLine(ioutil.Discard, line)
+	}
+	if got := s.env.lookup("_"); !got.Equal(mknumobj(3)) {
+		t.Errorf("want: _ = 3\ngot: %v", got)
+	}
+	symbols := 0
+	for _, symbol := range s.env.Symbols() {
+		if symbol == "_" {
+			symbols++
+		}
+	}
+	if symbols != 1 {
+		t.Errorf("want: _ listed once\ngot: %d", symbols)
+	}
+}
+
+func TestColorize(t *testing.T) {
+	tests := []struct {
+		enabled bool
+		color   string
+		s       string
+		want    string
+	}{
+		{false, colorError, "oops", "oops"},
+		{true, colorError, "oops", "\x1b[31moops\x1b[0m"},
+		{true, colorResult, "3", "\x1b[32m3\x1b[0m"},
+		{true, colorPrompt, ">> ", "\x1b[36m>> \x1b[0m"},
+	}
+	for _, tt := range tests {
+		if got := colorize(tt.enabled, tt.color, tt.s); got != tt.want {
+			t.Errorf("colorize(%v, %q, %q)\nwant: %q\ngot: %q", tt.enabled, tt.color, tt.s, tt.want, got)
+		}
+	}
+}
+
+func TestHandleLineColor(t *testing.T) {
+	lines := []struct {
+		input, output string
+	}{
+		{"app app add 1 2", "\x1b[32m3\x1b[0m\n"},
+		{"app add true", "\x1b[31madd: not a number: 'true'\x1b[0m\n"},
+		{"app add )", "\x1b[31mparse error: expecting expression; got ')'\x1b[0m\n"},
+	}
+	s := newSession(defaultEnvironment)
+	s.color = true
+	for _, line := range lines {
+		var buf bytes.Buffer
+		s.handleLine(&buf, line.input)
+		if buf.String() != line.output {
+			t.Errorf("input: %q\nwant: %q\ngot: %q\n", line.input, line.output, buf.String())
+		}
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	s := newSession(defaultEnvironment)
+	steps := []struct {
+		line   string // line to handle before checking the prompt, if any
+		prompt string
+	}{
+		{"", ">> "},
+		{"app app add 1", ".. "},
+		{"", ".. "},
+		{"2", ">> "},
+	}
+	for _, step := range steps {
+		if step.line != "" {
+			s.handleLine(new(bytes.Buffer), step.line)
+		}
+		if got := s.prompt(); got != step.prompt {
+			t.Errorf("after %q\nwant: %q\ngot: %q", step.line, step.prompt, got)
+		}
+	}
+
+	s.mainPrompt, s.contPrompt = "lam> ", "...> "
+	s.handleLine(new(bytes.Buffer), "app lam x x")
+	if got := s.prompt(); got != "...> " {
+		t.Errorf("custom continuation prompt\nwant: %q\ngot: %q", "...> ", got)
+	}
+	s.color = true
+	s.handleLine(new(bytes.Buffer), "1")
+	if got, want := s.prompt(), "\x1b[36mlam> \x1b[0m"; got != want {
+		t.Errorf("custom colored prompt\nwant: %q\ngot: %q", want, got)
+	}
+}
+
+type completionTest struct {
+	name       string
+	line       string
+	pos        int
+	candidates []string
+	prefixLen  int
+}
+
+var completionTests = []completionTest{
+	{"empty line", "", 0, []string{"_", "add", "app", "def", "double", "gt", "if", "lam", "letrec", "seq", "unless", "when"}, 0},
+	{"keyword and builtin", "a", 1, []string{"dd", "pp"}, 1},
+	{"session definition", "app do", 6, []string{"uble"}, 2},
+	{"complete word", "app add", 7, []string{""}, 3},
+	{"cursor in the middle", "app gt 1 2", 5, []string{"t"}, 1},
+	{"after paren", "(l", 2, []string{"am", "etrec"}, 1},
+	{"no match", "app z", 5, nil, 1},
+	{"number", "app 1", 5, nil, 0},
+	{"underscore", "app _", 5, []string{""}, 1},
+}
+
+func TestCompleter(t *testing.T) {
+	s := newSession(defaultEnvironment)
+	s.env = newEnvironment(nil, "add", builtinAdd).extend("if", builtinIf).extend("gt", builtinGt).
+		extend("double", mknumobj(1)).extend("add", mknumobj(2)).extend("_", mknumobj(3))
+	c := &completer{s}
+	for _, ct := range completionTests {
+		candidates, n := c.Do([]rune(ct.line), ct.pos)
+		var got []string
+		for _, cand := range candidates {
+			got = append(got, string(cand))
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", ct.candidates) || n != ct.prefixLen {
+			t.Errorf("[%s]\ninput: %q (pos %d)\nwant: %q, %d\ngot: %q, %d\n",
+				ct.name, ct.line, ct.pos, ct.candidates, ct.prefixLen, got, n)
+		}
+	}
+}